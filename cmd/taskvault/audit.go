@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/audit"
+	"github.com/taskvault/taskvault/internal/config"
+)
+
+var (
+	auditSince  string
+	auditTask   string
+	auditFormat string
+	auditTop    int
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Summarize the audit log",
+	Long: `Reads the audit log, including rotated files, and reports the hit/miss
+ratio and bytes served per task and per day, the keys that missed most
+and errors by type. Only lookups count as hits and misses, not saves.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if auditTop < 0 {
+			return fmt.Errorf("invalid --top %d: must be 0 or more", auditTop)
+		}
+
+		var filter audit.Filter
+		if auditSince != "" {
+			since, err := parseSince(auditSince)
+			if err != nil {
+				return err
+			}
+			filter.Since = since
+		}
+		filter.Task = auditTask
+
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		report, err := audit.Summarize(audit.LogPath(cfg.CacheDir), filter, auditTop)
+		if err != nil {
+			return err
+		}
+
+		switch auditFormat {
+		case "table":
+			return printAuditTable(report)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(report)
+		case "csv":
+			return printAuditCSV(report)
+		default:
+			return fmt.Errorf("invalid format %q: must be table, json or csv", auditFormat)
+		}
+	},
+}
+
+// parseSince accepts an age (7d, 12h), a date (2006-01-02) or an RFC 3339
+// time
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	age, err := parseAge(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q: use an age (7d, 12h) or a date (2006-01-02)", s)
+	}
+	return time.Now().Add(-age), nil
+}
+
+func printAuditTable(report *audit.Report) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printCounts := func(name string, c audit.Counts) {
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%.1f%%\t%d\t%.2f MB\n",
+			name, c.Hits, c.Misses, c.HitRate*100, c.Errors, float64(c.BytesServed)/1024/1024)
+	}
+
+	fmt.Fprintf(w, "By task\n")
+	fmt.Fprintf(w, "  TASK\tHITS\tMISSES\tHIT RATE\tERRORS\tSERVED\n")
+	for _, task := range report.Tasks {
+		name := task.Task
+		if name == "" {
+			name = "-"
+		}
+		printCounts(name, task.Counts)
+	}
+	printCounts("total", report.Totals)
+
+	fmt.Fprintf(w, "\nBy day\n")
+	fmt.Fprintf(w, "  DAY\tHITS\tMISSES\tHIT RATE\tERRORS\tSERVED\n")
+	for _, day := range report.Days {
+		printCounts(day.Day, day.Counts)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.TopMisses) > 0 {
+		fmt.Printf("\nTop missing keys\n")
+		for _, miss := range report.TopMisses {
+			fmt.Fprintf(w, "  %s\t%s\t%d\n", miss.Task, shortHash(miss.Hash), miss.Misses)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		fmt.Printf("\nErrors\n")
+		for _, e := range report.Errors {
+			fmt.Fprintf(w, "  %s\t%d\n", e.Type, e.Count)
+		}
+	}
+	return w.Flush()
+}
+
+// printAuditCSV writes every section of the report as rows of one table,
+// told apart by the first column
+func printAuditCSV(report *audit.Report) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"section", "name", "hash", "hits", "misses", "errors", "hit_rate", "bytes_served"})
+
+	row := func(section, name, hash string, c audit.Counts) {
+		w.Write([]string{
+			section, name, hash,
+			strconv.FormatInt(c.Hits, 10),
+			strconv.FormatInt(c.Misses, 10),
+			strconv.FormatInt(c.Errors, 10),
+			strconv.FormatFloat(c.HitRate, 'f', 4, 64),
+			strconv.FormatInt(c.BytesServed, 10),
+		})
+	}
+	row("total", "", "", report.Totals)
+	for _, task := range report.Tasks {
+		row("task", task.Task, "", task.Counts)
+	}
+	for _, day := range report.Days {
+		row("day", day.Day, "", day.Counts)
+	}
+	for _, miss := range report.TopMisses {
+		row("miss", miss.Task, miss.Hash, audit.Counts{Misses: miss.Misses})
+	}
+	for _, e := range report.Errors {
+		row("error", e.Type, "", audit.Counts{Errors: e.Count})
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func init() {
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "only records newer than an age (e.g. 7d, 12h) or a date (2006-01-02)")
+	auditCmd.Flags().StringVar(&auditTask, "task", "", "only records of this task")
+	auditCmd.Flags().StringVar(&auditFormat, "format", "table", "output format: table, json or csv")
+	auditCmd.Flags().IntVar(&auditTop, "top", 10, "number of top missing keys to list")
+
+	rootCmd.AddCommand(auditCmd)
+}
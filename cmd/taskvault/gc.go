@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/cache"
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+var (
+	gcGrace  string
+	gcRemote bool
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove expired entries and orphaned blobs",
+	Long: `Reconciles the blob and chunk directories with the index: removes expired
+entries, entries whose blob files are gone, blobs and chunks no entry uses,
+and files no entry refers to. Files younger than the grace period are kept,
+as they may belong to a save in progress.
+
+With --remote, collects the S3 remote instead: deleting entries there leaves
+their blobs and chunks in the bucket, as other entries may share them.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		grace, err := parseAge(gcGrace)
+		if err != nil {
+			return err
+		}
+
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		manager, err := cache.NewManagerFromConfig(cfg)
+		if err != nil {
+			return err
+		}
+		defer manager.Close()
+
+		gc := manager.GC
+		if gcRemote {
+			gc = manager.GCRemote
+		}
+		report, err := gc(storage.GCOptions{GracePeriod: grace})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %d expired entries, %d dangling entries\n", report.ExpiredEntries, report.DanglingEntries)
+		fmt.Printf("Removed %d unused blobs, %d unused chunks, %d orphaned files\n",
+			report.UnusedBlobs, report.UnusedChunks, report.OrphanedFiles)
+		fmt.Printf("✓ Reclaimed %.2f MB\n", float64(report.ReclaimedBytes)/1024/1024)
+		return nil
+	},
+}
+
+func init() {
+	gcCmd.Flags().StringVar(&gcGrace, "grace", "1h", "keep orphaned files younger than this (e.g. 30m, 2d)")
+	gcCmd.Flags().BoolVar(&gcRemote, "remote", false, "collect the S3 remote instead of the local cache")
+
+	cacheCmd.AddCommand(gcCmd)
+}
@@ -1,20 +1,47 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/archive"
 	"github.com/taskvault/taskvault/internal/cache"
 	"github.com/taskvault/taskvault/internal/config"
-	"github.com/taskvault/taskvault/internal/hash"
+	"github.com/taskvault/taskvault/internal/storage"
 )
 
 var (
 	version = "0.1.0"
 	cfgFile string
 	verbose bool
+
+	// Cache key inputs shared by save/get
+	taskVersion  string
+	envVars      []string
+	toolVersions map[string]string
+	withPlatform bool
+
+	// Repeated --input patterns and --output paths for save/get
+	inputPatterns []string
+	outputPaths   []string
+
+	// Tags recorded on save/run, filtered on by invalidate
+	saveTags []string
+
+	invalidateOlderThan string
+	invalidateTag       string
+
+	statsJSON bool
 )
 
 var rootCmd = &cobra.Command{
@@ -22,6 +49,9 @@ var rootCmd = &cobra.Command{
 	Short:   "Intelligent task result caching for CI/CD and data pipelines",
 	Long:    `TaskVault: Cache results of deterministic tasks using content-aware hashing. Never recompute the same work.`,
 	Version: version,
+
+	PersistentPreRunE: startTracing,
+	SilenceErrors:     true,
 }
 
 var cacheCmd = &cobra.Command{
@@ -30,13 +60,11 @@ var cacheCmd = &cobra.Command{
 }
 
 var saveCmd = &cobra.Command{
-	Use:   "save <task_name> <input_file> <output_file>",
+	Use:   "save <task_name> [<input_file>] [<output_file>]",
 	Short: "Save task output to cache",
-	Args:  cobra.ExactArgs(3),
+	Args:  saveArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		taskName := args[0]
-		inputFile := args[1]
-		outputFile := args[2]
 
 		cfg, err := config.LoadFromFile(cfgFile)
 		if err != nil {
@@ -47,42 +75,55 @@ var saveCmd = &cobra.Command{
 			return err
 		}
 
-		manager, err := cache.NewManager(cfg.CacheDir, cfg.MaxSizeGB, hash.HashAlgorithm(cfg.HashAlgo))
+		manager, err := cache.NewManagerFromConfig(cfg)
 		if err != nil {
 			return err
 		}
 		defer manager.Close()
 
-		// Read input and output files
-		inputData, err := os.ReadFile(inputFile)
+		inputHash, err := resolveInputHash(cmd.Context(), manager, args)
 		if err != nil {
-			return fmt.Errorf("cannot read input: %w", err)
+			return err
 		}
 
-		outputData, err := os.ReadFile(outputFile)
+		// Output trees are archived; a single output file is stored as is
+		if len(outputPaths) > 0 {
+			hash, err := manager.SaveOutputsContext(cmd.Context(), taskKey(taskName), inputHash, outputPaths, tagMetadata())
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✓ Cached %s (hash: %s, outputs: %s)\n", taskName, hash[:12], strings.Join(outputPaths, ", "))
+			return nil
+		}
+
+		outputFile, err := os.Open(args[len(args)-1])
 		if err != nil {
 			return fmt.Errorf("cannot read output: %w", err)
 		}
+		defer outputFile.Close()
 
-		// Save to cache
-		hash, err := manager.SaveResult(taskName, inputData, outputData, nil)
+		hash, err := manager.SaveStreamContext(cmd.Context(), taskKey(taskName), inputHash, outputFile, tagMetadata())
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("✓ Cached %s (hash: %s, size: %d bytes)\n", taskName, hash[:12], len(outputData))
+		info, err := outputFile.Stat()
+		if err != nil {
+			return fmt.Errorf("cannot read output: %w", err)
+		}
+
+		fmt.Printf("✓ Cached %s (hash: %s, size: %d bytes)\n", taskName, hash[:12], info.Size())
 		return nil
 	},
 }
 
 var getCmd = &cobra.Command{
-	Use:   "get <task_name> <input_file> <output_file>",
+	Use:   "get <task_name> [<input_file>] [<output_file>]",
 	Short: "Retrieve cached result or indicate miss",
-	Args:  cobra.ExactArgs(3),
+	Args:  getArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		taskName := args[0]
-		inputFile := args[1]
-		outputFile := args[2]
 
 		cfg, err := config.LoadFromFile(cfgFile)
 		if err != nil {
@@ -93,20 +134,19 @@ var getCmd = &cobra.Command{
 			return err
 		}
 
-		manager, err := cache.NewManager(cfg.CacheDir, cfg.MaxSizeGB, hash.HashAlgorithm(cfg.HashAlgo))
+		manager, err := cache.NewManagerFromConfig(cfg)
 		if err != nil {
 			return err
 		}
 		defer manager.Close()
 
-		// Read input file
-		inputData, err := os.ReadFile(inputFile)
+		inputHash, err := resolveInputHash(cmd.Context(), manager, args)
 		if err != nil {
-			return fmt.Errorf("cannot read input: %w", err)
+			return err
 		}
 
 		// Get from cache
-		output, metadata, hit, err := manager.GetResult(taskName, inputData)
+		blob, metadata, hit, err := manager.OpenResultContext(cmd.Context(), taskKey(taskName), inputHash)
 		if err != nil {
 			return err
 		}
@@ -115,13 +155,42 @@ var getCmd = &cobra.Command{
 			fmt.Printf("✗ Cache miss for %s\n", taskName)
 			return nil
 		}
-
-		// Write output file
-		if err := os.WriteFile(outputFile, output, 0644); err != nil {
-			return fmt.Errorf("cannot write output: %w", err)
+		defer blob.Close()
+
+		if cache.HasOutputs(metadata) {
+			// Output trees restore to the paths they were saved from
+			manifest, err := archive.Unpack(blob, ".")
+			if errors.Is(err, storage.ErrCorrupt) {
+				fmt.Printf("✗ Cache miss for %s (cached entry was corrupted)\n", taskName)
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("cannot restore outputs: %w", err)
+			}
+
+			fmt.Printf("✓ Cache hit for %s (restored %s, %d files)\n", taskName, strings.Join(manifest.Roots, ", "), len(manifest.Files))
+		} else {
+			minArgs := 2
+			if len(inputPatterns) > 0 {
+				minArgs = 1
+			}
+			if len(args) <= minArgs {
+				return fmt.Errorf("cached result for %s is a single file; <output_file> is required", taskName)
+			}
+
+			// Write output file
+			size, err := writeFileAtomic(args[len(args)-1], blob)
+			if errors.Is(err, storage.ErrCorrupt) {
+				fmt.Printf("✗ Cache miss for %s (cached entry was corrupted)\n", taskName)
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("cannot write output: %w", err)
+			}
+
+			fmt.Printf("✓ Cache hit for %s (size: %d bytes)\n", taskName, size)
 		}
 
-		fmt.Printf("✓ Cache hit for %s (size: %d bytes)\n", taskName, len(output))
 		if verbose {
 			fmt.Printf("  Metadata: %+v\n", metadata)
 		}
@@ -130,6 +199,47 @@ var getCmd = &cobra.Command{
 	},
 }
 
+var invalidateCmd = &cobra.Command{
+	Use:   "invalidate <task_name>",
+	Short: "Remove cached results for a task",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		taskName := args[0]
+
+		filter := cache.InvalidateFilter{Tag: invalidateTag}
+		if invalidateOlderThan != "" {
+			age, err := parseAge(invalidateOlderThan)
+			if err != nil {
+				return err
+			}
+			filter.OlderThan = age
+		}
+
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		manager, err := cache.NewManagerFromConfig(cfg)
+		if err != nil {
+			return err
+		}
+		defer manager.Close()
+
+		removed, err := manager.InvalidateTaskFilteredContext(cmd.Context(), taskName, filter)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("✓ Invalidated %d entries for %s\n", removed, taskName)
+		return nil
+	},
+}
+
 var statsCmd = &cobra.Command{
 	Use:   "stats",
 	Short: "Show cache statistics",
@@ -143,25 +253,52 @@ var statsCmd = &cobra.Command{
 			return err
 		}
 
-		manager, err := cache.NewManager(cfg.CacheDir, cfg.MaxSizeGB, hash.HashAlgorithm(cfg.HashAlgo))
+		manager, err := cache.NewManagerFromConfig(cfg)
 		if err != nil {
 			return err
 		}
 		defer manager.Close()
 
-		stats, err := manager.GetStats()
+		stats, err := manager.GetStatsContext(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		tasks, err := manager.TaskStatsContext(cmd.Context())
 		if err != nil {
 			return err
 		}
 
+		if statsJSON {
+			stats["tasks"] = tasks
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(stats)
+		}
+
 		fmt.Printf("TaskVault Cache Statistics\n")
 		fmt.Printf("==========================\n")
 		fmt.Printf("Entries:        %v\n", stats["entries"])
 		fmt.Printf("Total Size:     %.2f MB\n", float64(stats["total_size"].(int64))/1024/1024)
+		fmt.Printf("Logical Size:   %.2f MB (dedup %.2fx, compression %.2fx)\n",
+			float64(stats["logical_size"].(int64))/1024/1024, stats["dedup_ratio"], stats["compression_ratio"])
 		fmt.Printf("Cache Limit:    %.2f GB\n", float64(stats["cache_limit"].(int64))/1024/1024/1024)
 		fmt.Printf("Usage:          %.1f%%\n", stats["usage_percent"])
+		fmt.Printf("Hits:           %d of %d lookups (%.1f%%)\n",
+			stats["hits"], stats["hits"].(int64)+stats["misses"].(int64), stats["hit_rate"].(float64)*100)
+		fmt.Printf("Time Saved:     %s (estimated)\n", formatMillis(stats["time_saved_ms"].(int64)))
 
-		return nil
+		if len(tasks) == 0 {
+			return nil
+		}
+		fmt.Printf("\n")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "TASK\tENTRIES\tSIZE\tHITS\tMISSES\tHIT RATE\tTIME SAVED\n")
+		for _, t := range tasks {
+			fmt.Fprintf(w, "%s\t%d\t%.2f MB\t%d\t%d\t%.1f%%\t%s\n",
+				t.Task, t.Entries, float64(t.Size)/1024/1024, t.Hits, t.Misses, t.HitRate*100, formatMillis(t.TimeSavedMS))
+		}
+		return w.Flush()
 	},
 }
 
@@ -185,18 +322,149 @@ var initCmd = &cobra.Command{
 	},
 }
 
+// formatMillis formats a duration in milliseconds to the second, e.g. 3h12m5s
+func formatMillis(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).Round(time.Second).String()
+}
+
+// saveArgs validates save positional args: <task_name>, then <input_file>
+// unless --input is given, then <output_file> unless --output is given
+func saveArgs(cmd *cobra.Command, args []string) error {
+	n := 1
+	if len(inputPatterns) == 0 {
+		n++
+	}
+	if len(outputPaths) == 0 {
+		n++
+	}
+	return cobra.ExactArgs(n)(cmd, args)
+}
+
+// getArgs validates get positional args: <task_name>, then <input_file>
+// unless --input is given, then an optional <output_file> (required only
+// when the cached result is a single file)
+func getArgs(cmd *cobra.Command, args []string) error {
+	n := 1
+	if len(inputPatterns) == 0 {
+		n++
+	}
+	return cobra.RangeArgs(n, n+1)(cmd, args)
+}
+
+// resolveInputHash hashes the --input patterns, or the <input_file>
+// positional argument when no patterns are given
+func resolveInputHash(ctx context.Context, manager *cache.Manager, args []string) (string, error) {
+	if len(inputPatterns) > 0 {
+		return manager.HashInputsContext(ctx, inputPatterns)
+	}
+	return manager.HashInputFileContext(ctx, args[1])
+}
+
+// writeFileAtomic streams r into a temporary file next to path and renames
+// it into place, so an interrupted restore never leaves a truncated file
+func writeFileAtomic(path string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".taskvault-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, err
+	}
+
+	return size, os.Rename(tmp.Name(), path)
+}
+
+// tagMetadata returns user metadata carrying the --tag values, if any
+func tagMetadata() map[string]interface{} {
+	if len(saveTags) == 0 {
+		return nil
+	}
+	return map[string]interface{}{cache.MetadataTags: saveTags}
+}
+
+// parseAge parses a duration that may use a "d" (days) suffix, e.g. "7d"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	age, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q: %w", s, err)
+	}
+	return age, nil
+}
+
+// taskKey builds the composite cache key from the task name and key flags
+func taskKey(taskName string) cache.TaskKey {
+	env := cache.EnvInputs{
+		Vars:     envVars,
+		Tools:    toolVersions,
+		Platform: withPlatform,
+	}
+
+	return cache.TaskKey{
+		Name:    taskName,
+		Version: taskVersion,
+		Env:     env.Resolve(),
+	}
+}
+
+// addKeyFlags registers the flags that feed into the cache key
+func addKeyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&taskVersion, "task-version", "", "task version (change to invalidate cached results)")
+	cmd.Flags().StringSliceVar(&envVars, "env", nil, "environment variable names the task depends on")
+	cmd.Flags().StringToStringVar(&toolVersions, "tool", nil, "tool versions the task depends on (name=version)")
+	cmd.Flags().BoolVar(&withPlatform, "platform", false, "include OS/architecture in the cache key")
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", ".taskvault/config.yaml", "config file path")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace-file", "", "append OpenTelemetry spans of the command to this file as JSON (overrides tracing.file)")
 
 	rootCmd.AddCommand(initCmd)
 
-	cacheCmd.AddCommand(saveCmd, getCmd, statsCmd)
+	for _, cmd := range []*cobra.Command{saveCmd, getCmd} {
+		addKeyFlags(cmd)
+		cmd.Flags().StringArrayVar(&inputPatterns, "input", nil, "input file, directory or glob (repeatable, ** matches any depth)")
+	}
+	saveCmd.Flags().StringArrayVar(&outputPaths, "output", nil, "output file or directory to archive (repeatable)")
+	saveCmd.Flags().StringArrayVar(&saveTags, "tag", nil, "tag to record with the entry (repeatable)")
+
+	invalidateCmd.Flags().StringVar(&invalidateOlderThan, "older-than", "", "only entries older than this age (e.g. 7d, 12h)")
+	invalidateCmd.Flags().StringVar(&invalidateTag, "tag", "", "only entries saved with this tag")
+
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "print statistics as JSON, with per-task counters")
+
+	cacheCmd.AddCommand(saveCmd, getCmd, invalidateCmd, statsCmd)
 	rootCmd.AddCommand(cacheCmd)
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	stopTracing(err)
+	if err != nil {
+		// Wrapped commands exit with their own code, without extra noise
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
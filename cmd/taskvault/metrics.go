@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/metrics"
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+var metricsListen string
+
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Print or serve cache metrics in the Prometheus text format",
+	Long: `Prints the cache's size and the per-task lookup, time saved and eviction
+counters kept in its database, which cover every process sharing the cache
+directory, e.g. for node_exporter's textfile collector. With --listen,
+serves them on /metrics for Prometheus to scrape instead.
+
+Counts of this or any other process's own gets and saves are not included;
+programs using the SDK export those through their MetricsHandler.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		// Only the store's series: a manager's per-process counters would
+		// stay at zero here, as this process does no gets or saves
+		store, err := storage.NewStore(cfg.CacheDir, cfg.MaxSizeGB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		reg := metrics.NewRegistry()
+		store.RegisterMetrics(reg)
+		if metricsListen == "" {
+			return reg.WriteText(os.Stdout)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", reg.Handler())
+		server := &http.Server{
+			Addr:              metricsListen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+
+		fmt.Printf("✓ Serving metrics on http://%s/metrics\n", server.Addr)
+
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+		}
+
+		if err := server.Shutdown(context.Background()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("shutdown error: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	metricsCmd.Flags().StringVar(&metricsListen, "listen", "", "serve metrics on this address (e.g. :9101) instead of printing them")
+
+	rootCmd.AddCommand(metricsCmd)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/cache"
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/tracing"
+)
+
+var (
+	runTask          string
+	runInputs        []string
+	runOutputs       []string
+	runCacheFailures bool
+)
+
+// maxCapturedOutput bounds how much of each of a run's stdout and stderr
+// is cached for replay; the rest is only shown live
+const maxCapturedOutput = 1 << 20
+
+// exitCodeError carries a wrapped command's exit code back to main
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.code)
+}
+
+var runCmd = &cobra.Command{
+	Use:   "run --task <name> --inputs <glob>... [--outputs <path>...] -- <command> [args...]",
+	Short: "Run a command, restoring its outputs from cache when inputs are unchanged",
+	Args:  cobra.MinimumNArgs(1),
+	// A failing wrapped command is not a usage problem
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if runTask == "" {
+			return fmt.Errorf("--task is required")
+		}
+		// Without inputs every run of the task would share one entry,
+		// whatever the working tree holds
+		if len(runInputs) == 0 {
+			return fmt.Errorf("--inputs is required")
+		}
+
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		manager, err := cache.NewManagerFromConfig(cfg)
+		if err != nil {
+			return err
+		}
+		defer manager.Close()
+
+		key := runKey(args)
+		inputHash, err := manager.HashInputsContext(cmd.Context(), runInputs)
+		if err != nil {
+			return err
+		}
+
+		metadata, hit, err := manager.RestoreOutputsContext(cmd.Context(), key, inputHash, ".")
+		if err != nil {
+			return err
+		}
+
+		for !hit {
+			// Parallel jobs missing on the same key run the command once
+			lease, err := manager.AcquireLeaseContext(cmd.Context(), key, inputHash)
+			if err != nil {
+				return err
+			}
+			if lease != nil {
+				defer lease.Release()
+				fmt.Fprintf(os.Stderr, "✗ Cache miss for %s, running: %s\n", runTask, strings.Join(args, " "))
+				return executeRun(cmd.Context(), manager, key, inputHash, args)
+			}
+
+			// Another job ran it while this one waited
+			if metadata, hit, err = manager.RestoreOutputsContext(cmd.Context(), key, inputHash, "."); err != nil {
+				return err
+			}
+		}
+		return replayRun(metadata)
+	},
+}
+
+// runKey extends the task key with the command line and declared outputs,
+// so changing either never reuses a stale result
+func runKey(args []string) cache.TaskKey {
+	key := taskKey(runTask)
+	key.Env["run:command"] = fmt.Sprintf("%q", args)
+	key.Env["run:outputs"] = fmt.Sprintf("%q", runOutputs)
+	return key
+}
+
+// executeRun runs the command, teeing its output, and caches the result
+func executeRun(ctx context.Context, manager *cache.Manager, key cache.TaskKey, inputHash string, args []string) error {
+	stdout := &cappedBuffer{limit: maxCapturedOutput}
+	stderr := &cappedBuffer{limit: maxCapturedOutput}
+
+	command := exec.Command(args[0], args[1:]...)
+	command.Stdin = os.Stdin
+	command.Stdout = io.MultiWriter(os.Stdout, stdout)
+	command.Stderr = io.MultiWriter(os.Stderr, stderr)
+
+	_, span := tracing.Start(ctx, "run.command", tracing.Task.String(key.Name))
+	start := time.Now()
+	exitCode := 0
+	err := command.Run()
+	tracing.End(span, err)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("cannot run command: %w", err)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	duration := time.Since(start)
+
+	if exitCode != 0 && !runCacheFailures {
+		return &exitCodeError{code: exitCode}
+	}
+
+	metadata := map[string]interface{}{
+		"command":              args,
+		"exit_code":            exitCode,
+		"stdout":               stdout.String(),
+		"stderr":               stderr.String(),
+		cache.MetadataDuration: duration.Milliseconds(),
+	}
+	if len(saveTags) > 0 {
+		metadata[cache.MetadataTags] = saveTags
+	}
+
+	cacheKey, err := manager.SaveOutputsContext(ctx, key, inputHash, runOutputs, metadata)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "⚠ Not caching %s: %v\n", key.Name, err)
+		return exitResult(exitCode)
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "✓ Cached %s (hash: %s)\n", key.Name, cacheKey[:12])
+	}
+	return exitResult(exitCode)
+}
+
+// cappedBuffer keeps the first limit bytes written to it and counts the
+// rest, which String reports as truncated
+type cappedBuffer struct {
+	buf     []byte
+	limit   int
+	dropped int64
+}
+
+// Write never fails, so the live output it is teed from carries on
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	keep := min(len(p), b.limit-len(b.buf))
+	b.buf = append(b.buf, p[:keep]...)
+	b.dropped += int64(len(p) - keep)
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.dropped == 0 {
+		return string(b.buf)
+	}
+	return fmt.Sprintf("%s\n[taskvault: %d more bytes not cached]\n", b.buf, b.dropped)
+}
+
+// replayRun replays the recorded stdout/stderr of a restored run
+func replayRun(metadata map[string]interface{}) error {
+	userData, _ := metadata["user_data"].(map[string]interface{})
+	stdout, _ := userData["stdout"].(string)
+	stderr, _ := userData["stderr"].(string)
+	exitCode, _ := userData["exit_code"].(float64)
+
+	fmt.Fprint(os.Stdout, stdout)
+	fmt.Fprint(os.Stderr, stderr)
+	fmt.Fprintf(os.Stderr, "✓ Cache hit for %s (outputs restored)\n", runTask)
+
+	return exitResult(int(exitCode))
+}
+
+// exitResult maps a command exit code to the error returned from RunE
+func exitResult(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return &exitCodeError{code: code}
+}
+
+func init() {
+	runCmd.Flags().StringVar(&runTask, "task", "", "task name")
+	runCmd.Flags().StringSliceVar(&runInputs, "inputs", nil, "input files, directories or globs (** matches any depth); required")
+	runCmd.Flags().StringSliceVar(&runOutputs, "outputs", nil, "output files or directories to cache")
+	runCmd.Flags().BoolVar(&runCacheFailures, "cache-failures", false, "also cache runs that exit with a non-zero code")
+	runCmd.Flags().StringArrayVar(&saveTags, "tag", nil, "tag to record with the entry (repeatable)")
+	addKeyFlags(runCmd)
+
+	rootCmd.AddCommand(runCmd)
+}
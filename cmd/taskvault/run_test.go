@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helperEnv makes the test binary act as the command run wraps
+const helperEnv = "TASKVAULT_HELPER_COMMAND"
+
+// TestHelperCommand is the command the run tests wrap, not a test itself:
+// it counts its runs in ./runs, writes to stdout and stderr and exits 3
+func TestHelperCommand(t *testing.T) {
+	if os.Getenv(helperEnv) != "1" {
+		return
+	}
+
+	runs, err := os.OpenFile("runs", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		os.Exit(2)
+	}
+	runs.WriteString("run\n")
+	runs.Close()
+
+	fmt.Fprint(os.Stdout, "built\n")
+	fmt.Fprint(os.Stderr, "warning\n")
+	os.Exit(3)
+}
+
+// setRunFlags sets run's flags as if parsed, restoring them when t ends
+func setRunFlags(t *testing.T, task string, inputs []string) {
+	t.Helper()
+
+	task0, inputs0, outputs0, failures0, cfg0 := runTask, runInputs, runOutputs, runCacheFailures, cfgFile
+	t.Cleanup(func() {
+		runTask, runInputs, runOutputs, runCacheFailures, cfgFile = task0, inputs0, outputs0, failures0, cfg0
+	})
+
+	runTask = task
+	runInputs = inputs
+	runOutputs = nil
+	runCacheFailures = true
+	runCmd.SetContext(context.Background())
+}
+
+// capture runs fn with os.Stdout and os.Stderr sent to files, and returns
+// what was written to each
+func capture(t *testing.T, fn func() error) (stdout, stderr string, err error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	outFile, _ := os.Create(filepath.Join(dir, "stdout"))
+	errFile, _ := os.Create(filepath.Join(dir, "stderr"))
+	defer outFile.Close()
+	defer errFile.Close()
+
+	savedOut, savedErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	err = fn()
+	os.Stdout, os.Stderr = savedOut, savedErr
+
+	out, _ := os.ReadFile(outFile.Name())
+	errOut, _ := os.ReadFile(errFile.Name())
+	return string(out), string(errOut), err
+}
+
+func TestRunRequiresInputs(t *testing.T) {
+	setRunFlags(t, "build", nil)
+
+	err := runCmd.RunE(runCmd, []string{"true"})
+	if err == nil || !strings.Contains(err.Error(), "--inputs is required") {
+		t.Fatalf("expected --inputs to be required, got %v", err)
+	}
+}
+
+func TestRunReplaysHit(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	os.MkdirAll("src", 0755)
+	os.WriteFile(filepath.Join("src", "main.c"), []byte("int main() {}"), 0644)
+	os.WriteFile("config.yaml", []byte("cache_dir: "+filepath.ToSlash(filepath.Join(dir, "cache"))+"\n"), 0644)
+
+	setRunFlags(t, "build", []string{"src/*"})
+	cfgFile = "config.yaml"
+	t.Setenv(helperEnv, "1")
+	command := []string{os.Args[0], "-test.run=^TestHelperCommand$"}
+
+	for i, want := range []string{"ran", "replayed"} {
+		stdout, stderr, err := capture(t, func() error { return runCmd.RunE(runCmd, command) })
+
+		var exitErr *exitCodeError
+		if !errors.As(err, &exitErr) || exitErr.code != 3 {
+			t.Fatalf("expected the %s command to exit with 3, got %v", want, err)
+		}
+		if stdout != "built\n" {
+			t.Errorf("expected the %s command's stdout, got %q", want, stdout)
+		}
+		if !strings.Contains(stderr, "warning\n") {
+			t.Errorf("expected the %s command's stderr, got %q", want, stderr)
+		}
+		if i == 1 && !strings.Contains(stderr, "Cache hit for build") {
+			t.Errorf("expected a cache hit, got %q", stderr)
+		}
+	}
+
+	runs, _ := os.ReadFile("runs")
+	if n := bytes.Count(runs, []byte("run\n")); n != 1 {
+		t.Errorf("expected the command to run once, ran %d times", n)
+	}
+}
+
+func TestCappedBufferTruncates(t *testing.T) {
+	b := &cappedBuffer{limit: maxCapturedOutput}
+
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	for i := 0; i < 16; i++ {
+		if n, err := b.Write(chunk); n != len(chunk) || err != nil {
+			t.Fatalf("expected writes to succeed, got %d, %v", n, err)
+		}
+	}
+	if b.String() != strings.Repeat("x", 1<<20) {
+		t.Fatalf("expected 1 MiB kept whole, got %d bytes", len(b.String()))
+	}
+
+	b.Write([]byte("overflow"))
+	want := strings.Repeat("x", 1<<20) + "\n[taskvault: 8 more bytes not cached]\n"
+	if got := b.String(); got != want {
+		t.Errorf("expected the output truncated at 1 MiB, got %d bytes ending %q", len(got), got[len(got)-40:])
+	}
+}
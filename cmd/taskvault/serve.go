@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/cache"
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/metrics"
+	"github.com/taskvault/taskvault/internal/remote"
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+var (
+	serveAddr       string
+	servePort       int
+	serveGCInterval time.Duration
+	serveMetrics    bool
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the local cache over HTTP as a remote for other machines",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		port := cfg.ServicePort
+		if cmd.Flags().Changed("port") {
+			port = servePort
+		}
+
+		store, err := storage.NewStore(cfg.CacheDir, cfg.MaxSizeGB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		verify, err := storage.VerifyModeByName(cfg.Verify)
+		if err != nil {
+			return err
+		}
+		store.SetVerifyMode(verify)
+
+		if policy, ok := cfg.Policies[cache.DefaultPolicyName]; ok {
+			strategy, err := storage.StrategyByName(policy.Strategy)
+			if err != nil {
+				return err
+			}
+			store.SetEvictionStrategy(strategy)
+
+			compression, err := storage.CompressionByName(policy.Compression, policy.CompressionLevel)
+			if err != nil {
+				return err
+			}
+			store.SetCompression(compression)
+		}
+
+		// Reclaim space left by interrupted uploads and expired entries
+		if serveGCInterval > 0 {
+			stopGC := store.StartGC(serveGCInterval, storage.GCOptions{GracePeriod: storage.DefaultGCGracePeriod}, func(report *storage.GCReport, err error) {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "gc failed: %v\n", err)
+				}
+			})
+			defer stopGC()
+		}
+
+		server := remote.NewServer(store)
+		token := cfg.ServiceTokenOrEnv()
+		server.SetToken(token)
+		if token == "" && !isLoopback(serveAddr) {
+			fmt.Fprintf(os.Stderr, "⚠ Serving %s without a token: anyone who can reach it can overwrite entries (set service_token or %s)\n", serveAddr, config.TokenEnv)
+		}
+
+		var handler http.Handler = server
+		if serveMetrics {
+			reg := metrics.NewRegistry()
+			store.RegisterMetrics(reg)
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", reg.Handler())
+			mux.Handle("/", instrumentRequests(reg, handler))
+			handler = mux
+		}
+
+		httpServer := &http.Server{
+			Addr:              net.JoinHostPort(serveAddr, strconv.Itoa(port)),
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		// Finish in-flight transfers on Ctrl-C / SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- httpServer.ListenAndServe()
+		}()
+
+		fmt.Printf("✓ Serving %s on %s\n", cfg.CacheDir, httpServer.Addr)
+
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("shutdown error: %w", err)
+		}
+		return nil
+	},
+}
+
+// isLoopback reports whether addr only accepts connections from this host
+func isLoopback(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// instrumentRequests counts and times the requests next serves
+func instrumentRequests(reg *metrics.Registry, next http.Handler) http.Handler {
+	requests := reg.NewCounter("taskvault_remote_requests_total",
+		"Remote cache requests by method and status code.", "method", "code")
+	duration := reg.NewHistogram("taskvault_remote_request_duration_seconds",
+		"Latency of remote cache requests.", metrics.DefaultBuckets, "method")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		requests.Inc(r.Method, strconv.Itoa(rec.code))
+		duration.Observe(time.Since(start).Seconds(), r.Method)
+	})
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddr, "addr", "127.0.0.1", `address to listen on ("" for all interfaces)`)
+	serveCmd.Flags().IntVar(&servePort, "port", 0, "port to listen on (default service_port from config)")
+	serveCmd.Flags().DurationVar(&serveGCInterval, "gc-interval", time.Hour, "how often to garbage collect the store (0 disables)")
+
+	serveCmd.Flags().BoolVar(&serveMetrics, "metrics", false, "serve Prometheus metrics on /metrics")
+
+	rootCmd.AddCommand(serveCmd)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	traceFile string
+
+	// Set by startTracing when the command is traced
+	rootSpan      trace.Span
+	traceShutdown func(context.Context) error
+)
+
+// startTracing records the command as a root span, with the cache
+// operations it runs as children, when --trace-file or tracing.file is set
+func startTracing(cmd *cobra.Command, args []string) error {
+	path := traceFile
+	if path == "" {
+		// An unreadable config is reported by the command itself
+		if cfg, err := config.LoadFromFile(cfgFile); err == nil {
+			path = cfg.Tracing.File
+		}
+	}
+	if path == "" {
+		return nil
+	}
+
+	shutdown, err := tracing.ToFile(path)
+	if err != nil {
+		return err
+	}
+	traceShutdown = shutdown
+
+	ctx, span := tracing.Start(cmd.Context(), cmd.CommandPath())
+	rootSpan = span
+	cmd.SetContext(ctx)
+	return nil
+}
+
+// stopTracing ends the command's span, recording err, and flushes the
+// spans to the trace file
+func stopTracing(err error) {
+	if traceShutdown == nil {
+		return
+	}
+	if rootSpan != nil {
+		tracing.End(rootSpan, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := traceShutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠ Cannot write trace: %v\n", err)
+	}
+}
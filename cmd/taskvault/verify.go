@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/taskvault/taskvault/internal/cache"
+	"github.com/taskvault/taskvault/internal/config"
+)
+
+var verifyRepair bool
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check cached blobs against their content hashes",
+	Long: `Re-hashes every cached blob and chunk and cross-checks the index against
+the blob directory. With --repair, corrupted blobs are moved to the
+quarantine directory together with the entries using them, orphaned files
+and rows are removed and reference counts are corrected.`,
+	Args: cobra.NoArgs,
+	// Problems found are reported through the exit code, not as misuse
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.LoadFromFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		manager, err := cache.NewManagerFromConfig(cfg)
+		if err != nil {
+			return err
+		}
+		defer manager.Close()
+
+		report, err := manager.Verify(verifyRepair)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Checked %d entries, %d blobs, %d chunks\n", report.Entries, report.Blobs, report.Chunks)
+		removed := 0
+		for _, problem := range report.Problems {
+			fmt.Printf("  %-14s %s  %s\n", problem.Kind, shortHash(problem.Hash), problem.Detail)
+			removed += len(problem.Entries)
+		}
+
+		switch {
+		case len(report.Problems) == 0:
+			fmt.Printf("✓ No problems found\n")
+		case verifyRepair:
+			fmt.Printf("✓ Repaired %d problems (%d entries removed)\n", len(report.Problems), removed)
+		default:
+			return fmt.Errorf("found %d problems; run with --repair to fix them", len(report.Problems))
+		}
+		return nil
+	},
+}
+
+// shortHash abbreviates a hash for display
+func shortHash(h string) string {
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+func init() {
+	verifyCmd.Flags().BoolVar(&verifyRepair, "repair", false, "quarantine corrupted blobs and remove orphans")
+
+	cacheCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,442 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/hash"
+)
+
+// manifestName is the archive member holding the manifest; it is always
+// written first so Unpack knows the roots before extracting anything
+const manifestName = ".taskvault-manifest.json"
+
+// Entry types recorded in the manifest
+const (
+	TypeFile    = "file"
+	TypeDir     = "dir"
+	TypeSymlink = "symlink"
+)
+
+// Manifest lists the archived output roots and every entry below them
+type Manifest struct {
+	Roots []string    `json:"roots"`
+	Files []FileEntry `json:"files"`
+}
+
+// FileEntry describes one archived file, directory or symlink
+type FileEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Mode    uint32    `json:"mode"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash,omitempty"`
+	Target  string    `json:"target,omitempty"` // symlink target
+	ModTime time.Time `json:"mod_time"`
+}
+
+// TotalSize returns the sum of all regular file sizes
+func (m *Manifest) TotalSize() int64 {
+	var total int64
+	for _, f := range m.Files {
+		total += f.Size
+	}
+	return total
+}
+
+// Pack writes the given files and directories to w as a tar stream and
+// returns the manifest describing them. Paths must be relative; they are
+// stored as given so Unpack restores them at the same location relative to
+// its destination. Symlinks are archived as links, not followed.
+func Pack(w io.Writer, paths []string, hasher *hash.Engine) (*Manifest, error) {
+	roots, err := normalizeRoots(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the manifest first: it goes at the head of the archive
+	manifest := &Manifest{Roots: roots}
+	for _, root := range roots {
+		err := filepath.WalkDir(filepath.FromSlash(root), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			entry, err := describe(path, hasher)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot archive %s: %w", root, err)
+		}
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal manifest: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	header := &tar.Header{
+		Name:     manifestName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(manifestJSON)),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("cannot write archive: %w", err)
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return nil, fmt.Errorf("cannot write archive: %w", err)
+	}
+
+	for _, entry := range manifest.Files {
+		if err := addEntry(tw, entry); err != nil {
+			return nil, fmt.Errorf("cannot archive %s: %w", entry.Path, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("cannot write archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// normalizeRoots validates output paths and drops those nested in another
+func normalizeRoots(paths []string) ([]string, error) {
+	var roots []string
+	for _, p := range paths {
+		if err := checkRelative(p); err != nil {
+			return nil, err
+		}
+		root := filepath.ToSlash(filepath.Clean(p))
+		if root == "." {
+			return nil, fmt.Errorf("cannot archive the working directory itself")
+		}
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+
+	var result []string
+	for _, root := range roots {
+		if n := len(result); n > 0 {
+			last := result[n-1]
+			if root == last || strings.HasPrefix(root, last+"/") {
+				continue
+			}
+		}
+		result = append(result, root)
+	}
+	return result, nil
+}
+
+// describe builds the manifest entry for path without following symlinks
+func describe(path string, hasher *hash.Engine) (FileEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return FileEntry{}, err
+	}
+
+	entry := FileEntry{
+		Path:    filepath.ToSlash(filepath.Clean(path)),
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UTC(),
+	}
+
+	switch {
+	case info.IsDir():
+		entry.Type = TypeDir
+
+	case info.Mode()&os.ModeSymlink != 0:
+		entry.Type = TypeSymlink
+		if entry.Target, err = os.Readlink(path); err != nil {
+			return FileEntry{}, err
+		}
+
+	case info.Mode().IsRegular():
+		entry.Type = TypeFile
+		entry.Size = info.Size()
+		if entry.Hash, err = hasher.HashFile(path); err != nil {
+			return FileEntry{}, err
+		}
+
+	default:
+		return FileEntry{}, fmt.Errorf("unsupported file type %s", info.Mode().Type())
+	}
+
+	return entry, nil
+}
+
+// addEntry writes a single manifest entry (and file contents) to tw
+func addEntry(tw *tar.Writer, entry FileEntry) error {
+	header := &tar.Header{
+		Name:    entry.Path,
+		Mode:    int64(entry.Mode),
+		ModTime: entry.ModTime,
+		Format:  tar.FormatPAX, // sub-second mtimes
+	}
+
+	switch entry.Type {
+	case TypeDir:
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case TypeSymlink:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = entry.Target
+	case TypeFile:
+		header.Typeflag = tar.TypeReg
+		header.Size = entry.Size
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if entry.Type != TypeFile {
+		return nil
+	}
+
+	file, err := os.Open(filepath.FromSlash(entry.Path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The file must not change size between manifest and archive
+	if _, err := io.CopyN(tw, file, entry.Size); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unpack extracts a tar stream produced by Pack into dest. Everything is
+// first extracted into a staging directory next to the outputs; each output
+// root is then swapped into place with a rename, so a failed or interrupted
+// restore never leaves a half-written tree behind.
+func Unpack(r io.Reader, dest string) (*Manifest, error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %w", dest, err)
+	}
+
+	staging, err := os.MkdirTemp(dest, ".taskvault-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := extract(r, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read past the end-of-archive marker so a reader that checks its
+	// stream at EOF gets to fail before anything is swapped into place
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("cannot read archive: %w", err)
+	}
+
+	if err := swapRoots(manifest.Roots, staging, dest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// extract writes all archive members below staging and applies metadata
+func extract(r io.Reader, staging string) (*Manifest, error) {
+	tr := tar.NewReader(r)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, fmt.Errorf("cannot read archive: missing manifest")
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("cannot read archive manifest: %w", err)
+	}
+	for _, root := range manifest.Roots {
+		if err := checkRelative(root); err != nil {
+			return nil, err
+		}
+	}
+
+	var dirs []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read archive: %w", err)
+		}
+
+		if err := checkRelative(header.Name); err != nil {
+			return nil, err
+		}
+		target := filepath.Join(staging, filepath.FromSlash(header.Name))
+		if err := checkParents(staging, target); err != nil {
+			return nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, fmt.Errorf("cannot create %s: %w", header.Name, err)
+			}
+			dirs = append(dirs, header)
+
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return nil, fmt.Errorf("cannot create %s: %w", filepath.Dir(header.Name), err)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return nil, fmt.Errorf("cannot create symlink %s: %w", header.Name, err)
+			}
+
+		case tar.TypeReg:
+			if err := writeFile(target, tr, header.FileInfo().Mode().Perm()); err != nil {
+				return nil, err
+			}
+			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+				return nil, fmt.Errorf("cannot set mtime on %s: %w", header.Name, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("unsupported archive entry %s", header.Name)
+		}
+	}
+
+	// Directory permissions and mtimes last, deepest first, so creating
+	// children does not disturb them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(staging, filepath.FromSlash(dirs[i].Name))
+		if err := os.Chmod(target, dirs[i].FileInfo().Mode().Perm()); err != nil {
+			return nil, fmt.Errorf("cannot set mode on %s: %w", dirs[i].Name, err)
+		}
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return nil, fmt.Errorf("cannot set mtime on %s: %w", dirs[i].Name, err)
+		}
+	}
+
+	return &manifest, nil
+}
+
+// swapRoots moves each staged root over its destination, rolling back the
+// roots already swapped if any rename fails
+func swapRoots(roots []string, staging, dest string) error {
+	backupDir := filepath.Join(staging, ".previous")
+	if err := os.Mkdir(backupDir, 0755); err != nil {
+		return fmt.Errorf("cannot create staging directory: %w", err)
+	}
+
+	type swapped struct{ target, backup string }
+	var done []swapped
+
+	rollback := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			os.RemoveAll(done[i].target)
+			if done[i].backup != "" {
+				os.Rename(done[i].backup, done[i].target)
+			}
+		}
+	}
+
+	for i, root := range roots {
+		staged := filepath.Join(staging, filepath.FromSlash(root))
+		target := filepath.Join(dest, filepath.FromSlash(root))
+
+		if _, err := os.Lstat(staged); err != nil {
+			rollback()
+			return fmt.Errorf("archive is missing output %s", root)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			rollback()
+			return fmt.Errorf("cannot create %s: %w", filepath.Dir(target), err)
+		}
+
+		backup := ""
+		if _, err := os.Lstat(target); err == nil {
+			backup = filepath.Join(backupDir, fmt.Sprintf("%d", i))
+			if err := os.Rename(target, backup); err != nil {
+				rollback()
+				return fmt.Errorf("cannot replace %s: %w", root, err)
+			}
+		}
+
+		if err := os.Rename(staged, target); err != nil {
+			if backup != "" {
+				os.Rename(backup, target)
+			}
+			rollback()
+			return fmt.Errorf("cannot restore %s: %w", root, err)
+		}
+		done = append(done, swapped{target: target, backup: backup})
+	}
+
+	return nil
+}
+
+// writeFile creates target (and its parents) with the contents of r
+func writeFile(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("cannot create %s: %w", filepath.Dir(target), err)
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return fmt.Errorf("cannot create %s: %w", target, err)
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write %s: %w", target, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Apply the recorded mode exactly, regardless of umask
+	return os.Chmod(target, perm)
+}
+
+// checkParents rejects members that would be written through a symlink
+// extracted earlier, which could otherwise escape the destination
+func checkParents(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is below a symlink", target)
+		}
+	}
+	return nil
+}
+
+// checkRelative rejects absolute paths and paths escaping the destination
+func checkRelative(p string) error {
+	clean := filepath.ToSlash(filepath.Clean(filepath.FromSlash(p)))
+	if filepath.IsAbs(p) || strings.HasPrefix(clean, "/") || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("path %s must be relative to the working directory", p)
+	}
+	return nil
+}
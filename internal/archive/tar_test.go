@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/hash"
+)
+
+func TestPackUnpackRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	chdir(t, src)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join("dist", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("dist", "app"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("dist", "sub", "data.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join("dist", "app"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("app", filepath.Join("dist", "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := Pack(&buf, []string{"dist/", "dist/sub"}, hash.NewEngine(hash.Blake3))
+	if err != nil {
+		t.Fatalf("pack error: %v", err)
+	}
+	if len(manifest.Roots) != 1 || manifest.Roots[0] != "dist" {
+		t.Errorf("expected nested roots to collapse to [dist], got %v", manifest.Roots)
+	}
+	if manifest.TotalSize() != int64(len("binary")+len("{}")) {
+		t.Errorf("unexpected total size %d", manifest.TotalSize())
+	}
+
+	// A stale file in the destination must not survive the restore
+	if err := os.MkdirAll(filepath.Join(dest, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "dist", "stale"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Unpack(&buf, dest); err != nil {
+		t.Fatalf("unpack error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "dist", "stale")); !os.IsNotExist(err) {
+		t.Errorf("expected stale file to be replaced")
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "dist", "app"))
+	if err != nil {
+		t.Fatalf("missing restored file: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected mode 0755, got %o", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %v, got %v", mtime, info.ModTime())
+	}
+
+	target, err := os.Readlink(filepath.Join(dest, "dist", "latest"))
+	if err != nil || target != "app" {
+		t.Errorf("expected symlink to app, got %q (%v)", target, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, "dist", "sub", "data.json"))
+	if err != nil || string(data) != "{}" {
+		t.Errorf("unexpected nested file contents %q (%v)", data, err)
+	}
+
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 1 {
+		t.Errorf("expected only dist in destination, found %d entries", len(entries))
+	}
+}
+
+func TestPackRejectsEscapingPaths(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range []string{"../outside", "/abs", "."} {
+		if _, err := Pack(&buf, []string{p}, hash.NewEngine(hash.Blake3)); err == nil {
+			t.Errorf("expected error for %q", p)
+		}
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
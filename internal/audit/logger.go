@@ -1,101 +1,166 @@
 package audit
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
-// Logger tracks cache operations for auditing and analytics
+// Results recorded in the audit log
+const (
+	ResultHit   = "hit"
+	ResultMiss  = "miss"
+	ResultError = "error"
+)
+
+// Record is one line of the audit log
+type Record struct {
+	Time       time.Time `json:"ts"`
+	Result     string    `json:"result"` // ResultHit, ResultMiss or ResultError
+	Operation  string    `json:"op"`     // e.g. "get", "save", or the error type
+	Task       string    `json:"task,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	DurationMS float64   `json:"duration_ms,omitempty"`
+	Size       int64     `json:"size,omitempty"`        // bytes of output
+	StoredSize int64     `json:"stored_size,omitempty"` // bytes on disk after compression
+	Client     string    `json:"client,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Logger tracks cache operations for auditing and analytics, as JSON lines
 type Logger struct {
 	filePath string
 	file     *os.File
 	mu       sync.Mutex
+
+	client   string
+	observe  func(Record)
+	rotation Rotation
+	size     int64     // bytes in the current file
+	openedAt time.Time // time of the current file's first record
+	pending  sync.WaitGroup
 }
 
-// NewLogger creates an audit log file in the cache directory
+// NewLogger creates an audit log file in the cache directory, rotated
+// according to DefaultRotation
 func NewLogger(cacheDir string) (*Logger, error) {
-	filePath := filepath.Join(cacheDir, "audit.log")
-
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	l := &Logger{
+		filePath: LogPath(cacheDir),
+		client:   defaultClient(),
+		rotation: DefaultRotation,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
 	}
+	return l, nil
+}
 
-	return &Logger{
-		filePath: filePath,
-		file:     file,
-	}, nil
+// LogPath returns the path of the audit log in a cache directory
+func LogPath(cacheDir string) string {
+	return filepath.Join(cacheDir, "audit.log")
 }
 
-// LogHit records a cache hit
-func (l *Logger) LogHit(operation, taskName, hash string) {
+// SetClient sets the identity recorded with each operation; by default
+// $TASKVAULT_CLIENT, or user@host:pid
+func (l *Logger) SetClient(client string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	entry := fmt.Sprintf("[%s] HIT %s task=%s hash=%s\n",
-		time.Now().Format(time.RFC3339),
-		operation,
-		taskName,
-		truncateHash(hash),
-	)
-
-	if _, err := l.file.WriteString(entry); err != nil {
-		fmt.Fprintf(os.Stderr, "audit log write failed: %v\n", err)
-	}
+	l.client = client
 }
 
-// LogMiss records a cache miss
-func (l *Logger) LogMiss(operation, taskName, hash string) {
+// SetObserver sets a function called with every record logged, e.g. to
+// update metrics; it must not log itself
+func (l *Logger) SetObserver(observe func(Record)) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	entry := fmt.Sprintf("[%s] MISS %s task=%s hash=%s\n",
-		time.Now().Format(time.RFC3339),
-		operation,
-		taskName,
-		truncateHash(hash),
-	)
+	l.observe = observe
+}
 
-	if _, err := l.file.WriteString(entry); err != nil {
-		fmt.Fprintf(os.Stderr, "audit log write failed: %v\n", err)
+// Log appends a record, filling in its time and client if unset
+func (l *Logger) Log(rec Record) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
 	}
-}
+	rec.Time = rec.Time.UTC()
 
-// LogError records an error
-func (l *Logger) LogError(errorType, taskName string, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	entry := fmt.Sprintf("[%s] ERROR %s task=%s error=%v\n",
-		time.Now().Format(time.RFC3339),
-		errorType,
-		taskName,
-		err,
-	)
+	if rec.Client == "" {
+		rec.Client = l.client
+	}
+	if l.observe != nil {
+		l.observe(rec)
+	}
 
-	if _, err := l.file.WriteString(entry); err != nil {
+	line, err := json.Marshal(&rec)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "audit log write failed: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if err := l.prepareWrite(rec.Time, int64(len(line))); err != nil {
+		fmt.Fprintf(os.Stderr, "audit log rotation failed: %v\n", err)
+	}
+	if l.file == nil {
+		return
 	}
-}
 
-// truncateHash returns first 12 chars of hash for readability
-func truncateHash(h string) string {
-	if len(h) > 12 {
-		return h[:12] + "..."
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit log write failed: %v\n", err)
 	}
-	return h
 }
 
-// Close cleanly closes the audit log
+// LogHit records a cache hit
+func (l *Logger) LogHit(operation, taskName, hash string) {
+	l.Log(Record{Result: ResultHit, Operation: operation, Task: taskName, Hash: hash})
+}
+
+// LogMiss records a cache miss
+func (l *Logger) LogMiss(operation, taskName, hash string) {
+	l.Log(Record{Result: ResultMiss, Operation: operation, Task: taskName, Hash: hash})
+}
+
+// LogError records an error
+func (l *Logger) LogError(errorType, taskName string, err error) {
+	l.Log(Record{Result: ResultError, Operation: errorType, Task: taskName, Error: err.Error()})
+}
+
+// Close cleanly closes the audit log, waiting for rotated files to be
+// compressed
 func (l *Logger) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	l.pending.Wait()
 	if l.file != nil {
-		return l.file.Close()
+		err := l.file.Close()
+		l.file = nil
+		return err
 	}
 	return nil
 }
+
+// defaultClient identifies this process, e.g. by CI job through
+// $TASKVAULT_CLIENT, falling back to user@host:pid
+func defaultClient() string {
+	if client := os.Getenv("TASKVAULT_CLIENT"); client != "" {
+		return client
+	}
+
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s:%d", name, host, os.Getpid())
+}
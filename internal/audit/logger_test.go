@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestRecordFormat(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewLogger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetClient("ci-42")
+
+	logger.Log(Record{Result: ResultHit, Operation: "get", Task: "build", Hash: "abc", DurationMS: 1.5, Size: 100, StoredSize: 40})
+	logger.LogError("corrupt", "build", errors.New("bad blob"))
+	logger.Close()
+
+	records := readRecords(t, filepath.Join(dir, "audit.log"))
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	hit := records[0]
+	if hit.Result != ResultHit || hit.Hash != "abc" || hit.Size != 100 || hit.StoredSize != 40 || hit.DurationMS != 1.5 {
+		t.Errorf("unexpected hit record: %+v", hit)
+	}
+	if hit.Client != "ci-42" || hit.Time.IsZero() {
+		t.Errorf("expected time and client to be filled in: %+v", hit)
+	}
+
+	failed := records[1]
+	if failed.Result != ResultError || failed.Operation != "corrupt" || failed.Error != "bad blob" {
+		t.Errorf("unexpected error record: %+v", failed)
+	}
+}
+
+func TestRotationAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewLogger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetRotation(Rotation{MaxSize: 512, MaxBackups: 2, Compress: true})
+
+	// Distinct times keep the rotated file names apart
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		logger.Log(Record{Time: now.Add(time.Duration(i) * time.Second), Result: ResultMiss, Operation: "get", Task: "build"})
+	}
+	logger.Close()
+
+	path := filepath.Join(dir, "audit.log")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 512 {
+		t.Errorf("expected the log to stay under 512 bytes, got %d", info.Size())
+	}
+
+	rotated, err := RotatedFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files kept, got %v", rotated)
+	}
+	for _, file := range rotated {
+		if !strings.HasSuffix(file, ".gz") {
+			t.Errorf("expected %s to be compressed", file)
+		}
+		if len(readRecords(t, file)) == 0 {
+			t.Errorf("expected records in %s", file)
+		}
+	}
+}
+
+func TestRotationByAge(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewLogger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetRotation(Rotation{MaxAge: time.Hour})
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	logger.Log(Record{Time: now, Result: ResultHit, Operation: "get"})
+	logger.Log(Record{Time: now.Add(30 * time.Minute), Result: ResultHit, Operation: "get"})
+	logger.Log(Record{Time: now.Add(2 * time.Hour), Result: ResultHit, Operation: "get"})
+	logger.Close()
+
+	rotated, err := RotatedFiles(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 || len(readRecords(t, rotated[0])) != 2 {
+		t.Errorf("expected one rotated file with the first two records, got %v", rotated)
+	}
+	if n := len(readRecords(t, filepath.Join(dir, "audit.log"))); n != 1 {
+		t.Errorf("expected 1 record in the current log, got %d", n)
+	}
+}
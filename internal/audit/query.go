@@ -0,0 +1,269 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filter selects the records a Report counts
+type Filter struct {
+	Since time.Time // zero for all
+	Task  string    // empty for all
+}
+
+// Counts tallies cache lookups; saves and other operations are not lookups
+type Counts struct {
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	Errors      int64   `json:"errors"`
+	HitRate     float64 `json:"hit_rate"`     // hits / (hits + misses)
+	BytesServed int64   `json:"bytes_served"` // output bytes returned by hits
+}
+
+// TaskCounts are the counts for one task
+type TaskCounts struct {
+	Task string `json:"task"`
+	Counts
+}
+
+// DayCounts are the counts for one UTC day
+type DayCounts struct {
+	Day string `json:"day"` // 2006-01-02
+	Counts
+}
+
+// KeyMisses is how often a key missed
+type KeyMisses struct {
+	Task   string `json:"task"`
+	Hash   string `json:"hash"`
+	Misses int64  `json:"misses"`
+}
+
+// ErrorCount is how often an error type occurred
+type ErrorCount struct {
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+}
+
+// Report summarizes the audit log
+type Report struct {
+	Totals    Counts       `json:"totals"`
+	Tasks     []TaskCounts `json:"tasks"`      // by task name
+	Days      []DayCounts  `json:"days"`       // oldest first
+	TopMisses []KeyMisses  `json:"top_misses"` // most misses first
+	Errors    []ErrorCount `json:"errors"`     // most frequent first
+}
+
+// Summarize reads the log at path and its rotated files into a report,
+// listing at most topMisses keys (none if it is 0 or less)
+func Summarize(path string, filter Filter, topMisses int) (*Report, error) {
+	report := &Report{
+		Tasks:     []TaskCounts{},
+		Days:      []DayCounts{},
+		TopMisses: []KeyMisses{},
+		Errors:    []ErrorCount{},
+	}
+	tasks := make(map[string]*Counts)
+	days := make(map[string]*Counts)
+	misses := make(map[KeyMisses]int64)
+	errs := make(map[string]int64)
+
+	err := ReadRecords(path, filter.Since, func(rec Record) {
+		if filter.Task != "" && rec.Task != filter.Task {
+			return
+		}
+		if rec.Result == ResultError {
+			errs[rec.Operation]++
+		} else if rec.Operation != "get" {
+			return
+		}
+
+		day := rec.Time.UTC().Format("2006-01-02")
+		if tasks[rec.Task] == nil {
+			tasks[rec.Task] = &Counts{}
+		}
+		if days[day] == nil {
+			days[day] = &Counts{}
+		}
+		for _, c := range []*Counts{&report.Totals, tasks[rec.Task], days[day]} {
+			c.add(rec)
+		}
+		if rec.Result == ResultMiss {
+			misses[KeyMisses{Task: rec.Task, Hash: rec.Hash}]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Totals.finish()
+	for task, c := range tasks {
+		c.finish()
+		report.Tasks = append(report.Tasks, TaskCounts{Task: task, Counts: *c})
+	}
+	sort.Slice(report.Tasks, func(i, j int) bool { return report.Tasks[i].Task < report.Tasks[j].Task })
+
+	for day, c := range days {
+		c.finish()
+		report.Days = append(report.Days, DayCounts{Day: day, Counts: *c})
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Day < report.Days[j].Day })
+
+	for key, n := range misses {
+		key.Misses = n
+		report.TopMisses = append(report.TopMisses, key)
+	}
+	sort.Slice(report.TopMisses, func(i, j int) bool {
+		a, b := report.TopMisses[i], report.TopMisses[j]
+		if a.Misses != b.Misses {
+			return a.Misses > b.Misses
+		}
+		return a.Task+a.Hash < b.Task+b.Hash
+	})
+	if topMisses < 0 {
+		topMisses = 0
+	}
+	if len(report.TopMisses) > topMisses {
+		report.TopMisses = report.TopMisses[:topMisses]
+	}
+
+	for typ, n := range errs {
+		report.Errors = append(report.Errors, ErrorCount{Type: typ, Count: n})
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		a, b := report.Errors[i], report.Errors[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Type < b.Type
+	})
+
+	return report, nil
+}
+
+// add counts one record
+func (c *Counts) add(rec Record) {
+	switch rec.Result {
+	case ResultHit:
+		c.Hits++
+		c.BytesServed += rec.Size
+	case ResultMiss:
+		c.Misses++
+	case ResultError:
+		c.Errors++
+	}
+}
+
+// finish computes the hit rate
+func (c *Counts) finish() {
+	if lookups := c.Hits + c.Misses; lookups > 0 {
+		c.HitRate = float64(c.Hits) / float64(lookups)
+	}
+}
+
+// ReadRecords calls fn with each record at or after since in the log at
+// path and its rotated files, oldest first. Lines that are neither JSON
+// records nor in the text format written before are skipped.
+func ReadRecords(path string, since time.Time, fn func(Record)) error {
+	files, err := RotatedFiles(path)
+	if err != nil {
+		return fmt.Errorf("cannot list audit logs: %w", err)
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), ".log")
+	for _, file := range files {
+		// Rotated files only hold records from before they were rotated
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".gz"), ".log")
+		rotatedAt, err := time.Parse(rotatedLayout, strings.TrimPrefix(name, base+"-"))
+		if err == nil && rotatedAt.Before(since) {
+			continue
+		}
+		if err := readFile(file, since, fn); err != nil {
+			return err
+		}
+	}
+	return readFile(path, since, fn)
+}
+
+// readFile reads the records of one log file, compressed or not
+func readFile(path string, since time.Time, fn func(Record)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil // rotated away meanwhile, or nothing logged yet
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read audit log: %w", err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("cannot read audit log %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rec, ok := parseRecord(scanner.Text())
+		if ok && !rec.Time.Before(since) {
+			fn(rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read audit log %s: %w", path, err)
+	}
+	return nil
+}
+
+// parseRecord parses a JSON record, or a line of the earlier text format:
+//
+//	[2025-02-02T14:30:45Z] HIT get task=build hash=a3f2b1...
+//	[2025-02-02T14:30:47Z] ERROR hash_error task=build error=EOF
+func parseRecord(line string) (Record, bool) {
+	var rec Record
+	if strings.HasPrefix(line, "{") {
+		if json.Unmarshal([]byte(line), &rec) != nil || rec.Time.IsZero() {
+			return rec, false
+		}
+		return rec, true
+	}
+
+	ts, rest, ok := strings.Cut(strings.TrimPrefix(line, "["), "] ")
+	if !ok {
+		return rec, false
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return rec, false
+	}
+	rec.Time = t
+
+	fields := strings.SplitN(rest, " ", 4)
+	if len(fields) < 3 {
+		return rec, false
+	}
+	rec.Result = strings.ToLower(fields[0])
+	rec.Operation = fields[1]
+	rec.Task = strings.TrimPrefix(fields[2], "task=")
+	if len(fields) == 4 {
+		if hash, ok := strings.CutPrefix(fields[3], "hash="); ok {
+			rec.Hash = hash
+		} else {
+			rec.Error = strings.TrimPrefix(fields[3], "error=")
+		}
+	}
+	return rec, true
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewLogger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetRotation(Rotation{MaxAge: 24 * time.Hour, Compress: true})
+
+	day1 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	for _, rec := range []Record{
+		{Time: day1, Result: ResultMiss, Operation: "get", Task: "lint", Hash: "a"},
+		{Time: day1, Result: ResultHit, Operation: "save", Task: "lint", Hash: "a"},
+		{Time: day1, Result: ResultHit, Operation: "get", Task: "lint", Hash: "a", Size: 100},
+		{Time: day2, Result: ResultMiss, Operation: "get", Task: "lint", Hash: "b"},
+		{Time: day2, Result: ResultMiss, Operation: "get", Task: "lint", Hash: "b"},
+		{Time: day2, Result: ResultHit, Operation: "get", Task: "test", Hash: "c", Size: 50},
+	} {
+		logger.Log(rec)
+	}
+	logger.LogError("hash_error", "lint", errors.New("EOF"))
+	logger.Close()
+
+	// Records in the earlier text format are read too
+	legacy := "[2023-12-31T10:00:00Z] HIT get task=lint hash=z\nnot a record\n"
+	if err := os.WriteFile(filepath.Join(dir, "audit-20231231T235959.000.log"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := LogPath(dir)
+	report, err := Summarize(path, Filter{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Totals.Hits != 3 || report.Totals.Misses != 3 || report.Totals.Errors != 1 || report.Totals.BytesServed != 150 {
+		t.Errorf("unexpected totals: %+v", report.Totals)
+	}
+	if len(report.Days) != 4 {
+		t.Errorf("expected 4 days, got %+v", report.Days)
+	}
+	if len(report.TopMisses) != 2 || report.TopMisses[0].Hash != "b" || report.TopMisses[0].Misses != 2 {
+		t.Errorf("expected b to miss most, got %+v", report.TopMisses)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Type != "hash_error" {
+		t.Errorf("unexpected errors: %+v", report.Errors)
+	}
+
+	report, err = Summarize(path, Filter{Since: day2, Task: "lint"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tasks) != 1 || report.Tasks[0].Task != "lint" {
+		t.Fatalf("expected only lint, got %+v", report.Tasks)
+	}
+	if c := report.Tasks[0].Counts; c.Hits != 0 || c.Misses != 2 || c.HitRate != 0 {
+		t.Errorf("unexpected lint counts since day 2: %+v", c)
+	}
+
+	report, err = Summarize(path, Filter{}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.TopMisses) != 0 {
+		t.Errorf("expected no top misses, got %+v", report.TopMisses)
+	}
+}
@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rotation controls when the audit log is rotated and how many rotated
+// files are kept
+type Rotation struct {
+	MaxSize    int64         // rotate before the file would exceed this many bytes; 0 disables
+	MaxAge     time.Duration // rotate once the file's first record is this old; 0 disables
+	MaxBackups int           // rotated files kept, oldest removed first; 0 keeps all
+	Compress   bool          // gzip rotated files
+}
+
+// DefaultRotation keeps about 600 MB of history at most
+var DefaultRotation = Rotation{
+	MaxSize:    100 << 20,
+	MaxAge:     7 * 24 * time.Hour,
+	MaxBackups: 5,
+	Compress:   true,
+}
+
+// rotatedLayout names rotated files after their rotation time, so they
+// sort oldest first
+const rotatedLayout = "20060102T150405.000"
+
+// SetRotation changes how the log is rotated from the next record on
+func (l *Logger) SetRotation(r Rotation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotation = r
+}
+
+// open opens the log for appending, picking up the size and age of an
+// existing file
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	l.openedAt = firstRecordTime(l.filePath, info)
+	return nil
+}
+
+// firstRecordTime returns the time of the first record in the log, the
+// file's modification time for logs written before records were JSON, or
+// zero for an empty log
+func firstRecordTime(path string, info os.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Time{}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return info.ModTime()
+	}
+	defer file.Close()
+
+	line, _ := bufio.NewReader(file).ReadBytes('\n')
+	var rec Record
+	if json.Unmarshal(line, &rec) != nil || rec.Time.IsZero() {
+		return info.ModTime()
+	}
+	return rec.Time
+}
+
+// prepareWrite reopens the log if another process rotated it and rotates
+// it if writing n more bytes at now is due to. Callers hold l.mu.
+func (l *Logger) prepareWrite(now time.Time, n int64) error {
+	if l.file != nil && !isCurrent(l.file, l.filePath) {
+		l.file.Close()
+		l.file = nil
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if l.size == 0 {
+		l.openedAt = now
+		return nil
+	}
+
+	r := l.rotation
+	tooBig := r.MaxSize > 0 && l.size+n > r.MaxSize
+	tooOld := r.MaxAge > 0 && now.Sub(l.openedAt) >= r.MaxAge
+	if !tooBig && !tooOld {
+		return nil
+	}
+	return l.rotate(now)
+}
+
+// isCurrent reports whether file is still the one at path
+func isCurrent(file *os.File, path string) bool {
+	open, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(open, current)
+}
+
+// rotate moves the log aside and starts a new one, compressing and
+// pruning rotated files in the background. Callers hold l.mu.
+func (l *Logger) rotate(now time.Time) error {
+	l.file.Close()
+	l.file = nil
+
+	base := strings.TrimSuffix(filepath.Base(l.filePath), ".log")
+	rotated := filepath.Join(filepath.Dir(l.filePath), base+"-"+now.UTC().Format(rotatedLayout)+".log")
+	if err := os.Rename(l.filePath, rotated); err != nil {
+		l.open()
+		return fmt.Errorf("cannot rotate audit log: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.openedAt = now
+
+	r := l.rotation
+	l.pending.Add(1)
+	go func() {
+		defer l.pending.Done()
+		if r.Compress {
+			if err := compressFile(rotated); err != nil {
+				fmt.Fprintf(os.Stderr, "audit log compression failed: %v\n", err)
+			}
+		}
+		if r.MaxBackups > 0 {
+			pruneRotated(l.filePath, r.MaxBackups)
+		}
+	}()
+	return nil
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-audit-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	gz := gzip.NewWriter(tmp)
+	if _, err := io.Copy(gz, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// RotatedFiles lists the rotated files of the log at path, oldest first
+func RotatedFiles(path string) ([]string, error) {
+	base := strings.TrimSuffix(filepath.Base(path), ".log")
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(path), base+"-*.log*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, match := range matches {
+		// Skip a rotated file whose compressed copy is complete already
+		if !strings.HasSuffix(match, ".gz") {
+			if _, err := os.Stat(match + ".gz"); err == nil {
+				continue
+			}
+		}
+		files = append(files, match)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// pruneRotated removes all but the newest keep rotated files
+func pruneRotated(path string, keep int) {
+	files, err := RotatedFiles(path)
+	if err != nil || len(files) <= keep {
+		return
+	}
+	for _, file := range files[:len(files)-keep] {
+		os.Remove(file)
+		os.Remove(strings.TrimSuffix(file, ".gz")) // mid-compression leftover
+	}
+}
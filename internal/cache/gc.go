@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"fmt"
+
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+// GC removes expired entries, dangling rows and orphaned blob files left
+// behind by interrupted saves and deletes. Failures are recorded in the
+// audit log.
+func (m *Manager) GC(opts storage.GCOptions) (*storage.GCReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	report, err := m.store.GC(opts)
+	if err != nil {
+		m.auditLog.LogError("gc_error", "", err)
+		return nil, fmt.Errorf("gc error: %w", err)
+	}
+	return report, nil
+}
+
+// remoteCollector is implemented by remote tiers that collect their own
+// garbage when asked, such as an S3 bucket; a taskvault server runs GC on
+// its store itself
+type remoteCollector interface {
+	GC(opts storage.GCOptions) (*storage.GCReport, error)
+}
+
+// GCRemote removes expired entries and the blobs and chunks no entry uses
+// from the remote tier. Failures are recorded in the audit log.
+func (m *Manager) GCRemote(opts storage.GCOptions) (*storage.GCReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.remote == nil {
+		return nil, fmt.Errorf("gc error: no remote configured")
+	}
+	collector, ok := m.remote.(remoteCollector)
+	if !ok {
+		return nil, fmt.Errorf("gc error: the remote collects its own garbage")
+	}
+
+	report, err := collector.GC(opts)
+	if err != nil {
+		m.auditLog.LogError("gc_error", "", err)
+		return nil, fmt.Errorf("gc error: %w", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Key schema versions recorded with every cache entry
+const (
+	// KeySchemaLegacy keys are the bare input hash (no task namespacing)
+	KeySchemaLegacy = 1
+	// KeySchemaComposite keys fold in task name, version and environment
+	KeySchemaComposite = 2
+)
+
+// TaskKey identifies everything besides input data that a cached result depends on
+type TaskKey struct {
+	Name    string            // task name, e.g. "build"
+	Version string            // explicit task version, bump to invalidate
+	Env     map[string]string // resolved environment inputs (see EnvInputs.Resolve)
+}
+
+// EnvInputs declares which parts of the environment a task depends on
+type EnvInputs struct {
+	Vars     []string          // environment variable names
+	Tools    map[string]string // tool name -> version string
+	Platform bool              // include GOOS/GOARCH
+}
+
+// Resolve captures the current values of the declared environment inputs
+func (e EnvInputs) Resolve() map[string]string {
+	env := make(map[string]string, len(e.Vars)+len(e.Tools)+1)
+
+	for _, name := range e.Vars {
+		env["env:"+name] = os.Getenv(name)
+	}
+	for tool, version := range e.Tools {
+		env["tool:"+tool] = version
+	}
+	if e.Platform {
+		env["platform"] = runtime.GOOS + "/" + runtime.GOARCH
+	}
+
+	return env
+}
+
+// computeKey derives the composite cache key for a task and its input hash.
+// Fields are quoted and env entries sorted so the encoding is unambiguous
+// and independent of map ordering.
+func (m *Manager) computeKey(key TaskKey, inputHash string) (string, error) {
+	if key.Name == "" {
+		return "", fmt.Errorf("task name required")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "taskvault-key/%d\n", KeySchemaComposite)
+	fmt.Fprintf(&b, "task=%q\n", key.Name)
+	fmt.Fprintf(&b, "version=%q\n", key.Version)
+
+	names := make([]string, 0, len(key.Env))
+	for name := range key.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "env=%q:%q\n", name, key.Env[name])
+	}
+
+	fmt.Fprintf(&b, "input=%s\n", inputHash)
+
+	return m.hasher.HashData([]byte(b.String()))
+}
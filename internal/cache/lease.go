@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defaults for SetLeaseTimeouts
+const (
+	DefaultLeaseTTL  = 30 * time.Second
+	DefaultLeaseWait = 10 * time.Minute
+)
+
+// leasePoll is how often a caller waiting on another process's lease
+// checks whether it was released
+const leasePoll = 250 * time.Millisecond
+
+// Lease marks its holder as the one caller computing a task result;
+// others calling AcquireLease for the same key wait until it is released.
+// The lease is renewed in the background until Release.
+type Lease struct {
+	manager  *Manager
+	taskName string
+	cacheKey string
+	flight   *flight
+	held     bool // false when waiting timed out and the caller computes anyway
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// flight tracks the in-process leader for a key; done closes when it
+// releases its lease
+type flight struct {
+	done chan struct{}
+}
+
+// SetLeaseTimeouts sets how long a lease outlives a holder that stopped
+// renewing it (e.g. crashed), and how long AcquireLease waits for another
+// holder before giving up. A zero wait or ttl disables leases.
+func (m *Manager) SetLeaseTimeouts(ttl, wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.leaseTTL = ttl
+	m.leaseWait = wait
+}
+
+// AcquireLease is called after a miss, before computing the result. It
+// returns a lease when the caller should compute it and save it before
+// releasing the lease. If another caller, in this process or another one,
+// is already computing it, AcquireLease waits for that caller to finish and
+// returns nil: the result should then be looked up again. When the wait
+// times out the returned lease is not held and the caller computes anyway.
+func (m *Manager) AcquireLease(key TaskKey, inputHash string) (*Lease, error) {
+	return m.AcquireLeaseContext(context.Background(), key, inputHash)
+}
+
+// AcquireLeaseContext is AcquireLease, giving up waiting with ctx's error
+// once ctx is done. The lease is then renewed regardless of ctx.
+func (m *Manager) AcquireLeaseContext(ctx context.Context, key TaskKey, inputHash string) (*Lease, error) {
+	m.mu.RLock()
+	cacheKey, err := m.computeKey(key, inputHash)
+	ttl, wait := m.leaseTTL, m.leaseWait
+	m.mu.RUnlock()
+	if err != nil {
+		m.auditLog.LogError("hash_error", key.Name, err)
+		return nil, fmt.Errorf("key error: %w", err)
+	}
+
+	unheld := &Lease{}
+	if wait <= 0 || ttl <= 0 {
+		return unheld, nil
+	}
+	deadline := time.Now().Add(wait)
+
+	// Callers in this process queue behind the first one
+	m.flightMu.Lock()
+	if f, busy := m.flights[cacheKey]; busy {
+		m.flightMu.Unlock()
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-f.done:
+			return nil, nil
+		case <-timer.C:
+			m.auditLog.LogError("lease_timeout", key.Name, errors.New("gave up waiting for lease"))
+			return unheld, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lease error: %w", ctx.Err())
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	m.flights[cacheKey] = f
+	m.flightMu.Unlock()
+
+	// The first one then competes with other processes
+	waited := false
+	for {
+		ok, err := m.store.AcquireLeaseContext(ctx, cacheKey, m.leaseOwner, ttl)
+		if err != nil {
+			m.endFlight(cacheKey, f)
+			m.auditLog.LogError("lease_error", key.Name, err)
+			return nil, fmt.Errorf("lease error: %w", err)
+		}
+		if ok {
+			break
+		}
+
+		waited = true
+		if time.Now().After(deadline) {
+			m.endFlight(cacheKey, f)
+			m.auditLog.LogError("lease_timeout", key.Name, errors.New("gave up waiting for lease"))
+			return unheld, nil
+		}
+
+		timer := time.NewTimer(leasePoll)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			m.endFlight(cacheKey, f)
+			return nil, fmt.Errorf("lease error: %w", ctx.Err())
+		}
+	}
+
+	// The previous holder may have saved the result while this one waited
+	if waited {
+		if entry, err := m.store.Lookup(cacheKey); err == nil && entry != nil {
+			m.store.ReleaseLeaseContext(ctx, cacheKey, m.leaseOwner)
+			m.endFlight(cacheKey, f)
+			return nil, nil
+		}
+	}
+
+	lease := &Lease{
+		manager:  m,
+		taskName: key.Name,
+		cacheKey: cacheKey,
+		flight:   f,
+		held:     true,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go lease.renew(ttl)
+	return lease, nil
+}
+
+// Held reports whether the lease excludes other callers; it does not after
+// waiting for another holder timed out
+func (l *Lease) Held() bool {
+	return l.held
+}
+
+// Release gives up the lease, waking callers waiting for it. It is safe
+// to call more than once.
+func (l *Lease) Release() {
+	if !l.held {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+
+		m := l.manager
+		if err := m.store.ReleaseLease(l.cacheKey, m.leaseOwner); err != nil {
+			m.auditLog.LogError("lease_error", l.taskName, err)
+		}
+		m.endFlight(l.cacheKey, l.flight)
+	})
+}
+
+// renew keeps the lease from lapsing while its holder works
+func (l *Lease) renew(ttl time.Duration) {
+	defer close(l.done)
+
+	// At least a millisecond apart, however short the ttl
+	ticker := time.NewTicker(max(ttl/3, time.Millisecond))
+	defer ticker.Stop()
+
+	m := l.manager
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ok, err := m.store.AcquireLease(l.cacheKey, m.leaseOwner, ttl)
+			if err == nil && !ok {
+				err = errors.New("lease taken over by another process")
+			}
+			if err != nil {
+				m.auditLog.LogError("lease_lost", l.taskName, err)
+				return
+			}
+		}
+	}
+}
+
+// endFlight wakes the callers in this process waiting on f
+func (m *Manager) endFlight(cacheKey string, f *flight) {
+	m.flightMu.Lock()
+	delete(m.flights, cacheKey)
+	m.flightMu.Unlock()
+	close(f.done)
+}
+
+// newLeaseOwner identifies this manager's leases; the host and pid are
+// only there to help debugging
+func newLeaseOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), uuid.NewString())
+}
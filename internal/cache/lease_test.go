@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/hash"
+)
+
+func TestConcurrentMissesComputeOnce(t *testing.T) {
+	dir := t.TempDir()
+
+	// Two managers on one directory stand in for two processes
+	var managers []*Manager
+	for i := 0; i < 2; i++ {
+		manager, err := NewManager(dir, 1, hash.Blake3)
+		if err != nil {
+			t.Fatalf("cannot create manager: %v", err)
+		}
+		defer manager.Close()
+		managers = append(managers, manager)
+	}
+
+	key := TaskKey{Name: "build"}
+	var computed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(manager *Manager) {
+			defer wg.Done()
+			for {
+				output, _, hit, err := manager.GetByInputHash(key, "in")
+				if err != nil {
+					t.Errorf("get error: %v", err)
+					return
+				}
+				if hit {
+					if string(output) != "built" {
+						t.Errorf("expected built, got %q", output)
+					}
+					return
+				}
+
+				lease, err := manager.AcquireLease(key, "in")
+				if err != nil {
+					t.Errorf("lease error: %v", err)
+					return
+				}
+				if lease == nil {
+					continue
+				}
+
+				computed.Add(1)
+				time.Sleep(100 * time.Millisecond)
+				_, err = manager.SaveByInputHash(key, "in", []byte("built"), nil)
+				lease.Release()
+				if err != nil {
+					t.Errorf("save error: %v", err)
+				}
+				return
+			}
+		}(managers[i%2])
+	}
+	wg.Wait()
+
+	if n := computed.Load(); n != 1 {
+		t.Errorf("expected the task to be computed once, got %d", n)
+	}
+}
+
+func TestLeaseOfCrashedHolderExpires(t *testing.T) {
+	manager := newTestManager(t)
+	key := TaskKey{Name: "build"}
+
+	cacheKey, err := manager.computeKey(key, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.store.AcquireLease(cacheKey, "crashed", 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	lease, err := manager.AcquireLease(key, "in")
+	if err != nil {
+		t.Fatalf("lease error: %v", err)
+	}
+	if lease == nil || !lease.Held() {
+		t.Fatalf("expected to take over the lapsed lease, got %+v", lease)
+	}
+	lease.Release()
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("expected to wait for the lease to lapse, waited %v", waited)
+	}
+}
+
+func TestLeaseWaitTimesOut(t *testing.T) {
+	manager := newTestManager(t)
+	manager.SetLeaseTimeouts(DefaultLeaseTTL, 200*time.Millisecond)
+	key := TaskKey{Name: "build"}
+
+	cacheKey, err := manager.computeKey(key, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.store.AcquireLease(cacheKey, "busy", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := manager.AcquireLease(key, "in")
+	if err != nil {
+		t.Fatalf("lease error: %v", err)
+	}
+	if lease == nil || lease.Held() {
+		t.Fatalf("expected an unheld lease after the timeout, got %+v", lease)
+	}
+	lease.Release()
+}
+
+func TestZeroLeaseTTLDisablesLeases(t *testing.T) {
+	manager := newTestManager(t)
+	manager.SetLeaseTimeouts(0, time.Minute)
+
+	lease, err := manager.AcquireLease(TaskKey{Name: "build"}, "in")
+	if err != nil {
+		t.Fatalf("lease error: %v", err)
+	}
+	if lease == nil || lease.Held() {
+		t.Fatalf("expected an unheld lease, got %+v", lease)
+	}
+	lease.Release()
+}
@@ -1,15 +1,24 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/taskvault/taskvault/internal/archive"
 	"github.com/taskvault/taskvault/internal/audit"
+	"github.com/taskvault/taskvault/internal/fileset"
 	"github.com/taskvault/taskvault/internal/hash"
+	"github.com/taskvault/taskvault/internal/metrics"
 	"github.com/taskvault/taskvault/internal/storage"
+	"github.com/taskvault/taskvault/internal/tracing"
 )
 
 // Manager orchestrates cache lookups, saves, and eviction
@@ -20,6 +29,20 @@ type Manager struct {
 	mu        sync.RWMutex
 	policies  map[string]*EvictionPolicy
 	maxSizeGB int64
+
+	// Optional second tier consulted after a local miss
+	remote         storage.Backend
+	remoteReadOnly bool
+
+	// Single-flight of concurrent misses on one key, see AcquireLease
+	flightMu   sync.Mutex
+	flights    map[string]*flight
+	leaseOwner string
+	leaseTTL   time.Duration
+	leaseWait  time.Duration
+
+	// Set by EnableMetrics
+	metrics *metrics.Registry
 }
 
 // EvictionPolicy defines TTL and eviction strategy
@@ -27,7 +50,10 @@ type EvictionPolicy struct {
 	Name     string
 	TTL      time.Duration
 	MaxSize  int64  // bytes
-	Strategy string // "lru", "lfu", "fifo"
+	Strategy string // "lru", "lfu", "fifo", "cost"
+
+	Compression      string // "zstd" (default), "gzip", "none"
+	CompressionLevel int
 }
 
 // NewManager creates a cache manager
@@ -49,6 +75,11 @@ func NewManager(cacheDir string, maxSizeGB int64, hashAlgo hash.HashAlgorithm) (
 		auditLog:  auditLogger,
 		policies:  make(map[string]*EvictionPolicy),
 		maxSizeGB: maxSizeGB,
+
+		flights:    make(map[string]*flight),
+		leaseOwner: newLeaseOwner(),
+		leaseTTL:   DefaultLeaseTTL,
+		leaseWait:  DefaultLeaseWait,
 	}, nil
 }
 
@@ -61,98 +92,562 @@ func (m *Manager) RegisterPolicy(policy *EvictionPolicy) error {
 		return fmt.Errorf("policy name required")
 	}
 
+	strategy, err := storage.StrategyByName(policy.Strategy)
+	if err != nil {
+		return err
+	}
+
+	compression, err := storage.CompressionByName(policy.Compression, policy.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	// The default policy's strategy also governs cache-wide eviction, and
+	// its compression applies to entries fetched from a remote
+	if policy.Name == DefaultPolicyName {
+		m.store.SetEvictionStrategy(strategy)
+		m.store.SetCompression(compression)
+	}
+
 	m.policies[policy.Name] = policy
 	return nil
 }
 
 // SaveResult caches the result of a task execution
 func (m *Manager) SaveResult(taskName string, inputData []byte, output []byte, metadata map[string]interface{}) (string, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	return m.SaveTaskResult(TaskKey{Name: taskName}, inputData, output, metadata)
+}
 
+// SaveTaskResult caches a task result under its composite key
+// (task name, version, environment and input hash)
+func (m *Manager) SaveTaskResult(key TaskKey, inputData []byte, output []byte, metadata map[string]interface{}) (string, error) {
+	return m.SaveTaskResultContext(context.Background(), key, inputData, output, metadata)
+}
+
+// SaveTaskResultContext is SaveTaskResult under ctx
+func (m *Manager) SaveTaskResultContext(ctx context.Context, key TaskKey, inputData []byte, output []byte, metadata map[string]interface{}) (string, error) {
 	// Compute content hash
 	inputHash, err := m.hasher.HashData(inputData)
+	if err != nil {
+		m.auditLog.LogError("hash_error", key.Name, err)
+		return "", fmt.Errorf("hash error: %w", err)
+	}
+
+	return m.SaveByInputHashContext(ctx, key, inputHash, output, metadata)
+}
+
+// SaveByInputHash caches a task result for an already computed input hash,
+// e.g. one produced by HashInputs
+func (m *Manager) SaveByInputHash(key TaskKey, inputHash string, output []byte, metadata map[string]interface{}) (string, error) {
+	return m.SaveByInputHashContext(context.Background(), key, inputHash, output, metadata)
+}
+
+// SaveByInputHashContext is SaveByInputHash under ctx
+func (m *Manager) SaveByInputHashContext(ctx context.Context, key TaskKey, inputHash string, output []byte, metadata map[string]interface{}) (string, error) {
+	return m.SaveStreamContext(ctx, key, inputHash, bytes.NewReader(output), metadata)
+}
+
+// SaveStream caches a task result read from r without holding it in memory.
+// The output is hashed while it is written to the blob store.
+func (m *Manager) SaveStream(key TaskKey, inputHash string, r io.Reader, metadata map[string]interface{}) (string, error) {
+	return m.SaveStreamContext(context.Background(), key, inputHash, r, metadata)
+}
+
+// SaveStreamContext is SaveStream under ctx. The save fails, leaving
+// nothing cached, if ctx is done before it commits.
+func (m *Manager) SaveStreamContext(ctx context.Context, key TaskKey, inputHash string, r io.Reader, metadata map[string]interface{}) (string, error) {
+	return m.save(ctx, key, inputHash, r, nil, metadata)
+}
+
+// SaveOutputs archives a set of output files and directories (relative to
+// the working directory) and caches the archive for an input hash. The
+// archive manifest is recorded in the entry metadata under "outputs".
+func (m *Manager) SaveOutputs(key TaskKey, inputHash string, paths []string, metadata map[string]interface{}) (string, error) {
+	return m.SaveOutputsContext(context.Background(), key, inputHash, paths, metadata)
+}
+
+// SaveOutputsContext is SaveOutputs under ctx, see SaveStreamContext
+func (m *Manager) SaveOutputsContext(ctx context.Context, key TaskKey, inputHash string, paths []string, metadata map[string]interface{}) (string, error) {
+	pr, pw := io.Pipe()
+
+	// Pack streams into the blob store; the manifest is only complete once
+	// the archive has been fully read
+	var manifest *archive.Manifest
+	go func() {
+		packed, err := archive.Pack(pw, paths, m.hasher)
+		manifest = packed
+		pw.CloseWithError(err)
+	}()
+
+	cacheKey, err := m.save(ctx, key, inputHash, pr, func() map[string]interface{} {
+		return map[string]interface{}{"outputs": manifest}
+	}, metadata)
+	pr.Close()
+
+	return cacheKey, err
+}
+
+// RestoreOutputs looks up an entry saved with SaveOutputs and, on a hit,
+// atomically restores its files below dest
+func (m *Manager) RestoreOutputs(key TaskKey, inputHash string, dest string) (map[string]interface{}, bool, error) {
+	return m.RestoreOutputsContext(context.Background(), key, inputHash, dest)
+}
+
+// RestoreOutputsContext is RestoreOutputs under ctx. A deadline expiring
+// before the files are in place is a miss, as in OpenResultContext.
+func (m *Manager) RestoreOutputsContext(ctx context.Context, key TaskKey, inputHash string, dest string) (map[string]interface{}, bool, error) {
+	l, err := m.openResult(ctx, key, inputHash)
+	if err != nil || l == nil {
+		return nil, false, err
+	}
+	defer l.blob.Close()
+
+	metadata := l.entry.Metadata
+	if !HasOutputs(metadata) {
+		m.auditGet(l, audit.ResultHit, "")
+		return nil, false, fmt.Errorf("cached entry for %s is not an output archive", key.Name)
+	}
+
+	_, span := tracing.Start(ctx, "cache.unpack", tracing.Task.String(key.Name))
+	_, err = archive.Unpack(l.blob, dest)
+	tracing.End(span, err)
+	if err != nil {
+		// Nothing was restored; a corrupted entry is gone by now
+		if miss, reason := readMiss(err); miss {
+			m.auditGet(l, audit.ResultMiss, reason)
+			return nil, false, nil
+		}
+		m.auditLog.LogError("restore_error", key.Name, err)
+		return nil, false, fmt.Errorf("restore error: %w", err)
+	}
+	m.auditGet(l, audit.ResultHit, "")
+	return metadata, true, nil
+}
+
+// HasOutputs reports whether entry metadata describes an output archive
+func HasOutputs(metadata map[string]interface{}) bool {
+	_, ok := metadata["outputs"]
+	return ok
+}
+
+// save streams output from r into the store under the composite key.
+// extra, if set, is called once the output has been fully read and its
+// result merged into the entry's top-level metadata.
+func (m *Manager) save(ctx context.Context, key TaskKey, inputHash string, r io.Reader, extra func() map[string]interface{}, metadata map[string]interface{}) (cacheKey string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	taskName := key.Name
+	start := time.Now()
+
+	ctx, span := tracing.Start(ctx, "cache.save", tracing.Task.String(taskName))
+	defer func() { tracing.End(span, err) }()
+
+	cacheKey, err = m.computeKey(key, inputHash)
+	if err != nil {
+		m.auditLog.LogError("hash_error", taskName, err)
+		return "", fmt.Errorf("key error: %w", err)
+	}
+
+	outputHasher, err := m.hasher.NewHash()
 	if err != nil {
 		m.auditLog.LogError("hash_error", taskName, err)
 		return "", fmt.Errorf("hash error: %w", err)
 	}
 
+	policy := m.policyFor(taskName)
+
+	compression := storage.Compression{Codec: storage.CodecZstd}
+	if policy != nil {
+		compression, _ = storage.CompressionByName(policy.Compression, policy.CompressionLevel) // validated on register
+	}
+
+	blob, err := m.store.NewCompressedBlobWriter(compression)
+	if err != nil {
+		m.auditLog.LogError("save_error", taskName, err)
+		return "", fmt.Errorf("save error: %w", err)
+	}
+
+	var dst io.Writer = io.MultiWriter(blob, outputHasher)
+	if policy != nil && policy.MaxSize > 0 {
+		dst = &limitWriter{w: dst, limit: policy.MaxSize}
+	}
+
+	_, writeSpan := tracing.Start(ctx, "cache.blob_write")
+	_, err = io.Copy(dst, storage.ContextReader(ctx, r))
+	writeSpan.SetAttributes(tracing.Size.Int64(blob.Size()))
+	tracing.End(writeSpan, err)
+	if err != nil {
+		blob.Abort()
+		if errors.Is(err, ErrEntryTooLarge) {
+			m.auditLog.LogError("policy_rejected", taskName, err)
+			return "", fmt.Errorf("save error: %w (limit %d bytes)", err, policy.MaxSize)
+		}
+		m.auditLog.LogError("save_error", taskName, err)
+		return "", fmt.Errorf("save error: %w", err)
+	}
+
 	now := time.Now()
 	entry := &storage.Entry{
-		Hash:       inputHash,
-		Data:       output,
+		Hash:       cacheKey,
 		CreatedAt:  now,
 		AccessedAt: now,
-		Size:       int64(len(output)),
+		KeySchema:  KeySchemaComposite,
+		Task:       taskName,
+		Tags:       stringList(metadata[MetadataTags]),
+
+		ComputeTime: computeTime(metadata),
 		Metadata: map[string]interface{}{
-			"task":        taskName,
-			"input_hash":  inputHash,
-			"output_size": len(output),
-			"user_data":   metadata,
+			"task":         taskName,
+			"task_version": key.Version,
+			"env":          key.Env,
+			"input_hash":   inputHash,
+			"output_hash":  hex.EncodeToString(outputHasher.Sum(nil)),
+			"output_size":  blob.Size(),
+			"user_data":    metadata,
 		},
 	}
+	if extra != nil {
+		for k, v := range extra() {
+			entry.Metadata[k] = v
+		}
+	}
 
 	// Apply policy TTL if specified
-	if policy, exists := m.policies[taskName]; exists {
-		if policy.TTL > 0 {
-			expiresAt := now.Add(policy.TTL)
-			entry.ExpiresAt = &expiresAt
-		}
+	if policy != nil && policy.TTL > 0 {
+		expiresAt := now.Add(policy.TTL)
+		entry.ExpiresAt = &expiresAt
 	}
 
-	if err := m.store.Set(entry); err != nil {
+	if err := m.store.CommitContext(ctx, entry, blob); err != nil {
+		abortMissing(blob, err) // r cannot be read again
 		m.auditLog.LogError("save_error", taskName, err)
 		return "", fmt.Errorf("save error: %w", err)
 	}
+	span.SetAttributes(tracing.Key.String(cacheKey), tracing.Size.Int64(entry.Size), tracing.Stored.Int64(entry.StoredSize))
+
+	m.enforceTaskCap(ctx, policy, taskName, cacheKey)
+	m.auditLog.Log(audit.Record{
+		Result:     audit.ResultHit,
+		Operation:  "save",
+		Task:       taskName,
+		Hash:       cacheKey,
+		DurationMS: millisSince(start),
+		Size:       entry.Size,
+		StoredSize: entry.StoredSize,
+	})
+
+	m.pushRemote(ctx, taskName, cacheKey)
+	return cacheKey, nil
+}
+
+// enforceTaskCap keeps the task's total footprint within its policy cap,
+// never evicting keep
+func (m *Manager) enforceTaskCap(ctx context.Context, policy *EvictionPolicy, taskName, keep string) {
+	if policy == nil || policy.MaxSize <= 0 {
+		return
+	}
 
-	m.auditLog.LogHit("save", taskName, inputHash)
-	return inputHash, nil
+	_, span := tracing.Start(ctx, "cache.enforce_task_cap", tracing.Task.String(taskName))
+	strategy, _ := storage.StrategyByName(policy.Strategy) // validated on register
+	evicted, err := m.store.EvictTask(taskName, policy.MaxSize, strategy, keep)
+	span.SetAttributes(tracing.Count.Int(evicted))
+	tracing.End(span, err)
+	if err != nil {
+		m.auditLog.LogError("evict_error", taskName, err)
+	}
 }
 
 // GetResult retrieves a cached result by task name and input
 func (m *Manager) GetResult(taskName string, inputData []byte) ([]byte, map[string]interface{}, bool, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	return m.GetTaskResult(TaskKey{Name: taskName}, inputData)
+}
+
+// GetTaskResult retrieves a cached result by composite task key and input
+func (m *Manager) GetTaskResult(key TaskKey, inputData []byte) ([]byte, map[string]interface{}, bool, error) {
+	return m.GetTaskResultContext(context.Background(), key, inputData)
+}
 
+// GetTaskResultContext is GetTaskResult under ctx, see OpenResultContext
+func (m *Manager) GetTaskResultContext(ctx context.Context, key TaskKey, inputData []byte) ([]byte, map[string]interface{}, bool, error) {
 	// Compute input hash
 	inputHash, err := m.hasher.HashData(inputData)
 	if err != nil {
-		m.auditLog.LogError("hash_error", taskName, err)
+		m.auditLog.LogError("hash_error", key.Name, err)
 		return nil, nil, false, fmt.Errorf("hash error: %w", err)
 	}
 
-	// Look up in cache
-	entry, err := m.store.Get(inputHash)
+	return m.GetByInputHashContext(ctx, key, inputHash)
+}
+
+// GetByInputHash retrieves a cached result for an already computed input hash
+func (m *Manager) GetByInputHash(key TaskKey, inputHash string) ([]byte, map[string]interface{}, bool, error) {
+	return m.GetByInputHashContext(context.Background(), key, inputHash)
+}
+
+// GetByInputHashContext is GetByInputHash under ctx. A deadline expiring
+// while the output is read is a miss, as in OpenResultContext.
+func (m *Manager) GetByInputHashContext(ctx context.Context, key TaskKey, inputHash string) ([]byte, map[string]interface{}, bool, error) {
+	l, err := m.openResult(ctx, key, inputHash)
+	if err != nil || l == nil {
+		return nil, nil, false, err
+	}
+	defer l.blob.Close()
+
+	output, err := io.ReadAll(l.blob)
+	if miss, reason := readMiss(err); miss {
+		m.auditGet(l, audit.ResultMiss, reason)
+		return nil, nil, false, nil
+	}
 	if err != nil {
-		m.auditLog.LogError("get_error", taskName, err)
+		m.auditLog.LogError("get_error", key.Name, err)
 		return nil, nil, false, fmt.Errorf("get error: %w", err)
 	}
+	m.auditGet(l, audit.ResultHit, "")
+	return output, l.entry.Metadata, true, nil
+}
+
+// readMiss reports whether reading a hit failed in a way that makes it a
+// miss: the blob was corrupt (logged and quarantined) or the deadline
+// expired. reason is recorded with the miss.
+func readMiss(err error) (miss bool, reason string) {
+	switch {
+	case errors.Is(err, storage.ErrCorrupt):
+		return true, "corrupt"
+	case errors.Is(err, context.DeadlineExceeded):
+		return true, "lookup deadline exceeded"
+	}
+	return false, ""
+}
+
+// OpenResult looks up a cached result and returns a reader streaming its
+// contents, which the caller must close
+func (m *Manager) OpenResult(key TaskKey, inputHash string) (io.ReadCloser, map[string]interface{}, bool, error) {
+	return m.OpenResultContext(context.Background(), key, inputHash)
+}
+
+// OpenResultContext is OpenResult under ctx, recorded as a span in ctx's
+// trace with child spans for the store lookup and any remote fetch. The
+// lookup is a miss, not an error, if ctx's deadline expires before it
+// finds the entry; reading the returned blob fails with ctx's error once
+// ctx is done. Cancelling ctx fails the lookup.
+func (m *Manager) OpenResultContext(ctx context.Context, key TaskKey, inputHash string) (io.ReadCloser, map[string]interface{}, bool, error) {
+	l, err := m.openResult(ctx, key, inputHash)
+	if err != nil || l == nil {
+		return nil, nil, false, err
+	}
+
+	// Streamed to the caller, so audited before anyone reads it
+	m.auditGet(l, audit.ResultHit, "")
+	return l.blob, l.entry.Metadata, true, nil
+}
+
+// lookup is an entry openResult found, and what auditing it takes
+type lookup struct {
+	taskName string
+	cacheKey string
+	entry    *storage.Entry
+	blob     io.ReadCloser
+	start    time.Time
+}
+
+// openResult looks up a cached result for OpenResultContext, auditing a
+// miss but leaving a hit to its caller to audit, once known to be
+// readable. Returns nil on a miss.
+func (m *Manager) openResult(ctx context.Context, key TaskKey, inputHash string) (l *lookup, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	taskName := key.Name
+	start := time.Now()
+
+	ctx, span := tracing.Start(ctx, "cache.get", tracing.Task.String(taskName))
+	defer func() {
+		span.SetAttributes(tracing.Hit.Bool(l != nil))
+		tracing.End(span, err)
+	}()
+
+	cacheKey, err := m.computeKey(key, inputHash)
+	if err != nil {
+		m.auditLog.LogError("hash_error", taskName, err)
+		return nil, fmt.Errorf("key error: %w", err)
+	}
+
+	span.SetAttributes(tracing.Key.String(cacheKey))
+
+	// Look up in cache
+	entry, blob, err := m.store.OpenContext(ctx, cacheKey)
+	if m.lookupFailed(taskName, err) {
+		m.auditLog.LogError("get_error", taskName, err)
+		return nil, fmt.Errorf("get error: %w", err)
+	}
 
 	if entry == nil {
-		m.auditLog.LogMiss("get", taskName, inputHash)
-		return nil, nil, false, nil // Cache miss
+		entry, blob, err = m.openLegacy(ctx, key, inputHash)
+		if m.lookupFailed(taskName, err) {
+			m.auditLog.LogError("get_error", taskName, err)
+			return nil, fmt.Errorf("get error: %w", err)
+		}
+	}
+
+	if entry == nil {
+		entry, blob = m.openRemote(ctx, taskName, cacheKey)
 	}
 
-	m.auditLog.LogHit("get", taskName, inputHash)
-	return entry.Data, entry.Metadata, true, nil
+	l = &lookup{taskName: taskName, cacheKey: cacheKey, entry: entry, start: start}
+	if entry == nil {
+		if err := m.store.RecordMiss(taskName); err != nil {
+			m.auditLog.LogError("stats_error", taskName, err)
+		}
+		reason := ""
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "lookup deadline exceeded"
+		}
+		m.auditGet(l, audit.ResultMiss, reason)
+		return nil, nil // Cache miss
+	}
+
+	span.SetAttributes(tracing.Size.Int64(entry.Size))
+	l.blob = &auditedBlob{ReadCloser: blob, manager: m, taskName: taskName}
+	return l, nil
+}
+
+// auditGet records a lookup's result; reason, if set, says why a miss was
+func (m *Manager) auditGet(l *lookup, result, reason string) {
+	rec := audit.Record{
+		Result:     result,
+		Operation:  "get",
+		Task:       l.taskName,
+		Hash:       l.cacheKey,
+		DurationMS: millisSince(l.start),
+		Error:      reason,
+	}
+	if l.entry != nil {
+		rec.Hash = l.entry.Hash
+		if result == audit.ResultHit {
+			rec.Size = l.entry.Size
+			rec.StoredSize = l.entry.StoredSize
+		}
+	}
+	m.auditLog.Log(rec)
+}
+
+// lookupFailed reports whether a lookup's error is a failure. Corruption
+// is logged and, like the lookup's deadline expiring, read as a miss.
+func (m *Manager) lookupFailed(taskName string, err error) bool {
+	return err != nil && !m.logCorruption(taskName, err) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// millisSince returns the milliseconds elapsed since start, for the audit log
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// HashInputs expands file, directory and glob patterns and returns the
+// manifest hash of the matched files (paths relative to the working directory)
+func (m *Manager) HashInputs(patterns []string) (string, error) {
+	return m.HashInputsContext(context.Background(), patterns)
+}
+
+// HashInputsContext is HashInputs, recorded as a span in ctx's trace
+func (m *Manager) HashInputsContext(ctx context.Context, patterns []string) (digest string, err error) {
+	ctx, span := tracing.Start(ctx, "cache.hash_inputs")
+	defer func() { tracing.End(span, err) }()
+
+	files, err := fileset.Expand(patterns)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve inputs: %w", err)
+	}
+	span.SetAttributes(tracing.Files.Int(len(files)))
+
+	return m.hasher.HashManifestContext(ctx, ".", files)
+}
+
+// HashInputFile hashes a single input file by content only, matching the
+// input hash SaveTaskResult computes for the same bytes
+func (m *Manager) HashInputFile(path string) (string, error) {
+	return m.HashInputFileContext(context.Background(), path)
+}
+
+// HashInputFileContext is HashInputFile, recorded as a span in ctx's trace
+func (m *Manager) HashInputFileContext(ctx context.Context, path string) (string, error) {
+	return m.hasher.HashFileContext(ctx, path)
+}
+
+// openLegacy looks up an entry written before composite keys, keyed by the
+// bare input hash. It only counts as a hit when the row belongs to the same
+// task and the caller declares no version or environment, since legacy rows
+// carry neither.
+func (m *Manager) openLegacy(ctx context.Context, key TaskKey, inputHash string) (*storage.Entry, io.ReadCloser, error) {
+	if key.Version != "" || len(key.Env) > 0 {
+		return nil, nil, nil
+	}
+
+	entry, blob, err := m.store.OpenContext(ctx, inputHash)
+	if err != nil || entry == nil {
+		return nil, nil, err
+	}
+
+	if entry.KeySchema != KeySchemaLegacy || entry.Metadata["task"] != key.Name {
+		blob.Close()
+		return nil, nil, nil
+	}
+	return entry, blob, nil
 }
 
 // InvalidateTask clears all cached entries for a task
 func (m *Manager) InvalidateTask(taskName string) (int, error) {
+	return m.InvalidateTaskContext(context.Background(), taskName)
+}
+
+// InvalidateTaskContext is InvalidateTask under ctx
+func (m *Manager) InvalidateTaskContext(ctx context.Context, taskName string) (int, error) {
+	return m.InvalidateTaskFilteredContext(ctx, taskName, InvalidateFilter{})
+}
+
+// InvalidateFilter narrows which of a task's entries are invalidated
+type InvalidateFilter struct {
+	OlderThan time.Duration // only entries created longer ago than this
+	Tag       string        // only entries saved with this tag
+}
+
+// InvalidateTaskFiltered clears a task's cached entries matching filter,
+// removing both rows and blobs, and returns the number removed
+func (m *Manager) InvalidateTaskFiltered(taskName string, filter InvalidateFilter) (int, error) {
+	return m.InvalidateTaskFilteredContext(context.Background(), taskName, filter)
+}
+
+// InvalidateTaskFilteredContext is InvalidateTaskFiltered under ctx. The
+// entries removed before ctx is done stay removed, and are counted.
+func (m *Manager) InvalidateTaskFilteredContext(ctx context.Context, taskName string, filter InvalidateFilter) (int, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// This is a simplified version - in production you'd query by metadata
-	// For now, manually delete specific hashes or implement metadata indexing
-	return 0, nil
+	storeFilter := storage.TaskFilter{Tag: filter.Tag}
+	if filter.OlderThan > 0 {
+		storeFilter.CreatedBefore = time.Now().Add(-filter.OlderThan)
+	}
+
+	removed, err := m.store.DeleteTaskContext(ctx, taskName, storeFilter)
+	if err != nil {
+		m.auditLog.LogError("invalidate_error", taskName, err)
+		return removed, fmt.Errorf("invalidate error: %w", err)
+	}
+
+	return removed, nil
 }
 
 // GetStats returns cache statistics
 func (m *Manager) GetStats() (map[string]interface{}, error) {
+	return m.GetStatsContext(context.Background())
+}
+
+// GetStatsContext is GetStats under ctx
+func (m *Manager) GetStatsContext(ctx context.Context) (map[string]interface{}, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	stats, err := m.store.Stats()
+	stats, err := m.store.StatsContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("stats error: %w", err)
 	}
@@ -161,16 +656,72 @@ func (m *Manager) GetStats() (map[string]interface{}, error) {
 	return stats, nil
 }
 
+// TaskStats returns hit and miss counters and time saved per task
+func (m *Manager) TaskStats() ([]storage.TaskStats, error) {
+	return m.TaskStatsContext(context.Background())
+}
+
+// TaskStatsContext is TaskStats under ctx
+func (m *Manager) TaskStatsContext(ctx context.Context) ([]storage.TaskStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats, err := m.store.TaskStatsContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("stats error: %w", err)
+	}
+	return stats, nil
+}
+
 // Close cleanly shuts down the manager
 func (m *Manager) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.close(context.Background())
+}
+
+// close shuts the manager down; callers must hold m.mu. The store closes
+// first, so if ctx ends the wait for its writes nothing is closed yet.
+func (m *Manager) close(ctx context.Context) error {
+	if err := m.store.CloseContext(ctx); err != nil {
+		return fmt.Errorf("cannot close cache: %w", err)
+	}
+
+	if m.remote != nil {
+		m.remote.Close()
+	}
 
 	if err := m.auditLog.Close(); err != nil {
 		return fmt.Errorf("audit log error: %w", err)
 	}
+	return nil
+}
+
+// CloseContext is Close, waiting for in-flight operations only until ctx
+// is done. It then returns ctx's error and leaves the manager open.
+func (m *Manager) CloseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("cannot close cache: %w", err)
+	}
 
-	return m.store.Close()
+	locked := make(chan struct{})
+	go func() {
+		m.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		defer m.mu.Unlock()
+		return m.close(ctx)
+	case <-ctx.Done():
+		// Hand the lock back as soon as it is granted
+		go func() {
+			<-locked
+			m.mu.Unlock()
+		}()
+		return fmt.Errorf("cannot close cache: %w", ctx.Err())
+	}
 }
 
 // ExportSnapshot exports current cache state as JSON for backup
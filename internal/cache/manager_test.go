@@ -0,0 +1,382 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/hash"
+	"github.com/taskvault/taskvault/internal/remote"
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+
+	manager, err := NewManager(t.TempDir(), 1, hash.Blake3)
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+	return manager
+}
+
+func TestTasksWithSameInputDoNotCollide(t *testing.T) {
+	manager := newTestManager(t)
+	input := []byte("same input")
+
+	if _, err := manager.SaveResult("lint", input, []byte("lint output"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	if _, err := manager.SaveResult("test", input, []byte("test output"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	output, _, hit, err := manager.GetResult("lint", input)
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	if !hit || string(output) != "lint output" {
+		t.Errorf("expected lint output, got hit=%v output=%q", hit, output)
+	}
+}
+
+func TestKeyIncludesVersionAndEnv(t *testing.T) {
+	manager := newTestManager(t)
+	input := []byte("input")
+
+	key := TaskKey{Name: "build", Version: "1", Env: map[string]string{"tool:go": "1.21"}}
+	if _, err := manager.SaveTaskResult(key, input, []byte("out"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	for _, other := range []TaskKey{
+		{Name: "build", Version: "2", Env: key.Env},
+		{Name: "build", Version: "1", Env: map[string]string{"tool:go": "1.22"}},
+		{Name: "build"},
+	} {
+		_, _, hit, err := manager.GetTaskResult(other, input)
+		if err != nil {
+			t.Fatalf("get error: %v", err)
+		}
+		if hit {
+			t.Errorf("unexpected hit for %+v", other)
+		}
+	}
+
+	if _, _, hit, _ := manager.GetTaskResult(key, input); !hit {
+		t.Errorf("expected hit for original key")
+	}
+}
+
+func TestSaveStreamRecordsOutputHash(t *testing.T) {
+	manager := newTestManager(t)
+	key := TaskKey{Name: "report"}
+	output := strings.Repeat("row\n", 100000)
+
+	if _, err := manager.SaveStream(key, "input-hash", strings.NewReader(output), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	blob, metadata, hit, err := manager.OpenResult(key, "input-hash")
+	if err != nil || !hit {
+		t.Fatalf("expected hit, got hit=%v err=%v", hit, err)
+	}
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(data) != output {
+		t.Errorf("streamed output does not match")
+	}
+
+	expected, _ := hash.NewEngine(hash.Blake3).HashData([]byte(output))
+	if metadata["output_hash"] != expected {
+		t.Errorf("expected output_hash %s, got %v", expected, metadata["output_hash"])
+	}
+}
+
+func TestConfigPoliciesAreEnforced(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.CacheDir = t.TempDir()
+	cfg.Policies["small"] = config.Policy{TTLSeconds: 60, MaxSizeBytes: 10}
+
+	manager, err := NewManagerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	defer manager.Close()
+
+	// Oversized outputs are rejected outright
+	_, err = manager.SaveResult("small", []byte("a"), []byte("way more than ten bytes"), nil)
+	if !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("expected ErrEntryTooLarge, got %v", err)
+	}
+
+	// Older entries are evicted once the task exceeds its cap
+	if _, err := manager.SaveResult("small", []byte("a"), []byte("123456"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	if _, err := manager.SaveResult("small", []byte("b"), []byte("789012"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	if _, _, hit, _ := manager.GetResult("small", []byte("a")); hit {
+		t.Errorf("expected oldest entry to be evicted")
+	}
+	if _, _, hit, _ := manager.GetResult("small", []byte("b")); !hit {
+		t.Errorf("expected newest entry to survive")
+	}
+
+	// Tasks without a named policy fall back to the default TTL
+	if _, err := manager.SaveResult("other", []byte("a"), []byte("out"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	entry, err := manager.store.Get(mustKey(t, manager, TaskKey{Name: "other"}, []byte("a")))
+	if err != nil || entry == nil {
+		t.Fatalf("expected entry, got %v", err)
+	}
+	if entry.ExpiresAt == nil || time.Until(*entry.ExpiresAt) < 6*24*time.Hour {
+		t.Errorf("expected default 7 day TTL, got %v", entry.ExpiresAt)
+	}
+}
+
+func mustKey(t *testing.T, m *Manager, key TaskKey, input []byte) string {
+	t.Helper()
+
+	inputHash, err := m.hasher.HashData(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheKey, err := m.computeKey(key, inputHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cacheKey
+}
+
+func TestInvalidateTask(t *testing.T) {
+	manager := newTestManager(t)
+
+	tagged := map[string]interface{}{MetadataTags: []string{"nightly"}}
+	if _, err := manager.SaveResult("build", []byte("a"), []byte("1"), tagged); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	if _, err := manager.SaveResult("build", []byte("b"), []byte("2"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	if _, err := manager.SaveResult("lint", []byte("a"), []byte("3"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	// Nothing is old enough yet
+	removed, err := manager.InvalidateTaskFiltered("build", InvalidateFilter{OlderThan: time.Hour})
+	if err != nil || removed != 0 {
+		t.Fatalf("expected 0 removed, got %d (%v)", removed, err)
+	}
+
+	removed, err = manager.InvalidateTaskFiltered("build", InvalidateFilter{Tag: "nightly"})
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 removed, got %d (%v)", removed, err)
+	}
+
+	removed, err = manager.InvalidateTask("build")
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 removed, got %d (%v)", removed, err)
+	}
+
+	if _, _, hit, _ := manager.GetResult("lint", []byte("a")); !hit {
+		t.Errorf("expected other tasks to be untouched")
+	}
+}
+
+func TestRemoteTier(t *testing.T) {
+	store, err := storage.NewStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	defer store.Close()
+
+	server := httptest.NewServer(remote.NewServer(store))
+	defer server.Close()
+
+	writer := newTestManager(t)
+	writer.SetRemote(remote.NewClient(server.URL), false)
+	if _, err := writer.SaveResult("build", []byte("in"), []byte("out"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	readOnly := newTestManager(t)
+	readOnly.SetRemote(remote.NewClient(server.URL), true)
+	output, _, hit, err := readOnly.GetResult("build", []byte("in"))
+	if err != nil || !hit || string(output) != "out" {
+		t.Fatalf("expected remote hit, got hit=%v output=%q err=%v", hit, output, err)
+	}
+	if _, err := readOnly.SaveResult("lint", []byte("in"), []byte("x"), nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	// Remote hits populate the local cache, which keeps serving them
+	// once the remote is gone; read-only managers never push
+	server.Close()
+	if _, _, hit, _ := readOnly.GetResult("build", []byte("in")); !hit {
+		t.Errorf("expected local hit after remote populated it")
+	}
+	if stats, _ := store.Stats(); stats["entries"] != int64(1) {
+		t.Errorf("expected only the writer's entry on the remote, got %v", stats["entries"])
+	}
+
+	// An unreachable remote is a miss, not an error
+	if _, _, hit, err := readOnly.GetResult("test", []byte("in")); hit || err != nil {
+		t.Errorf("expected plain miss, got hit=%v err=%v", hit, err)
+	}
+}
+
+func TestCorruptedEntryIsAMiss(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := NewManager(dir, 1, hash.Blake3)
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	defer manager.Close()
+
+	input := []byte("input")
+	output := []byte(strings.Repeat("test output\n", 50))
+	if _, err := manager.SaveResult("test", input, output, nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	entry, err := manager.store.Lookup(mustKey(t, manager, TaskKey{Name: "test"}, input))
+	if err != nil || entry == nil {
+		t.Fatalf("expected entry, got %v", err)
+	}
+	blobPath := filepath.Join(dir, "blobs", entry.BlobHash)
+	if err := os.WriteFile(blobPath, []byte("bit rot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, hit, err := manager.GetResult("test", input); hit || err != nil {
+		t.Fatalf("expected a corrupted entry to be a miss, got hit=%v err=%v", hit, err)
+	}
+
+	log, _ := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if !strings.Contains(string(log), `"result":"error","op":"corrupt","task":"test"`) {
+		t.Errorf("expected corruption in the audit log, got:\n%s", log)
+	}
+	if strings.Contains(string(log), `"result":"hit","op":"get"`) {
+		t.Errorf("expected the corrupted lookup audited as a miss, got:\n%s", log)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", entry.BlobHash)); err != nil {
+		t.Errorf("expected blob in quarantine: %v", err)
+	}
+}
+
+func TestCorruptBlobReadIsNotAHit(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := NewManager(dir, 1, hash.Blake3)
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	defer manager.Close()
+
+	// Stored raw, so it can be damaged without changing its size
+	if err := manager.RegisterPolicy(&EvictionPolicy{Name: "test", Compression: "none"}); err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("input")
+	output := []byte(strings.Repeat("test output\n", 50))
+	if _, err := manager.SaveResult("test", input, output, nil); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	entry, err := manager.store.Lookup(mustKey(t, manager, TaskKey{Name: "test"}, input))
+	if err != nil || entry == nil {
+		t.Fatalf("expected entry, got %v", err)
+	}
+	if entry.Codec != storage.CodecNone {
+		t.Fatalf("expected a raw blob, got codec %q", entry.Codec)
+	}
+	blobPath := filepath.Join(dir, "blobs", entry.BlobHash)
+	data, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(blobPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, hit, err := manager.GetResult("test", input); hit || err != nil {
+		t.Fatalf("expected a corrupted entry to be a miss, got hit=%v err=%v", hit, err)
+	}
+
+	tasks, err := manager.TaskStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Hits != 0 || tasks[0].Misses != 1 {
+		t.Errorf("expected 0 hits and 1 miss, got %+v", tasks)
+	}
+}
+
+func TestExpiredLookupIsAMiss(t *testing.T) {
+	manager := newTestManager(t)
+	key := TaskKey{Name: "build"}
+	if _, err := manager.SaveByInputHash(key, "in", []byte("built"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, _, hit, err := manager.GetByInputHashContext(expired, key, "in"); err != nil || hit {
+		t.Errorf("expected an expired lookup to miss, got hit=%v err=%v", hit, err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := manager.GetByInputHashContext(cancelled, key, "in"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled lookup to fail, got %v", err)
+	}
+	if _, err := manager.SaveByInputHashContext(expired, key, "other", []byte("x"), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected an expired save to fail, got %v", err)
+	}
+
+	// Nothing was lost or cached by the expired operations
+	if _, _, hit, err := manager.GetByInputHash(key, "in"); err != nil || !hit {
+		t.Errorf("expected a hit, got hit=%v err=%v", hit, err)
+	}
+	if _, _, hit, _ := manager.GetByInputHash(key, "other"); hit {
+		t.Error("expected the expired save to cache nothing")
+	}
+}
+
+func TestSlowRemoteLookupEndsWithContext(t *testing.T) {
+	stuck := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer server.Close()
+	defer close(stuck)
+
+	manager := newTestManager(t)
+	manager.SetRemote(remote.NewClient(server.URL), true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, hit, err := manager.GetByInputHashContext(ctx, TaskKey{Name: "build"}, "in"); err != nil || hit {
+		t.Errorf("expected a miss, got hit=%v err=%v", hit, err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("expected the remote fetch to end with the context, waited %v", waited)
+	}
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"github.com/taskvault/taskvault/internal/audit"
+	"github.com/taskvault/taskvault/internal/metrics"
+)
+
+// managerMetrics counts this process's operations, fed by the audit log
+type managerMetrics struct {
+	operations *metrics.CounterVec
+	duration   *metrics.HistogramVec
+	read       *metrics.CounterVec
+	written    *metrics.CounterVec
+	errors     *metrics.CounterVec
+}
+
+// EnableMetrics instruments the manager and exports its store's metrics
+// in a new registry, returned by Metrics
+func (m *Manager) EnableMetrics() *metrics.Registry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.metrics != nil {
+		return m.metrics
+	}
+
+	reg := metrics.NewRegistry()
+	mm := &managerMetrics{
+		operations: reg.NewCounter("taskvault_cache_operations_total",
+			"Gets and saves by this process, by task and result.", "op", "task", "result"),
+		duration: reg.NewHistogram("taskvault_cache_operation_duration_seconds",
+			"Latency of gets and saves.", metrics.DefaultBuckets, "op"),
+		read: reg.NewCounter("taskvault_cache_read_bytes_total",
+			"Output bytes returned by hits, by task.", "task"),
+		written: reg.NewCounter("taskvault_cache_written_bytes_total",
+			"Output bytes saved, by task.", "task"),
+		errors: reg.NewCounter("taskvault_cache_errors_total",
+			"Errors by type, e.g. corrupt or remote_error.", "type"),
+	}
+	m.store.RegisterMetrics(reg)
+	m.auditLog.SetObserver(mm.observe)
+
+	m.metrics = reg
+	return reg
+}
+
+// Metrics returns the registry set up by EnableMetrics, or nil
+func (m *Manager) Metrics() *metrics.Registry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.metrics
+}
+
+func (mm *managerMetrics) observe(rec audit.Record) {
+	if rec.Result == audit.ResultError {
+		mm.errors.Inc(rec.Operation)
+		return
+	}
+	if rec.Operation != "get" && rec.Operation != "save" {
+		return
+	}
+
+	mm.operations.Inc(rec.Operation, rec.Task, rec.Result)
+	mm.duration.Observe(rec.DurationMS/1000, rec.Operation)
+	switch {
+	case rec.Operation == "get" && rec.Result == audit.ResultHit:
+		mm.read.Add(float64(rec.Size), rec.Task)
+	case rec.Operation == "save":
+		mm.written.Add(float64(rec.Size), rec.Task)
+	}
+}
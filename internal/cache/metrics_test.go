@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountOperations(t *testing.T) {
+	manager := newTestManager(t)
+	reg := manager.EnableMetrics()
+	key := TaskKey{Name: "build"}
+
+	if _, _, hit, err := manager.GetByInputHash(key, "in"); err != nil || hit {
+		t.Fatalf("expected a miss, got hit=%v err=%v", hit, err)
+	}
+	if _, err := manager.SaveByInputHash(key, "in", []byte("built"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, hit, err := manager.GetByInputHash(key, "in"); err != nil || !hit {
+		t.Fatalf("expected a hit, got hit=%v err=%v", hit, err)
+	}
+
+	var buf bytes.Buffer
+	if err := reg.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`taskvault_cache_operations_total{op="get",task="build",result="miss"} 1`,
+		`taskvault_cache_operations_total{op="get",task="build",result="hit"} 1`,
+		`taskvault_cache_operations_total{op="save",task="build",result="hit"} 1`,
+		`taskvault_cache_operation_duration_seconds_count{op="get"} 2`,
+		`taskvault_cache_read_bytes_total{task="build"} 5`,
+		`taskvault_cache_written_bytes_total{task="build"} 5`,
+		`taskvault_cache_entries{task="build"} 1`,
+		`taskvault_task_lookups_total{task="build",result="hit"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/audit"
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/hash"
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+// DefaultPolicyName is the policy applied to tasks without a named policy
+const DefaultPolicyName = "default"
+
+// MetadataDuration is the user metadata key under which callers record how
+// long the task took (milliseconds); cost-aware eviction ranks on it
+const MetadataDuration = "duration_ms"
+
+// MetadataTags is the user metadata key holding a list of tags that
+// invalidation can filter on
+const MetadataTags = "tags"
+
+// ErrEntryTooLarge is returned when an output exceeds its policy's max size
+var ErrEntryTooLarge = errors.New("output exceeds policy max size")
+
+// NewManagerFromConfig creates a cache manager and registers every policy
+// declared in the configuration
+func NewManagerFromConfig(cfg *config.Config) (*Manager, error) {
+	manager, err := NewManager(cfg.CacheDir, cfg.MaxSizeGB, hash.HashAlgorithm(cfg.HashAlgo))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, p := range cfg.Policies {
+		policy := &EvictionPolicy{
+			Name:     name,
+			TTL:      time.Duration(p.TTLSeconds) * time.Second,
+			MaxSize:  p.MaxSizeBytes,
+			Strategy: p.Strategy,
+
+			Compression:      p.Compression,
+			CompressionLevel: p.CompressionLevel,
+		}
+		if err := manager.RegisterPolicy(policy); err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("policy %s: %w", name, err)
+		}
+	}
+
+	verify, err := storage.VerifyModeByName(cfg.Verify)
+	if err != nil {
+		manager.Close()
+		return nil, err
+	}
+	manager.store.SetVerifyMode(verify)
+
+	manager.SetLeaseTimeouts(
+		time.Duration(cfg.Lease.TTLSeconds)*time.Second,
+		time.Duration(cfg.Lease.WaitTimeoutSeconds)*time.Second,
+	)
+
+	manager.auditLog.SetRotation(audit.Rotation{
+		MaxSize:    cfg.Audit.MaxSizeMB << 20,
+		MaxAge:     time.Duration(cfg.Audit.MaxAgeDays) * 24 * time.Hour,
+		MaxBackups: cfg.Audit.MaxBackups,
+		Compress:   cfg.Audit.Compress,
+	})
+
+	if cfg.Remote.URL != "" {
+		backend, err := NewRemoteBackend(cfg.Remote)
+		if err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("remote: %w", err)
+		}
+		manager.SetRemote(backend, cfg.Remote.ReadOnly)
+	}
+
+	return manager, nil
+}
+
+// policyFor returns the task's own policy, falling back to the default
+// policy; nil if neither is registered. Callers must hold m.mu.
+func (m *Manager) policyFor(taskName string) *EvictionPolicy {
+	if policy, exists := m.policies[taskName]; exists {
+		return policy
+	}
+	return m.policies[DefaultPolicyName]
+}
+
+// limitWriter fails once more than limit bytes have been written, so an
+// oversized output is rejected without streaming all of it to disk
+type limitWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		return 0, ErrEntryTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+// computeTime extracts the recorded task duration from user metadata
+func computeTime(metadata map[string]interface{}) time.Duration {
+	switch ms := metadata[MetadataDuration].(type) {
+	case int64:
+		return time.Duration(ms) * time.Millisecond
+	case int:
+		return time.Duration(ms) * time.Millisecond
+	case float64:
+		return time.Duration(ms * float64(time.Millisecond))
+	default:
+		return 0
+	}
+}
+
+// stringList converts a metadata value holding a list of strings
+func stringList(v interface{}) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		result := make([]string, 0, len(list))
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
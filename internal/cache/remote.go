@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/config"
+	"github.com/taskvault/taskvault/internal/remote"
+	"github.com/taskvault/taskvault/internal/storage"
+	"github.com/taskvault/taskvault/internal/tracing"
+)
+
+// NewRemoteBackend opens the remote tier described by cfg: an http(s) URL
+// for a `taskvault serve` instance, or s3://bucket/prefix for an
+// S3-compatible object store at cfg.Endpoint
+func NewRemoteBackend(cfg config.Remote) (storage.Backend, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		client := remote.NewClient(cfg.URL)
+		client.SetToken(cfg.TokenOrEnv())
+		return client, nil
+	case "s3":
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return storage.NewS3Backend(storage.S3Config{
+			Endpoint: cfg.Endpoint,
+			Region:   cfg.Region,
+			Bucket:   u.Host,
+			Prefix:   prefix,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported remote url scheme %q (want http, https or s3)", u.Scheme)
+	}
+}
+
+// SetRemote adds a remote cache tier: a TaskVault server, an object store or
+// any other backend. Local misses are looked up remotely and remote hits are
+// copied into the local cache; saves are pushed to the remote unless
+// readOnly is set. Remote failures never fail a lookup or save, they are
+// recorded in the audit log and treated as misses.
+func (m *Manager) SetRemote(backend storage.Backend, readOnly bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remote = backend
+	m.remoteReadOnly = readOnly
+}
+
+// pushRemote uploads a locally committed entry to the remote tier, if one
+// is configured for writing. Chunked blobs are sent as only the chunks the
+// remote lacks when it supports chunk lists. The upload is abandoned if
+// ctx ends. Callers must hold m.mu.
+func (m *Manager) pushRemote(ctx context.Context, taskName, cacheKey string) {
+	if m.remote == nil || m.remoteReadOnly {
+		return
+	}
+	remote := storage.WithContext(ctx, m.remote)
+
+	entry, blob, err := m.store.Peek(cacheKey)
+	if err != nil || entry == nil {
+		// Evicted already (entry larger than the cache) or unreadable
+		if err != nil {
+			m.auditLog.LogError("remote_error", taskName, err)
+		}
+		return
+	}
+	defer blob.Close()
+
+	if chunks, ok := remote.(storage.ChunkStore); ok && len(entry.Chunks) > 0 {
+		_, err = storage.CopyChunks(chunks, m.store, entry.Chunks)
+		if err == nil {
+			err = chunks.SetChunks(entry)
+		}
+	} else {
+		err = remote.SetStream(entry, blob)
+	}
+	if err != nil {
+		m.auditLog.LogError("remote_error", taskName, err)
+		return
+	}
+	m.auditLog.LogHit("remote_push", taskName, cacheKey)
+}
+
+// openRemote fetches an entry from the remote tier, copies it into the
+// local cache and opens the local copy. Returns nil on a remote miss, any
+// remote failure or once ctx ends, abandoning the fetch. Callers must hold
+// m.mu.
+func (m *Manager) openRemote(ctx context.Context, taskName, cacheKey string) (*storage.Entry, io.ReadCloser) {
+	if m.remote == nil || ctx.Err() != nil {
+		return nil, nil
+	}
+
+	fetchCtx, span := tracing.Start(ctx, "cache.remote_fetch", tracing.Task.String(taskName), tracing.Key.String(cacheKey))
+	found, err := m.fetchRemote(fetchCtx, cacheKey)
+	span.SetAttributes(tracing.Hit.Bool(found))
+	tracing.End(span, err)
+	if err != nil {
+		m.auditLog.LogError("remote_error", taskName, err)
+		return nil, nil
+	}
+	if !found {
+		m.auditLog.LogMiss("remote_get", taskName, cacheKey)
+		return nil, nil
+	}
+	m.enforceTaskCap(ctx, m.policyFor(taskName), taskName, cacheKey)
+	m.auditLog.LogHit("remote_get", taskName, cacheKey)
+
+	local, localBlob, err := m.store.OpenContext(ctx, cacheKey)
+	if err != nil {
+		if m.lookupFailed(taskName, err) {
+			m.auditLog.LogError("get_error", taskName, err)
+		}
+		return nil, nil
+	}
+	return local, localBlob
+}
+
+// fetchRemote copies an entry from the remote tier into the local store,
+// reporting whether the remote had it. Chunked blobs only transfer the
+// chunks the local store lacks. Remote requests are made under ctx.
+func (m *Manager) fetchRemote(ctx context.Context, cacheKey string) (bool, error) {
+	remote := storage.WithContext(ctx, m.remote)
+	if chunks, ok := remote.(storage.ChunkStore); ok {
+		entry, err := chunks.Lookup(cacheKey)
+		if err != nil || entry == nil {
+			return false, err
+		}
+		if len(entry.Chunks) > 0 {
+			if _, err := storage.CopyChunks(m.store, chunks, entry.Chunks); err != nil {
+				return false, err
+			}
+			resetFetched(entry, cacheKey)
+			return true, m.store.SetChunks(entry)
+		}
+	}
+
+	entry, body, err := remote.Open(cacheKey)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	defer body.Close()
+
+	blob, err := m.store.NewBlobWriter()
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(blob, body); err != nil {
+		blob.Abort()
+		return false, err
+	}
+
+	resetFetched(entry, cacheKey)
+	if err := m.store.Commit(entry, blob); err != nil {
+		abortMissing(blob, err) // the body cannot be read again
+		return false, err
+	}
+	return true, nil
+}
+
+// abortMissing discards a blob writer that Commit kept for its missing
+// chunks to be resupplied, for callers that cannot read the blob again
+func abortMissing(blob *storage.BlobWriter, err error) {
+	var missing *storage.MissingChunksError
+	if errors.As(err, &missing) {
+		blob.Abort()
+	}
+}
+
+// resetFetched prepares a remote entry to be stored locally as unread
+func resetFetched(entry *storage.Entry, cacheKey string) {
+	entry.Hash = cacheKey
+	entry.AccessedAt = time.Now()
+	entry.HitCount = 0
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestGetIsTracedWithChildSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	manager := newTestManager(t)
+	key := TaskKey{Name: "build"}
+	if _, err := manager.SaveByInputHash(key, "in", []byte("built"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, _, hit, err := manager.OpenResultContext(context.Background(), key, "in")
+	if err != nil || !hit {
+		t.Fatalf("expected a hit, got hit=%v err=%v", hit, err)
+	}
+	io.Copy(io.Discard, blob)
+	blob.Close()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"cache.save", "cache.blob_write", "storage.commit", "cache.get", "storage.open", "storage.blob_read"} {
+		if spans[name] == nil {
+			t.Fatalf("expected a %s span, got %d spans", name, len(spans))
+		}
+	}
+
+	get := spans["cache.get"].SpanContext().SpanID()
+	for _, name := range []string{"storage.open", "storage.blob_read"} {
+		if parent := spans[name].Parent().SpanID(); parent != get {
+			t.Errorf("expected %s to be a child of cache.get, got parent %s", name, parent)
+		}
+	}
+	if parent := spans["storage.commit"].Parent().SpanID(); parent != spans["cache.save"].SpanContext().SpanID() {
+		t.Errorf("expected storage.commit to be a child of cache.save, got parent %s", parent)
+	}
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+// Verify checks every cached blob against its content hash and the index
+// against the blob directory, optionally repairing what it finds. Each
+// problem is recorded in the audit log.
+func (m *Manager) Verify(repair bool) (*storage.VerifyReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	report, err := m.store.Verify(repair)
+	if err != nil {
+		m.auditLog.LogError("verify_error", "", err)
+		return nil, fmt.Errorf("verify error: %w", err)
+	}
+
+	for _, problem := range report.Problems {
+		detail := fmt.Sprintf("%s %s", problem.Hash, problem.Detail)
+		if len(problem.Entries) > 0 {
+			detail += fmt.Sprintf(" (removed %s)", strings.Join(problem.Entries, ", "))
+		}
+		m.auditLog.LogError(problem.Kind, "", errors.New(detail))
+	}
+	return report, nil
+}
+
+// logCorruption records a blob that failed verification on read. The
+// store has already quarantined it, so the lookup carries on as a miss.
+func (m *Manager) logCorruption(taskName string, err error) bool {
+	if !errors.Is(err, storage.ErrCorrupt) {
+		return false
+	}
+	m.auditLog.LogError("corrupt", taskName, err)
+	return true
+}
+
+// auditedBlob reports corruption detected while a blob streams to the
+// audit log, and counts the lookup as a miss; the store only counts a hit
+// for a blob read through
+type auditedBlob struct {
+	io.ReadCloser
+	manager  *Manager
+	taskName string
+	logged   bool
+}
+
+func (b *auditedBlob) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !b.logged {
+		b.logged = b.manager.logCorruption(b.taskName, err)
+		if b.logged {
+			if err := b.manager.store.RecordMiss(b.taskName); err != nil {
+				b.manager.auditLog.LogError("stats_error", b.taskName, err)
+			}
+		}
+	}
+	return n, err
+}
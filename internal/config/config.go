@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,13 +16,65 @@ type Config struct {
 	Policies    map[string]Policy `yaml:"policies"`
 	LogLevel    string            `yaml:"log_level"`
 	ServicePort int               `yaml:"service_port"`
+	Remote      Remote            `yaml:"remote,omitempty"`
+
+	// Bearer token `taskvault serve` requires of clients; empty serves
+	// anyone who can reach it. TASKVAULT_TOKEN overrides it.
+	ServiceToken string `yaml:"service_token,omitempty"`
+
+	// How cached blobs are checked against their content hash on read:
+	// "full", "fast" (default) or "skip"
+	Verify string `yaml:"verify,omitempty"`
+
+	Lease   Lease   `yaml:"lease,omitempty"`
+	Audit   Audit   `yaml:"audit,omitempty"`
+	Tracing Tracing `yaml:"tracing,omitempty"`
+}
+
+// Tracing configures recording OpenTelemetry spans of CLI commands
+type Tracing struct {
+	File string `yaml:"file"` // JSON spans are appended here; empty disables
+}
+
+// Audit configures rotation and retention of the audit log
+type Audit struct {
+	MaxSizeMB  int64 `yaml:"max_size_mb"`  // rotate at this size; 0 disables
+	MaxAgeDays int64 `yaml:"max_age_days"` // rotate at this age; 0 disables
+	MaxBackups int   `yaml:"max_backups"`  // rotated files kept; 0 keeps all
+	Compress   bool  `yaml:"compress"`     // gzip rotated files
+}
+
+// Lease configures how concurrent runs of a task that missed on the same
+// key wait for the first one to cache its result instead of all computing it
+type Lease struct {
+	TTLSeconds         int64 `yaml:"ttl_seconds"`          // how long a crashed holder blocks the others
+	WaitTimeoutSeconds int64 `yaml:"wait_timeout_seconds"` // 0 disables waiting
+}
+
+// Remote configures a shared cache consulted after the local cache misses:
+// a `taskvault serve` instance or an S3-compatible bucket
+type Remote struct {
+	URL      string `yaml:"url"`       // "http://cache.internal:9999" or "s3://bucket/prefix"; empty disables
+	ReadOnly bool   `yaml:"read_only"` // fetch from the remote but never push to it
+
+	// Bearer token of a `taskvault serve` remote; TASKVAULT_TOKEN overrides it
+	Token string `yaml:"token,omitempty"`
+
+	// S3 only; credentials come from AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY
+	Endpoint string `yaml:"endpoint,omitempty"` // e.g. "https://s3.us-east-1.amazonaws.com"
+	Region   string `yaml:"region,omitempty"`
 }
 
 // Policy defines eviction and caching rules per task
 type Policy struct {
 	TTLSeconds   int64  `yaml:"ttl_seconds"`
 	MaxSizeBytes int64  `yaml:"max_size_bytes"`
-	Strategy     string `yaml:"strategy"` // "lru", "lfu", "fifo"
+	Strategy     string `yaml:"strategy"` // "lru", "lfu", "fifo", "cost"
+
+	// Blob compression: "zstd" (default), "gzip" or "none", and the
+	// codec's level (0 for its default)
+	Compression      string `yaml:"compression,omitempty"`
+	CompressionLevel int    `yaml:"compression_level,omitempty"`
 }
 
 // DefaultConfig returns sensible defaults
@@ -32,11 +85,23 @@ func DefaultConfig() *Config {
 		HashAlgo:    "blake3",
 		LogLevel:    "info",
 		ServicePort: 9999,
+		Verify:      "fast",
+		Lease: Lease{
+			TTLSeconds:         30,
+			WaitTimeoutSeconds: 600, // 10 minutes
+		},
+		Audit: Audit{
+			MaxSizeMB:  100,
+			MaxAgeDays: 7,
+			MaxBackups: 5,
+			Compress:   true,
+		},
 		Policies: map[string]Policy{
 			"default": {
 				TTLSeconds:   86400 * 7,         // 7 days
 				MaxSizeBytes: 1024 * 1024 * 100, // 100 MB
 				Strategy:     "lru",
+				Compression:  "zstd",
 			},
 		},
 	}
@@ -61,6 +126,28 @@ func LoadFromFile(filePath string) (*Config, error) {
 	return cfg, nil
 }
 
+// TokenEnv overrides service_token and remote.token, keeping the secret
+// out of the config file
+const TokenEnv = "TASKVAULT_TOKEN"
+
+// envToken returns TokenEnv if set, else token
+func envToken(token string) string {
+	if env := os.Getenv(TokenEnv); env != "" {
+		return env
+	}
+	return token
+}
+
+// ServiceTokenOrEnv returns the token `taskvault serve` requires
+func (c *Config) ServiceTokenOrEnv() string {
+	return envToken(c.ServiceToken)
+}
+
+// TokenOrEnv returns the token sent to a `taskvault serve` remote
+func (r Remote) TokenOrEnv() string {
+	return envToken(r.Token)
+}
+
 // SaveToFile writes config to YAML file
 func (c *Config) SaveToFile(filePath string) error {
 	data, err := yaml.Marshal(c)
@@ -89,5 +176,30 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("hash_algorithm must be 'blake3' or 'sha256'")
 	}
 
+	switch c.Verify {
+	case "", "full", "fast", "skip":
+	default:
+		return fmt.Errorf("verify must be 'full', 'fast' or 'skip'")
+	}
+
+	if c.Lease.TTLSeconds < 1 {
+		return fmt.Errorf("lease.ttl_seconds must be >= 1")
+	}
+	if c.Lease.WaitTimeoutSeconds < 0 {
+		return fmt.Errorf("lease.wait_timeout_seconds must be >= 0")
+	}
+
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxAgeDays < 0 || c.Audit.MaxBackups < 0 {
+		return fmt.Errorf("audit.max_size_mb, max_age_days and max_backups must be >= 0")
+	}
+
+	if strings.HasPrefix(c.Remote.URL, "s3://") {
+		if c.Remote.Endpoint == "" {
+			return fmt.Errorf("remote.endpoint is required for s3:// remotes")
+		}
+	} else if c.Remote.URL != "" && !strings.HasPrefix(c.Remote.URL, "http://") && !strings.HasPrefix(c.Remote.URL, "https://") {
+		return fmt.Errorf("remote.url must be an http://, https:// or s3:// URL")
+	}
+
 	return nil
 }
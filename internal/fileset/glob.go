@@ -0,0 +1,142 @@
+package fileset
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Expand resolves input patterns to a sorted, de-duplicated list of files.
+// A pattern may name a file, a directory (every file below it), or a glob
+// in which "**" matches any number of path segments, e.g. "src/**/*.go".
+func Expand(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+
+	for _, pattern := range patterns {
+		matches, err := expandOne(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern %q matched no files", pattern)
+		}
+		for _, m := range matches {
+			seen[filepath.Clean(m)] = true
+		}
+	}
+
+	files := make([]string, 0, len(seen))
+	for f := range seen {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// expandOne resolves a single pattern
+func expandOne(pattern string) ([]string, error) {
+	slashPattern := filepath.ToSlash(filepath.Clean(pattern))
+
+	if !hasMeta(slashPattern) {
+		info, err := os.Lstat(pattern)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("cannot stat %s: %w", pattern, err)
+		}
+		if !info.IsDir() {
+			return []string{pattern}, nil
+		}
+		return walkFiles(pattern, func(string) bool { return true })
+	}
+
+	// Walk from the longest prefix without glob characters
+	segments := strings.Split(slashPattern, "/")
+	baseSegments := []string{}
+	for _, seg := range segments {
+		if hasMeta(seg) {
+			break
+		}
+		baseSegments = append(baseSegments, seg)
+	}
+	base := strings.Join(baseSegments, "/")
+	if base == "" {
+		base = "."
+		if strings.HasPrefix(slashPattern, "/") {
+			base = "/"
+		}
+	}
+
+	rest := segments[len(baseSegments):]
+	return walkFiles(filepath.FromSlash(base), func(rel string) bool {
+		return matchSegments(rest, strings.Split(rel, "/"))
+	})
+}
+
+// walkFiles returns files below root whose slash-separated path relative
+// to root satisfies match
+func walkFiles(root string, match func(rel string) bool) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if match(filepath.ToSlash(rel)) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot walk %s: %w", root, err)
+	}
+
+	return files, nil
+}
+
+// matchSegments matches path segments against pattern segments, where a
+// "**" pattern segment matches zero or more path segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// hasMeta reports whether s contains glob characters
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[`)
+}
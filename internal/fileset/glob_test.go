@@ -0,0 +1,182 @@
+package fileset
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTree creates each file, and its directories, below the current
+// directory
+func writeTree(t *testing.T, files ...string) {
+	t.Helper()
+
+	for _, f := range files {
+		p := filepath.FromSlash(f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// slashed converts Expand's results to slash paths for comparison
+func slashed(files []string) []string {
+	out := make([]string, len(files))
+	for i, f := range files {
+		out[i] = filepath.ToSlash(f)
+	}
+	return out
+}
+
+func TestExpand(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t,
+		"go.mod",
+		"src/main.go",
+		"src/main_test.go",
+		"src/util/strings.go",
+		"src/util/deep/er/path.go",
+		"src/util/README.md",
+		"docs/guide.md",
+	)
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{
+			name:     "file",
+			patterns: []string{"go.mod"},
+			want:     []string{"go.mod"},
+		},
+		{
+			name:     "directory",
+			patterns: []string{"src/util"},
+			want:     []string{"src/util/README.md", "src/util/deep/er/path.go", "src/util/strings.go"},
+		},
+		{
+			name:     "directory with trailing slash",
+			patterns: []string{"docs/"},
+			want:     []string{"docs/guide.md"},
+		},
+		{
+			name:     "star stays in one directory",
+			patterns: []string{"src/*.go"},
+			want:     []string{"src/main.go", "src/main_test.go"},
+		},
+		{
+			name:     "double star crosses directories",
+			patterns: []string{"src/**/*.go"},
+			want:     []string{"src/main.go", "src/main_test.go", "src/util/deep/er/path.go", "src/util/strings.go"},
+		},
+		{
+			name:     "double star in the middle",
+			patterns: []string{"src/**/er/*.go"},
+			want:     []string{"src/util/deep/er/path.go"},
+		},
+		{
+			name:     "leading double star",
+			patterns: []string{"**/*.md"},
+			want:     []string{"docs/guide.md", "src/util/README.md"},
+		},
+		{
+			name:     "overlapping patterns are de-duplicated",
+			patterns: []string{"src/util/**", "src/util/strings.go", "./go.mod", "go.mod"},
+			want:     []string{"go.mod", "src/util/README.md", "src/util/deep/er/path.go", "src/util/strings.go"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Expand(tt.patterns)
+			if err != nil {
+				t.Fatalf("expand error: %v", err)
+			}
+			if got := slashed(files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExpandIsSortedWhateverThePatternOrder(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, "b/2.txt", "a/1.txt", "c.txt", "a/z/3.txt")
+
+	first, err := Expand([]string{"c.txt", "b", "a/**"})
+	if err != nil {
+		t.Fatalf("expand error: %v", err)
+	}
+	second, err := Expand([]string{"a/**", "c.txt", "b"})
+	if err != nil {
+		t.Fatalf("expand error: %v", err)
+	}
+
+	want := []string{"a/1.txt", "a/z/3.txt", "b/2.txt", "c.txt"}
+	if got := slashed(first); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the same files in the same order, got %v and %v", first, second)
+	}
+}
+
+func TestExpandFailsWhenAPatternMatchesNothing(t *testing.T) {
+	chdir(t, t.TempDir())
+	writeTree(t, "src/main.go")
+
+	for _, pattern := range []string{"missing.go", "src/*.c", "lib/**/*.go", "empty"} {
+		if pattern == "empty" {
+			if err := os.Mkdir("empty", 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := Expand([]string{"src/main.go", pattern})
+		if err == nil || !strings.Contains(err.Error(), "matched no files") {
+			t.Errorf("expected %q to match no files, got %v", pattern, err)
+		}
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**", "a/b/c", true},
+		{"**/c", "c", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/b/c", true},
+		{"a/**/c", "a/b/d", false},
+		{"*.go", "a/b.go", false},
+		{"a/*", "a", false},
+		{"[", "[", false},
+	}
+
+	for _, tt := range tests {
+		got := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.name, "/"))
+		if got != tt.want {
+			t.Errorf("matchSegments(%q, %q) = %v, expected %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
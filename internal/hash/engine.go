@@ -1,13 +1,19 @@
 package hash
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/taskvault/taskvault/internal/tracing"
 	"github.com/zeebo/blake3"
 )
 
@@ -46,73 +52,125 @@ func (e *Engine) HashData(data []byte) (string, error) {
 
 // HashFile computes hash of a file's contents
 func (e *Engine) HashFile(filePath string) (string, error) {
+	return e.HashFileContext(context.Background(), filePath)
+}
+
+// HashFileContext is HashFile, recorded as a span in ctx's trace
+func (e *Engine) HashFileContext(ctx context.Context, filePath string) (digest string, err error) {
+	_, span := tracing.Start(ctx, "hash.file", tracing.Path.String(filePath))
+	defer func() { tracing.End(span, err) }()
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("cannot open file %s: %w", filePath, err)
 	}
 	defer file.Close()
 
+	digest, err = e.HashReader(file)
+	if err != nil {
+		return "", fmt.Errorf("hash error for %s: %w", filePath, err)
+	}
+	return digest, nil
+}
+
+// HashReader computes hash of everything read from r, streaming
+func (e *Engine) HashReader(r io.Reader) (string, error) {
+	h, err := e.NewHash()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NewHash returns a streaming hash.Hash for the engine's algorithm, for
+// hashing data while it is copied elsewhere (e.g. via io.MultiWriter)
+func (e *Engine) NewHash() (hash.Hash, error) {
 	switch e.algorithm {
 	case Blake3:
-		h := blake3.New()
-		if _, err := io.Copy(h, file); err != nil {
-			return "", fmt.Errorf("hash error for %s: %w", filePath, err)
-		}
-		return hex.EncodeToString(h.Sum(nil)), nil
-
+		return blake3.New(), nil
 	case SHA256:
-		h := sha256.New()
-		if _, err := io.Copy(h, file); err != nil {
-			return "", fmt.Errorf("hash error for %s: %w", filePath, err)
-		}
-		return hex.EncodeToString(h.Sum(nil)), nil
-
+		return sha256.New(), nil
 	default:
-		return "", fmt.Errorf("unsupported algorithm: %s", e.algorithm)
+		return nil, fmt.Errorf("unsupported algorithm: %s", e.algorithm)
 	}
 }
 
 // HashDirectory computes a composite hash of a directory tree
 // Files are sorted for consistency across different file system orderings
 func (e *Engine) HashDirectory(dirPath string) (string, error) {
-	h := blake3.New()
+	var files []string
 
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+	err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("directory hash error: %w", err)
+	}
+
+	return e.HashManifest(dirPath, files)
+}
+
+// HashManifest computes a deterministic hash over a set of files.
+// Each file contributes its path relative to root, its permission bits and
+// its content hash; entries are sorted by path so the result does not depend
+// on the order files were discovered in.
+func (e *Engine) HashManifest(root string, files []string) (string, error) {
+	return e.HashManifestContext(context.Background(), root, files)
+}
+
+// HashManifestContext is HashManifest, recorded as a span in ctx's trace
+// with one child span per file hashed. It stops with ctx's error before
+// the next file once ctx is done.
+func (e *Engine) HashManifestContext(ctx context.Context, root string, files []string) (digest string, err error) {
+	ctx, span := tracing.Start(ctx, "hash.manifest", tracing.Files.Int(len(files)))
+	var total int64
+	defer func() {
+		span.SetAttributes(tracing.Size.Int64(total))
+		tracing.End(span, err)
+	}()
+
+	lines := make([]string, 0, len(files))
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 
-		// Include relative path in hash (affects structure changes)
-		relPath, err := filepath.Rel(dirPath, path)
+		info, err := os.Stat(file)
 		if err != nil {
-			return err
+			return "", fmt.Errorf("cannot stat %s: %w", file, err)
 		}
-
 		if info.IsDir() {
-			fmt.Fprintf(h, "dir:%s\n", relPath)
-		} else {
-			// Include file size and name in hash
-			fmt.Fprintf(h, "file:%s:%d\n", relPath, info.Size())
-
-			// Include file contents
-			file, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("cannot read file %s: %w", path, err)
-			}
-			defer file.Close()
-
-			if _, err := io.Copy(h, file); err != nil {
-				return fmt.Errorf("hash error for %s: %w", path, err)
-			}
+			continue
 		}
-		return nil
-	})
 
-	if err != nil {
-		return "", fmt.Errorf("directory hash error: %w", err)
+		relPath, err := filepath.Rel(root, file)
+		if err != nil {
+			return "", fmt.Errorf("cannot relativize %s: %w", file, err)
+		}
+
+		contentHash, err := e.HashFileContext(ctx, file)
+		if err != nil {
+			return "", err
+		}
+		total += info.Size()
+
+		lines = append(lines, fmt.Sprintf("file:%q:%o:%d:%s\n",
+			filepath.ToSlash(relPath), info.Mode().Perm(), info.Size(), contentHash))
 	}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+	sort.Strings(lines)
+	return e.HashData([]byte(strings.Join(lines, "")))
 }
 
 // hashBlake3 computes Blake3 hash (fastest for large files)
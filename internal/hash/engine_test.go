@@ -1,6 +1,8 @@
 package hash
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -54,3 +56,53 @@ func TestHashAlgorithmSwitching(t *testing.T) {
 		t.Errorf("unexpected hash length: %d", len(hashBlake3))
 	}
 }
+
+func TestHashManifest(t *testing.T) {
+	engine := NewEngine(Blake3)
+	dir := t.TempDir()
+
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "sub", "b.txt")
+	if err := os.MkdirAll(filepath.Dir(b), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(a, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Order of discovery must not matter
+	hash1, err := engine.HashManifest(dir, []string{a, b})
+	if err != nil {
+		t.Fatalf("hash error: %v", err)
+	}
+	hash2, err := engine.HashManifest(dir, []string{b, a})
+	if err != nil {
+		t.Fatalf("hash error: %v", err)
+	}
+	if hash1 != hash2 {
+		t.Errorf("expected order-independent hash, got %s != %s", hash1, hash2)
+	}
+
+	dirHash, err := engine.HashDirectory(dir)
+	if err != nil {
+		t.Fatalf("hash error: %v", err)
+	}
+	if dirHash != hash1 {
+		t.Errorf("expected directory hash to match manifest hash")
+	}
+
+	// Content changes must change the hash
+	if err := os.WriteFile(b, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash3, err := engine.HashManifest(dir, []string{a, b})
+	if err != nil {
+		t.Fatalf("hash error: %v", err)
+	}
+	if hash3 == hash1 {
+		t.Errorf("expected different hash after content change")
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+	ops := reg.NewCounter("ops_total", "Operations.", "op", "task")
+	latency := reg.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	reg.NewCollector("size_bytes", "Size.", Gauge, nil, func(emit Emit) error {
+		emit(10737418240)
+		return nil
+	})
+	reg.NewCounter("unused_total", "Never incremented.")
+
+	ops.Inc("get", "build")
+	ops.Add(2, "get", `say "hi"`)
+	latency.Observe(0.05, "get")
+	latency.Observe(0.5, "get")
+	latency.Observe(5, "get")
+
+	var buf bytes.Buffer
+	if err := reg.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP ops_total Operations.
+# TYPE ops_total counter
+ops_total{op="get",task="build"} 1
+ops_total{op="get",task="say \"hi\""} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.1"} 1
+latency_seconds_bucket{op="get",le="1"} 2
+latency_seconds_bucket{op="get",le="+Inf"} 3
+latency_seconds_sum{op="get"} 5.55
+latency_seconds_count{op="get"} 3
+# HELP size_bytes Size.
+# TYPE size_bytes gauge
+size_bytes 10737418240
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCollectorErrorKeepsOthers(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCollector("broken", "Fails.", Gauge, nil, func(emit Emit) error {
+		return errors.New("database is closed")
+	})
+	reg.NewCounter("ok_total", "Works.").Inc()
+
+	var buf bytes.Buffer
+	err := reg.WriteText(&buf)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the collector error, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "ok_total 1") {
+		t.Errorf("expected the other metrics, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,316 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+// Client talks to a TaskVault server started with `taskvault serve`
+type Client struct {
+	baseURL string
+	http    *http.Client
+	token   string          // sent as a bearer token if set
+	ctx     context.Context // requests are made under it; nil for none
+}
+
+var (
+	_ storage.ChunkStore     = (*Client)(nil)
+	_ storage.ContextBackend = (*Client)(nil)
+)
+
+// NewClient creates a client for the server at baseURL,
+// e.g. "http://cache.internal:9999"
+func NewClient(baseURL string) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Blobs can be large, so only waiting for the server to respond is
+	// bounded, not the transfer itself
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Transport: transport},
+	}
+}
+
+// SetToken sets the bearer token sent with every request, for a server
+// started with one
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// WithContext returns a client sharing c's connections whose requests are
+// made under ctx
+func (c *Client) WithContext(ctx context.Context) storage.Backend {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+// Open fetches an entry and a reader streaming its blob, which the caller
+// must close. Returns nil, nil, nil if the server does not have it.
+func (c *Client) Open(hash string) (*storage.Entry, io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, c.entryURL(hash))
+	if err != nil {
+		return nil, nil, fmt.Errorf("remote get failed: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil, nil
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := readEntry(resp.Body, resp.Header.Get(EntryLengthHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("remote get failed: %w", err)
+	}
+	return entry, resp.Body, nil
+}
+
+// Has reports whether the server holds an entry, without counting a hit
+func (c *Client) Has(hash string) (bool, error) {
+	resp, err := c.do(http.MethodHead, c.entryURL(hash))
+	if err != nil {
+		return false, fmt.Errorf("remote head failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetStream uploads an entry with its blob read from r; entry.Data is
+// ignored. A non-zero entry.Size, the blob's length, sets the content
+// length.
+func (c *Client) SetStream(entry *storage.Entry, r io.Reader) error {
+	meta, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	body := io.MultiReader(bytes.NewReader(meta), r)
+	req, err := c.newRequest(http.MethodPut, c.entryURL(entry.Hash), body)
+	if err != nil {
+		return fmt.Errorf("remote put failed: %w", err)
+	}
+	req.Header.Set(EntryLengthHeader, strconv.Itoa(len(meta)))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if entry.Size > 0 {
+		req.ContentLength = int64(len(meta)) + entry.Size
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote put failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// Delete removes an entry from the server; deleting a missing entry is
+// not an error
+func (c *Client) Delete(hash string) error {
+	req, err := c.newRequest(http.MethodDelete, c.entryURL(hash), nil)
+	if err != nil {
+		return fmt.Errorf("remote delete failed: %w", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote delete failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp, http.StatusNoContent)
+}
+
+// Stats returns the server's store statistics
+func (c *Client) Stats() (map[string]interface{}, error) {
+	resp, err := c.do(http.MethodGet, c.baseURL+statsPath)
+	if err != nil {
+		return nil, fmt.Errorf("remote stats failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("cannot decode remote stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Lookup fetches an entry's metadata, with its chunk list if the server
+// stores it chunked. Returns nil if the server does not have it.
+func (c *Client) Lookup(hash string) (*storage.Entry, error) {
+	resp, err := c.do(http.MethodGet, c.entryURL(hash)+chunkListSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("remote lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var entry storage.Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		return nil, fmt.Errorf("cannot decode remote entry: %w", err)
+	}
+	return &entry, nil
+}
+
+// SetChunks stores an entry whose blob is made of chunks already uploaded
+// with PutChunk
+func (c *Client) SetChunks(entry *storage.Entry) error {
+	meta := *entry
+	meta.Data = nil
+	body, err := json.Marshal(&meta)
+	if err != nil {
+		return fmt.Errorf("cannot marshal entry: %w", err)
+	}
+
+	req, err := c.newRequest(http.MethodPut, c.entryURL(entry.Hash)+chunkListSuffix, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("remote put failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote put failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The server lacks a chunk, e.g. one evicted since it was uploaded
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("remote put failed: %w", storage.ErrChunkMissing)
+	}
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// HasChunk reports whether the server holds a chunk
+func (c *Client) HasChunk(hash string) (bool, error) {
+	resp, err := c.do(http.MethodHead, c.chunkURL(hash))
+	if err != nil {
+		return false, fmt.Errorf("remote head failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// OpenChunk returns a reader streaming a chunk from the server
+func (c *Client) OpenChunk(hash string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, c.chunkURL(hash))
+	if err != nil {
+		return nil, fmt.Errorf("remote get failed: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", storage.ErrChunkMissing, hash)
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutChunk uploads a chunk read from r
+func (c *Client) PutChunk(hash string, r io.Reader) error {
+	req, err := c.newRequest(http.MethodPut, c.chunkURL(hash), r)
+	if err != nil {
+		return fmt.Errorf("remote put failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote put failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// Close releases idle connections to the server
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// newRequest builds a request under the client's context, with its token
+func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request without a body
+func (c *Client) do(method, url string) (*http.Response, error) {
+	req, err := c.newRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+func (c *Client) entryURL(hash string) string {
+	return c.baseURL + entriesPath + hash
+}
+
+func (c *Client) chunkURL(hash string) string {
+	return c.baseURL + chunksPath + hash
+}
+
+// checkStatus turns an unexpected response into an error carrying the
+// server's message, closing the body in that case
+func checkStatus(resp *http.Response, want int) error {
+	if resp.StatusCode == want {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("remote returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,371 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+// EntryLengthHeader gives the length of the entry's metadata (JSON,
+// without Data) that precedes its blob in GET and PUT bodies. Metadata can
+// hold a run's captured output, far more than a header may carry.
+const EntryLengthHeader = "X-Taskvault-Entry-Length"
+
+// maxEntryLength bounds the metadata read ahead of a blob
+const maxEntryLength = 16 << 20
+
+const entriesPath = "/v1/entries/"
+const chunksPath = "/v1/chunks/"
+const statsPath = "/v1/stats"
+
+// chunkListSuffix follows an entry hash to address its chunk list
+const chunkListSuffix = "/chunks"
+
+// validHash matches cache keys; anything else never reaches the blob
+// directory, where the key becomes a file name
+var validHash = regexp.MustCompile(`^[0-9a-f]{16,128}$`)
+
+// Server exposes a store over HTTP:
+//
+//	GET    /v1/entries/<hash>  entry JSON then blob, split at X-Taskvault-Entry-Length
+//	HEAD   /v1/entries/<hash>  entry existence
+//	PUT    /v1/entries/<hash>  store entry JSON then blob, split at X-Taskvault-Entry-Length
+//	DELETE /v1/entries/<hash>
+//	GET    /v1/entries/<hash>/chunks  entry as JSON, with its chunk list if chunked
+//	PUT    /v1/entries/<hash>/chunks  store entry (JSON body) from stored chunks
+//	HEAD   /v1/chunks/<hash>   chunk existence
+//	GET    /v1/chunks/<hash>   chunk contents
+//	PUT    /v1/chunks/<hash>   store body as chunk
+//	GET    /v1/stats           store statistics as JSON
+//
+// The chunk routes let clients transfer a large blob as only the chunks the
+// other side lacks. With a token set, every route requires it as a bearer
+// token in the Authorization header.
+type Server struct {
+	store *storage.Store
+	token string
+}
+
+// NewServer creates a handler serving store
+func NewServer(store *storage.Store) *Server {
+	return &Server{store: store}
+}
+
+// SetToken requires clients to present token; empty lets anyone in
+func (s *Server) SetToken(token string) {
+	s.token = token
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="taskvault"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == statsPath {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.stats(w)
+		return
+	}
+
+	if hash, ok := strings.CutPrefix(r.URL.Path, chunksPath); ok {
+		s.serveChunk(w, r, hash)
+		return
+	}
+
+	hash, ok := strings.CutPrefix(r.URL.Path, entriesPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	hash, chunkList := strings.CutSuffix(hash, chunkListSuffix)
+	if !validHash.MatchString(hash) {
+		http.Error(w, "invalid entry hash", http.StatusBadRequest)
+		return
+	}
+
+	if chunkList {
+		switch r.Method {
+		case http.MethodGet:
+			s.getChunkList(w, r, hash)
+		case http.MethodPut:
+			s.putChunkList(w, r, hash)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.get(w, r, hash)
+	case http.MethodPut:
+		s.put(w, r, hash)
+	case http.MethodDelete:
+		s.delete(w, hash)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized reports whether r carries the server's token, if it has one
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, hash string) {
+	// HEAD is an existence check, not a hit
+	open := s.store.Open
+	if r.Method == http.MethodHead {
+		open = s.store.Peek
+	}
+
+	entry, blob, err := open(hash)
+	if errors.Is(err, storage.ErrCorrupt) {
+		http.NotFound(w, r) // quarantined, so a miss from now on
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer blob.Close()
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	meta, err := encodeEntry(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(EntryLengthHeader, strconv.Itoa(len(meta)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// No Content-Length: a blob found corrupt at its very end must still
+	// fail the response, which a length already satisfied would not
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(meta), blob)); err != nil {
+		abortStream("entry", hash, err)
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, hash string) {
+	entry, err := readEntry(r.Body, r.Header.Get(EntryLengthHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.Hash = hash
+
+	blob, err := s.store.NewBlobWriter()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := io.Copy(blob, r.Body); err != nil {
+		blob.Abort()
+		http.Error(w, fmt.Sprintf("cannot read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.store.Commit(entry, blob); err != nil {
+		// The body cannot be read again to resupply missing chunks, but the
+		// upload is worth retrying
+		var missing *storage.MissingChunksError
+		if errors.As(err, &missing) {
+			blob.Abort()
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) delete(w http.ResponseWriter, hash string) {
+	if err := s.store.Delete(hash); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getChunkList(w http.ResponseWriter, r *http.Request, hash string) {
+	entry, err := s.store.Lookup(hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A client fetching the chunks directly never calls Open, so the hit
+	// is counted here; unchunked entries are fetched with GET afterwards
+	if len(entry.Chunks) > 0 {
+		if err := s.store.Touch(hash); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func (s *Server) putChunkList(w http.ResponseWriter, r *http.Request, hash string) {
+	var entry storage.Entry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("cannot decode entry: %v", err), http.StatusBadRequest)
+		return
+	}
+	entry.Hash = hash
+
+	err := s.store.SetChunks(&entry)
+	if errors.Is(err, storage.ErrChunkMissing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) serveChunk(w http.ResponseWriter, r *http.Request, hash string) {
+	if !validHash.MatchString(hash) {
+		http.Error(w, "invalid chunk hash", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		has, err := s.store.HasChunk(hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !has {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		chunk, err := s.store.OpenChunk(hash)
+		if errors.Is(err, storage.ErrChunkMissing) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer chunk.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := io.Copy(w, chunk); err != nil {
+			abortStream("chunk", hash, err)
+		}
+	case http.MethodPut:
+		if err := s.store.PutChunk(hash, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) stats(w http.ResponseWriter) {
+	stats, err := s.store.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// abortStream logs a body that failed partway, e.g. on a blob found
+// corrupt, and drops the connection so the client sees a failure rather
+// than a short body
+func abortStream(kind, hash string, err error) {
+	log.Printf("cannot send %s %s: %v", kind, hash, err)
+	panic(http.ErrAbortHandler)
+}
+
+// encodeEntry serializes entry metadata to precede its blob. The chunk
+// list is left out; it travels in the chunk list routes instead.
+func encodeEntry(entry *storage.Entry) ([]byte, error) {
+	meta := *entry
+	meta.Data = nil
+	meta.Chunks = nil
+
+	data, err := json.Marshal(&meta)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal entry: %w", err)
+	}
+	return data, nil
+}
+
+// readEntry reads the metadata preceding a blob in body, length bytes as
+// given by EntryLengthHeader, leaving body at the blob
+func readEntry(body io.Reader, length string) (*storage.Entry, error) {
+	if length == "" {
+		return nil, fmt.Errorf("missing %s header", EntryLengthHeader)
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 || n > maxEntryLength {
+		return nil, fmt.Errorf("invalid %s header %q", EntryLengthHeader, length)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("cannot read entry: %w", err)
+	}
+
+	var entry storage.Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal entry: %w", err)
+	}
+	return &entry, nil
+}
@@ -0,0 +1,281 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/storage"
+)
+
+func newTestServer(t *testing.T) (*Client, *storage.Store) {
+	t.Helper()
+
+	store, err := storage.NewStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	server := httptest.NewServer(NewServer(store))
+	t.Cleanup(server.Close)
+
+	return NewClient(server.URL + "/"), store
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	client, store := newTestServer(t)
+	hash := strings.Repeat("ab", 32)
+
+	now := time.Now()
+	entry := &storage.Entry{
+		Hash:       hash,
+		CreatedAt:  now,
+		AccessedAt: now,
+		Size:       int64(len("payload")),
+		KeySchema:  2,
+		Task:       "build",
+		Tags:       []string{"nightly"},
+		Metadata:   map[string]interface{}{"task": "build"},
+	}
+	if err := client.SetStream(entry, strings.NewReader("payload")); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+
+	if has, err := client.Has(hash); err != nil || !has {
+		t.Fatalf("expected entry on server, got %v (%v)", has, err)
+	}
+
+	got, body, err := client.Open(hash)
+	if err != nil || got == nil {
+		t.Fatalf("expected hit, got %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "payload" {
+		t.Errorf("unexpected blob %q", data)
+	}
+	if got.Task != "build" || got.KeySchema != 2 || len(got.Tags) != 1 || got.Metadata["task"] != "build" {
+		t.Errorf("entry not preserved: %+v", got)
+	}
+
+	stats, err := client.Stats()
+	if err != nil || stats["entries"] != float64(1) {
+		t.Errorf("unexpected stats %v (%v)", stats, err)
+	}
+
+	if err := client.Delete(hash); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if local, _ := store.Get(hash); local != nil {
+		t.Errorf("expected entry deleted from store")
+	}
+
+	got, _, err = client.Open(hash)
+	if err != nil || got != nil {
+		t.Errorf("expected miss after delete, got %+v (%v)", got, err)
+	}
+}
+
+func TestServerRejectsInvalidHash(t *testing.T) {
+	client, _ := newTestServer(t)
+
+	for _, hash := range []string{"..%2F..%2Fetc", "ABCDEF0123456789", "short"} {
+		resp, err := http.Get(client.baseURL + entriesPath + hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for %q, got %d", hash, resp.StatusCode)
+		}
+	}
+}
+
+func TestChunkedTransferSkipsKnownChunks(t *testing.T) {
+	local, err := storage.NewStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	defer local.Close()
+
+	serverStore, err := storage.NewStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	defer serverStore.Close()
+
+	var chunkPuts atomic.Int64
+	handler := NewServer(serverStore)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, chunksPath) {
+			chunkPuts.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	v1 := make([]byte, 20<<20)
+	rand.New(rand.NewSource(1)).Read(v1)
+	v2 := append(append(append([]byte{}, v1[:10<<20]...), "edit"...), v1[10<<20:]...)
+
+	push := func(hash string, data []byte) int64 {
+		t.Helper()
+		now := time.Now()
+		if err := local.SetStream(&storage.Entry{Hash: hash, CreatedAt: now, AccessedAt: now}, bytes.NewReader(data)); err != nil {
+			t.Fatalf("set error: %v", err)
+		}
+		entry, err := local.Lookup(hash)
+		if err != nil || len(entry.Chunks) == 0 {
+			t.Fatalf("expected chunked entry, got %+v (%v)", entry, err)
+		}
+
+		before := chunkPuts.Load()
+		if _, err := storage.CopyChunks(client, local, entry.Chunks); err != nil {
+			t.Fatalf("copy error: %v", err)
+		}
+		if err := client.SetChunks(entry); err != nil {
+			t.Fatalf("set chunks error: %v", err)
+		}
+		return chunkPuts.Load() - before
+	}
+
+	first := push(strings.Repeat("01", 32), v1)
+	second := push(strings.Repeat("02", 32), v2)
+	if first < 3 || second == 0 || second > 2 {
+		t.Errorf("expected the second push to send only changed chunks, sent %d then %d", first, second)
+	}
+
+	entry, body, err := client.Open(strings.Repeat("02", 32))
+	if err != nil || entry == nil {
+		t.Fatalf("expected hit, got %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(data, v2) {
+		t.Errorf("chunked blob did not round trip")
+	}
+
+	// Chunk lists referring to chunks the server lacks are refused
+	missing := &storage.Entry{Hash: strings.Repeat("03", 32), Chunks: []storage.ChunkRef{{Hash: strings.Repeat("ff", 32), Size: 1}}}
+	if err := client.SetChunks(missing); !errors.Is(err, storage.ErrChunkMissing) {
+		t.Errorf("expected ErrChunkMissing, got %v", err)
+	}
+}
+
+func TestServerRequiresToken(t *testing.T) {
+	store, err := storage.NewStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	defer store.Close()
+
+	handler := NewServer(store)
+	handler.SetToken("secret")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	hash := strings.Repeat("ab", 32)
+	now := time.Now()
+	entry := &storage.Entry{Hash: hash, CreatedAt: now, AccessedAt: now}
+
+	for _, token := range []string{"", "wrong"} {
+		client := NewClient(server.URL)
+		client.SetToken(token)
+		if err := client.SetStream(entry, strings.NewReader("poison")); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("expected a put with token %q to be rejected, got %v", token, err)
+		}
+		if err := client.Delete(hash); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("expected a delete with token %q to be rejected, got %v", token, err)
+		}
+	}
+	if stats, _ := store.Stats(); stats["entries"] != int64(0) {
+		t.Fatalf("expected nothing stored, got %v", stats["entries"])
+	}
+
+	client := NewClient(server.URL)
+	client.SetToken("secret")
+	if err := client.SetStream(entry, strings.NewReader("payload")); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	if has, err := client.Has(hash); err != nil || !has {
+		t.Errorf("expected entry on server, got %v (%v)", has, err)
+	}
+}
+
+func TestLargeMetadataRoundTrip(t *testing.T) {
+	client, _ := newTestServer(t)
+	hash := strings.Repeat("cd", 32)
+
+	// e.g. a run's captured stdout and stderr, over any header limit
+	output := strings.Repeat("log line\n", 250000)
+	now := time.Now()
+	entry := &storage.Entry{
+		Hash:       hash,
+		CreatedAt:  now,
+		AccessedAt: now,
+		Size:       int64(len("payload")),
+		Metadata:   map[string]interface{}{"stdout": output, "stderr": output},
+	}
+	if err := client.SetStream(entry, strings.NewReader("payload")); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+
+	got, body, err := client.Open(hash)
+	if err != nil || got == nil {
+		t.Fatalf("expected hit, got %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "payload" || got.Metadata["stdout"] != output || got.Metadata["stderr"] != output {
+		t.Errorf("entry with large metadata did not round trip")
+	}
+}
+
+func TestCorruptBlobAbortsResponse(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(dir, 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	defer store.Close()
+	store.SetCompression(storage.Compression{Codec: storage.CodecNone})
+
+	server := httptest.NewServer(NewServer(store))
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	hash := strings.Repeat("ef", 32)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	now := time.Now()
+	if err := store.SetStream(&storage.Entry{Hash: hash, CreatedAt: now, AccessedAt: now}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+
+	// Same size, so only hashing the streamed blob catches it
+	entry, _ := store.Lookup(hash)
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(filepath.Join(dir, "blobs", entry.BlobHash), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, body, err := client.Open(hash)
+	if err != nil || got == nil {
+		t.Fatalf("expected the response to start, got %v", err)
+	}
+	defer body.Close()
+	if _, err := io.ReadAll(body); err == nil {
+		t.Errorf("expected reading a corrupt blob to fail, not end short")
+	}
+}
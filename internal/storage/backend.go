@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// Backend is a place cache entries can be stored and fetched by hash. Store
+// (SQLite index plus blob directory) is the local backend; the remote tier
+// can be a TaskVault server or an S3-compatible object store.
+type Backend interface {
+	// SetStream stores entry with its blob read from r. entry.Data is
+	// ignored; entry.Size is set to the number of bytes stored.
+	SetStream(entry *Entry, r io.Reader) error
+	// Open returns an entry and a reader over its blob, which the caller
+	// must close. Returns nil, nil, nil on a miss.
+	Open(hash string) (*Entry, io.ReadCloser, error)
+	// Delete removes an entry; deleting a missing entry is not an error
+	Delete(hash string) error
+	// Stats returns backend statistics
+	Stats() (map[string]interface{}, error)
+	// Close releases the backend's resources
+	Close() error
+}
+
+var _ Backend = (*Store)(nil)
+
+// ContextBackend is a Backend that makes its requests under a context, so
+// ending the context abandons a transfer in progress
+type ContextBackend interface {
+	Backend
+	// WithContext returns the backend making its requests under ctx
+	WithContext(ctx context.Context) Backend
+}
+
+// WithContext returns b making its requests under ctx, or b itself if it
+// does not take a context
+func WithContext(ctx context.Context, b Backend) Backend {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb.WithContext(ctx)
+	}
+	return b
+}
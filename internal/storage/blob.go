@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/taskvault/taskvault/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BlobWriter streams blob contents to a temporary file in the blob
+// directory, hashing them as they are written. Nothing is visible to
+// readers until Store.Commit renames it into place under its content hash,
+// so a reader never observes a partially written blob.
+//
+// Contents are compressed on the way to disk. The codec is chosen once the
+// first bytes are known, so already compressed formats are stored raw.
+//
+// Blobs larger than chunkThreshold are instead split into content-defined
+// chunks, each stored and compressed on its own, so a large output that
+// differs slightly from a stored one only adds the chunks that changed.
+type BlobWriter struct {
+	store  *Store
+	file   *os.File
+	hasher hash.Hash
+	size   int64
+	buf    []byte // raw contents until the blob is known to be small or large
+
+	compression Compression
+	head        []byte         // buffered until the codec is chosen
+	codec       string         // empty until chosen
+	encoder     io.WriteCloser // compresses into stored
+	stored      *countingWriter
+
+	chunker *chunker // set once the blob is chunked
+	chunks  []ChunkRef
+	pending map[string]*pendingChunk
+	missing map[string]bool // chunks a failed Commit asked for again
+}
+
+// NewBlobWriter starts a new blob compressed with the store's default
+// compression; finish it with Commit or Abort
+func (s *Store) NewBlobWriter() (*BlobWriter, error) {
+	return s.NewCompressedBlobWriter(s.compression)
+}
+
+// NewCompressedBlobWriter starts a new blob compressed with c
+func (s *Store) NewCompressedBlobWriter(c Compression) (*BlobWriter, error) {
+	file, err := os.CreateTemp(s.blobDir, ".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create blob: %w", err)
+	}
+	return &BlobWriter{
+		store:       s,
+		file:        file,
+		hasher:      sha256.New(),
+		compression: c,
+		stored:      &countingWriter{w: file},
+	}, nil
+}
+
+// Write appends p to the blob
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	w.hasher.Write(p)
+	w.size += int64(len(p))
+
+	if w.chunker != nil {
+		return w.chunker.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > chunkThreshold {
+		if err := w.startChunking(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// startChunking switches to chunked storage, dropping the blob file
+func (w *BlobWriter) startChunking() error {
+	w.file.Close()
+	os.Remove(w.file.Name())
+
+	w.pending = make(map[string]*pendingChunk)
+	w.chunker = &chunker{emit: w.addChunk}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.chunker.Write(buf)
+	return err
+}
+
+// addChunk records a chunk, writing it out unless this blob or the store
+// already has it. A stored chunk may still be evicted or quarantined before
+// Commit, which then asks for it again (see Resupply).
+func (w *BlobWriter) addChunk(data []byte) error {
+	sum := sha256.Sum256(data)
+	chunkHash := hex.EncodeToString(sum[:])
+	w.chunks = append(w.chunks, ChunkRef{Hash: chunkHash, Size: int64(len(data))})
+
+	if _, ok := w.pending[chunkHash]; ok {
+		return nil
+	}
+	has, err := w.store.HasChunk(chunkHash)
+	if err != nil {
+		return err
+	}
+	if has {
+		w.pending[chunkHash] = &pendingChunk{size: int64(len(data))}
+		return nil
+	}
+
+	pending, err := w.store.writeChunk(data, w.compression)
+	if err != nil {
+		return err
+	}
+	w.pending[chunkHash] = pending
+	return nil
+}
+
+// Resupply writes out the chunks a failed Commit reported missing, reading
+// the blob's contents again from r, so the writer can be committed again.
+// The other chunks are only hashed.
+func (w *BlobWriter) Resupply(r io.Reader) error {
+	c := &chunker{emit: func(data []byte) error {
+		sum := sha256.Sum256(data)
+		chunkHash := hex.EncodeToString(sum[:])
+		if !w.missing[chunkHash] {
+			return nil
+		}
+
+		pending, err := w.store.writeChunk(data, w.compression)
+		if err != nil {
+			return err
+		}
+		w.pending[chunkHash] = pending
+		delete(w.missing, chunkHash)
+		return nil
+	}}
+
+	if _, err := io.Copy(c, r); err != nil {
+		return fmt.Errorf("cannot read blob: %w", err)
+	}
+	return c.Close()
+}
+
+// writeFile passes raw contents on towards the blob file
+func (w *BlobWriter) writeFile(p []byte) error {
+	if w.codec == "" {
+		w.head = append(w.head, p...)
+		if len(w.head) < sniffSize {
+			return nil
+		}
+		return w.startEncoder(false)
+	}
+
+	if _, err := w.encoder.Write(p); err != nil {
+		return fmt.Errorf("cannot write blob: %w", err)
+	}
+	return nil
+}
+
+// startEncoder chooses the codec from the buffered head and flushes it
+func (w *BlobWriter) startEncoder(complete bool) error {
+	w.codec = chooseCodec(w.compression.Codec, w.head, complete)
+
+	encoder, err := newEncoder(w.stored, w.compression, w.codec)
+	if err != nil {
+		return fmt.Errorf("cannot create blob encoder: %w", err)
+	}
+	w.encoder = encoder
+
+	if _, err := w.encoder.Write(w.head); err != nil {
+		return fmt.Errorf("cannot write blob: %w", err)
+	}
+	w.head = nil
+	return nil
+}
+
+// Size returns the number of bytes written so far, before compression
+func (w *BlobWriter) Size() int64 {
+	return w.size
+}
+
+// Hash returns the hex SHA-256 of the bytes written so far, the key the
+// blob is stored under
+func (w *BlobWriter) Hash() string {
+	return hex.EncodeToString(w.hasher.Sum(nil))
+}
+
+// Abort discards the blob
+func (w *BlobWriter) Abort() {
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.removePending()
+}
+
+// removePending removes chunk files that were not moved into place
+func (w *BlobWriter) removePending() {
+	for _, pending := range w.pending {
+		if pending.tmp != "" {
+			os.Remove(pending.tmp)
+		}
+	}
+}
+
+// close finishes writing the temporary file and makes it readable, ready to
+// be renamed into place, or writes out the last chunks of a chunked blob;
+// everything is removed on failure
+func (w *BlobWriter) close() error {
+	if w.chunker != nil {
+		if err := w.chunker.Close(); err != nil {
+			w.Abort()
+			return err
+		}
+		return nil
+	}
+
+	if err := w.writeFile(w.buf); err != nil {
+		w.Abort()
+		return err
+	}
+	w.buf = nil
+
+	if w.codec == "" {
+		if err := w.startEncoder(true); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.encoder.Close(); err != nil {
+		w.Abort()
+		return fmt.Errorf("cannot write blob: %w", err)
+	}
+
+	// Flushed to disk before the rename makes it visible under its hash,
+	// so a crash cannot leave a torn blob behind a committed row
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		return fmt.Errorf("cannot sync blob: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("cannot write blob: %w", err)
+	}
+	if err := os.Chmod(w.file.Name(), 0644); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("cannot write blob: %w", err)
+	}
+	return nil
+}
+
+// blobPath returns where the blob with the given content hash is stored
+func (s *Store) blobPath(blobHash string) string {
+	return filepath.Join(s.blobDir, blobHash)
+}
+
+// ContextReader returns a reader over r whose reads fail with ctx's error
+// once ctx is done, for copies that should stop when a caller gives up
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// readContext is ContextReader for a blob, keeping its Close
+func readContext(ctx context.Context, blob io.ReadCloser) io.ReadCloser {
+	if ctx.Done() == nil {
+		return blob
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{ContextReader(ctx, blob), blob}
+}
+
+// tracedBlob records reading a blob as a span ending on Close
+type tracedBlob struct {
+	io.ReadCloser
+	span trace.Span
+	read int64
+	err  error
+}
+
+// traceRead wraps blob in a span in ctx's trace when it is being recorded
+func traceRead(ctx context.Context, blob io.ReadCloser, entry *Entry) io.ReadCloser {
+	_, span := tracing.Start(ctx, "storage.blob_read", tracing.Key.String(entry.Hash), tracing.Codec.String(entry.Codec))
+	if !span.IsRecording() {
+		span.End()
+		return blob
+	}
+	return &tracedBlob{ReadCloser: blob, span: span}
+}
+
+func (b *tracedBlob) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *tracedBlob) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.SetAttributes(tracing.Size.Int64(b.read))
+	tracing.End(b.span, b.err)
+	return err
+}
@@ -0,0 +1,109 @@
+package storage
+
+// Content-defined chunking in the style of FastCDC: a rolling gear hash
+// picks chunk boundaries from the data itself, so inserting or changing
+// bytes only changes the chunks around the edit and every other chunk of a
+// large, slightly different output is shared with the previous version.
+
+const (
+	cdcMinSize = 256 << 10 // no boundary before this many bytes
+	cdcAvgSize = 1 << 20   // target chunk size
+	cdcMaxSize = 4 << 20   // forced boundary
+
+	// chunkThreshold is the size from which blobs are stored as chunk
+	// lists; smaller blobs stay single files
+	chunkThreshold = 2 * cdcMaxSize
+)
+
+// Normalized chunking: a stricter mask before the average size and a
+// looser one after it keep chunk sizes close to cdcAvgSize. The masks test
+// the high bits of the gear hash, which depend on the most input bytes.
+const (
+	cdcMaskStrict = ((1 << 22) - 1) << (64 - 22)
+	cdcMaskLoose  = ((1 << 18) - 1) << (64 - 18)
+)
+
+// gearTable maps each byte to a pseudo-random 64-bit value. It is derived
+// from a fixed seed and must never change: chunk boundaries, and therefore
+// sharing with already stored chunks, depend on it.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x7461736b7661756c) // "taskvaul"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cutPoint returns the length of the first chunk of data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= cdcMinSize {
+		return n
+	}
+	if n > cdcMaxSize {
+		n = cdcMaxSize
+	}
+	normal := cdcAvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := cdcMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&cdcMaskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&cdcMaskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into content-defined chunks, calling emit for
+// each. The slice passed to emit is only valid during the call.
+type chunker struct {
+	buf  []byte
+	emit func(chunk []byte) error
+}
+
+// Write buffers p and emits every chunk whose boundary is now certain
+func (c *chunker) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+
+	// With cdcMaxSize bytes buffered the first cut can no longer move
+	start := 0
+	for len(c.buf)-start >= cdcMaxSize {
+		n := cutPoint(c.buf[start:])
+		if err := c.emit(c.buf[start : start+n]); err != nil {
+			return 0, err
+		}
+		start += n
+	}
+	c.buf = append(c.buf[:0], c.buf[start:]...)
+
+	return len(p), nil
+}
+
+// Close emits the remaining buffered chunks
+func (c *chunker) Close() error {
+	for len(c.buf) > 0 {
+		n := cutPoint(c.buf)
+		if err := c.emit(c.buf[:n]); err != nil {
+			return err
+		}
+		c.buf = c.buf[n:]
+	}
+	return nil
+}
@@ -0,0 +1,624 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CodecChunked marks a blob stored as a list of chunks, each compressed on
+// its own, rather than as a single file
+const CodecChunked = "chunked"
+
+// ErrChunkMissing is returned when a chunk list refers to a chunk the
+// store does not have
+var ErrChunkMissing = errors.New("chunk missing")
+
+// MissingChunksError is returned when chunks a blob refers to are not
+// stored, e.g. evicted while the blob was written. It matches
+// ErrChunkMissing.
+type MissingChunksError struct {
+	Hashes []string
+}
+
+func (e *MissingChunksError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrChunkMissing, strings.Join(e.Hashes, ", "))
+}
+
+// Is reports whether target is ErrChunkMissing
+func (e *MissingChunksError) Is(target error) bool {
+	return target == ErrChunkMissing
+}
+
+// ChunkRef is one content-defined chunk of a chunked blob
+type ChunkRef struct {
+	Hash string `json:"hash"` // hex SHA-256 of the chunk's contents
+	Size int64  `json:"size"`
+}
+
+// ChunkStore is implemented by backends that can store large blobs as
+// chunk lists. Transfers between two chunk stores only move the chunks the
+// receiving side does not have yet (see CopyChunks).
+type ChunkStore interface {
+	Backend
+	// Lookup returns an entry without opening its blob, with Chunks set
+	// if the blob is chunked. Returns nil on a miss.
+	Lookup(hash string) (*Entry, error)
+	// HasChunk reports whether a chunk is stored
+	HasChunk(hash string) (bool, error)
+	// OpenChunk returns a reader over a chunk's contents
+	OpenChunk(hash string) (io.ReadCloser, error)
+	// PutChunk stores a chunk read from r, verifying it against hash
+	PutChunk(hash string, r io.Reader) error
+	// SetChunks stores entry with the blob made of entry.Chunks, all of
+	// which must already be stored
+	SetChunks(entry *Entry) error
+}
+
+var _ ChunkStore = (*Store)(nil)
+
+// CopyChunks copies the chunks of a chunk list that dst lacks from src,
+// returning how many were moved
+func CopyChunks(dst, src ChunkStore, chunks []ChunkRef) (int, error) {
+	moved := 0
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+
+		has, err := dst.HasChunk(chunk.Hash)
+		if err != nil {
+			return moved, err
+		}
+		if has {
+			continue
+		}
+
+		r, err := src.OpenChunk(chunk.Hash)
+		if err != nil {
+			return moved, err
+		}
+		err = dst.PutChunk(chunk.Hash, r)
+		r.Close()
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// chunkPath returns where a chunk is stored
+func (s *Store) chunkPath(chunkHash string) string {
+	return filepath.Join(s.chunkDir, chunkHash)
+}
+
+// pendingChunk is a chunk written by a BlobWriter but not yet committed
+type pendingChunk struct {
+	tmp        string // temporary file, empty if already stored or once moved into place
+	size       int64
+	storedSize int64
+	codec      string
+}
+
+// writeChunk compresses a chunk into a temporary file in the chunk
+// directory. Chunks that do not shrink are stored raw.
+func (s *Store) writeChunk(data []byte, c Compression) (*pendingChunk, error) {
+	codec := chooseCodec(c.Codec, data, true)
+	encoded := data
+
+	if codec != CodecNone {
+		var buf bytes.Buffer
+		encoder, err := newEncoder(&buf, c, codec)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create chunk encoder: %w", err)
+		}
+		encoder.Write(data)
+		if err := encoder.Close(); err != nil {
+			return nil, fmt.Errorf("cannot compress chunk: %w", err)
+		}
+		if buf.Len() < len(data) {
+			encoded = buf.Bytes()
+		} else {
+			codec = CodecNone
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.chunkDir, ".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create chunk: %w", err)
+	}
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("cannot write chunk: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("cannot sync chunk: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("cannot write chunk: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("cannot write chunk: %w", err)
+	}
+
+	return &pendingChunk{
+		tmp:        tmp.Name(),
+		size:       int64(len(data)),
+		storedSize: int64(len(encoded)),
+		codec:      codec,
+	}, nil
+}
+
+// HasChunk reports whether a chunk is stored
+func (s *Store) HasChunk(hash string) (bool, error) {
+	var refcount int64
+	err := s.db.QueryRow(`SELECT refcount FROM chunks WHERE hash = ?`, hash).Scan(&refcount)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+
+	if _, err := os.Stat(s.chunkPath(hash)); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// OpenChunk returns a reader over a chunk's decompressed contents
+func (s *Store) OpenChunk(hash string) (io.ReadCloser, error) {
+	var codec string
+	err := s.db.QueryRow(`SELECT codec FROM chunks WHERE hash = ?`, hash).Scan(&codec)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrChunkMissing, hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	file, err := os.Open(s.chunkPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrChunkMissing, hash)
+	}
+	return newDecoder(file, codec)
+}
+
+// PutChunk stores a chunk read from r, compressed with the store's default
+// compression. The contents must hash to hash. The chunk is unreferenced
+// until an entry is stored with SetChunks.
+func (s *Store) PutChunk(hash string, r io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, cdcMaxSize+1))
+	if err != nil {
+		return fmt.Errorf("cannot read chunk: %w", err)
+	}
+	if len(data) > cdcMaxSize {
+		return fmt.Errorf("chunk %s exceeds %d bytes", hash, cdcMaxSize)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("chunk contents do not match hash %s", hash)
+	}
+
+	pending, err := s.writeChunk(data, s.compression)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pending.tmp) // no-op once renamed
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Keep a chunk that is already stored as it is
+	var refcount int64
+	err = tx.QueryRow(`SELECT refcount FROM chunks WHERE hash = ?`, hash).Scan(&refcount)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if err == nil {
+		if _, statErr := os.Stat(s.chunkPath(hash)); statErr == nil {
+			return nil
+		}
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO chunks (hash, size, stored_size, codec, refcount) VALUES (?, ?, ?, ?, 0)
+	ON CONFLICT(hash) DO UPDATE SET stored_size = excluded.stored_size, codec = excluded.codec
+	`, hash, pending.size, pending.storedSize, pending.codec)
+	if err != nil {
+		return fmt.Errorf("cannot record chunk: %w", err)
+	}
+	if err := os.Rename(pending.tmp, s.chunkPath(hash)); err != nil {
+		return fmt.Errorf("cannot write chunk: %w", err)
+	}
+	if err := syncDir(s.chunkDir); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot record chunk: %w", err)
+	}
+	return nil
+}
+
+// SetChunks stores entry with the blob assembled from entry.Chunks, which
+// must all be stored already (see PutChunk). The blob hash and size are
+// recomputed from the chunks.
+func (s *Store) SetChunks(entry *Entry) error {
+	if len(entry.Chunks) == 0 {
+		return fmt.Errorf("entry %s has no chunks", entry.Hash)
+	}
+
+	hasher := sha256.New()
+	var size int64
+	for _, chunk := range entry.Chunks {
+		r, err := s.OpenChunk(chunk.Hash)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(hasher, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read chunk %s: %w", chunk.Hash, err)
+		}
+		size += n
+	}
+	entry.BlobHash = hex.EncodeToString(hasher.Sum(nil))
+	entry.Size = size
+
+	metadataJSON, tagsJSON, err := marshalEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.refChunkedBlob(tx, entry, nil); err != nil {
+		return err
+	}
+	return s.saveEntry(tx, entry, metadataJSON, tagsJSON)
+}
+
+// Lookup returns an entry without opening its blob or counting a hit, with
+// Chunks set if the blob is chunked. Returns nil on a miss.
+func (s *Store) Lookup(hash string) (*Entry, error) {
+	entry, blob, err := s.Peek(hash)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	blob.Close()
+	return entry, nil
+}
+
+// refChunkedBlob takes a reference on entry's chunked blob, creating it
+// from entry.Chunks if it does not exist. Chunk files written by a
+// BlobWriter are moved into place from pending. Sets entry.Codec and
+// entry.StoredSize.
+func (s *Store) refChunkedBlob(tx *storeTx, entry *Entry, pending map[string]*pendingChunk) error {
+	entry.Codec = CodecChunked
+
+	var refcount int64
+	err := tx.QueryRow(`SELECT refcount FROM blobs WHERE hash = ?`, entry.BlobHash).Scan(&refcount)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	stored := err == nil
+
+	// Checked under the write lock, so nothing can evict them before the
+	// references below are taken
+	missing, err := s.missingChunks(tx, entry, pending, stored)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return &MissingChunksError{Hashes: missing}
+	}
+
+	if !stored {
+		for seq, chunk := range entry.Chunks {
+			if err := s.refChunk(tx, chunk, pending[chunk.Hash]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO blob_chunks (blob_hash, seq, chunk_hash) VALUES (?, ?, ?)`,
+				entry.BlobHash, seq, chunk.Hash)
+			if err != nil {
+				return fmt.Errorf("cannot record chunk list: %w", err)
+			}
+		}
+
+		// Chunked blobs have no file of their own; their bytes on disk are
+		// accounted to the chunks
+		_, err := tx.Exec(`INSERT INTO blobs (hash, size, codec, refcount) VALUES (?, 0, ?, 1)`,
+			entry.BlobHash, CodecChunked)
+		if err != nil {
+			return fmt.Errorf("cannot reference blob: %w", err)
+		}
+	} else {
+		for _, chunk := range entry.Chunks {
+			if err := s.restoreChunk(tx, chunk, pending[chunk.Hash]); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`UPDATE blobs SET refcount = refcount + 1 WHERE hash = ?`, entry.BlobHash)
+		if err != nil {
+			return fmt.Errorf("cannot reference blob: %w", err)
+		}
+	}
+
+	err = tx.QueryRow(`
+	SELECT COALESCE(SUM(stored_size), 0) FROM chunks
+	WHERE hash IN (SELECT chunk_hash FROM blob_chunks WHERE blob_hash = ?)
+	`, entry.BlobHash).Scan(&entry.StoredSize)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// missingChunks lists the chunks of entry that are not stored and that
+// pending cannot fill. A stored blob only needs its chunk files back; its
+// chunk rows stand.
+func (s *Store) missingChunks(tx *storeTx, entry *Entry, pending map[string]*pendingChunk, stored bool) ([]string, error) {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, chunk := range entry.Chunks {
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+
+		if p := pending[chunk.Hash]; p != nil && p.tmp != "" {
+			continue
+		}
+		if _, err := os.Stat(s.chunkPath(chunk.Hash)); err == nil {
+			if stored {
+				continue
+			}
+			var refcount int64
+			err := tx.QueryRow(`SELECT refcount FROM chunks WHERE hash = ?`, chunk.Hash).Scan(&refcount)
+			if err == nil {
+				continue
+			}
+			if err != sql.ErrNoRows {
+				return nil, fmt.Errorf("database error: %w", err)
+			}
+		}
+		missing = append(missing, chunk.Hash)
+	}
+	return missing, nil
+}
+
+// refChunk takes a reference on a chunk, moving its pending file into
+// place if the store does not have it yet
+func (s *Store) refChunk(tx *storeTx, chunk ChunkRef, pending *pendingChunk) error {
+	path := s.chunkPath(chunk.Hash)
+
+	var refcount int64
+	err := tx.QueryRow(`SELECT refcount FROM chunks WHERE hash = ?`, chunk.Hash).Scan(&refcount)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+	_, statErr := os.Stat(path)
+
+	if err == nil && statErr == nil {
+		_, err := tx.Exec(`UPDATE chunks SET refcount = refcount + 1 WHERE hash = ?`, chunk.Hash)
+		if err != nil {
+			return fmt.Errorf("cannot reference chunk: %w", err)
+		}
+		return nil
+	}
+
+	// Not stored (or its file is gone): only a chunk written by this save
+	// can fill the gap
+	if pending == nil || pending.tmp == "" {
+		return fmt.Errorf("%w: %s", ErrChunkMissing, chunk.Hash)
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO chunks (hash, size, stored_size, codec, refcount) VALUES (?, ?, ?, ?, 1)
+	ON CONFLICT(hash) DO UPDATE SET refcount = refcount + 1, stored_size = excluded.stored_size, codec = excluded.codec
+	`, chunk.Hash, pending.size, pending.storedSize, pending.codec)
+	if err != nil {
+		return fmt.Errorf("cannot reference chunk: %w", err)
+	}
+	if err := os.Rename(pending.tmp, path); err != nil {
+		return fmt.Errorf("cannot write chunk: %w", err)
+	}
+	pending.tmp = ""
+	return nil
+}
+
+// restoreChunk puts back the file of a chunk a stored blob uses, if it is
+// gone, from the chunk this save wrote. The blob's references on it stand.
+func (s *Store) restoreChunk(tx *storeTx, chunk ChunkRef, pending *pendingChunk) error {
+	path := s.chunkPath(chunk.Hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if pending == nil || pending.tmp == "" {
+		return fmt.Errorf("%w: %s", ErrChunkMissing, chunk.Hash)
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO chunks (hash, size, stored_size, codec, refcount)
+	VALUES (?, ?, ?, ?, (SELECT COUNT(*) FROM blob_chunks WHERE chunk_hash = ?))
+	ON CONFLICT(hash) DO UPDATE SET stored_size = excluded.stored_size, codec = excluded.codec
+	`, chunk.Hash, pending.size, pending.storedSize, pending.codec, chunk.Hash)
+	if err != nil {
+		return fmt.Errorf("cannot reference chunk: %w", err)
+	}
+	if err := os.Rename(pending.tmp, path); err != nil {
+		return fmt.Errorf("cannot write chunk: %w", err)
+	}
+	pending.tmp = ""
+	return nil
+}
+
+// releaseChunks drops a chunked blob's references on its chunks, removing
+// chunks no other blob uses. Returns the bytes freed.
+func (s *Store) releaseChunks(tx *storeTx, blobHash string) (int64, error) {
+	rows, err := tx.Query(`SELECT chunk_hash FROM blob_chunks WHERE blob_hash = ?`, blobHash)
+	if err != nil {
+		return 0, fmt.Errorf("cannot query chunks: %w", err)
+	}
+	var chunks []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("cannot scan chunk: %w", err)
+		}
+		chunks = append(chunks, hash)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM blob_chunks WHERE blob_hash = ?`, blobHash); err != nil {
+		return 0, fmt.Errorf("cannot release chunks: %w", err)
+	}
+
+	var freed int64
+	for _, hash := range chunks {
+		if _, err := tx.Exec(`UPDATE chunks SET refcount = refcount - 1 WHERE hash = ?`, hash); err != nil {
+			return freed, fmt.Errorf("cannot release chunk: %w", err)
+		}
+
+		var refcount, storedSize int64
+		err := tx.QueryRow(`SELECT refcount, stored_size FROM chunks WHERE hash = ?`, hash).Scan(&refcount, &storedSize)
+		if err == sql.ErrNoRows || (err == nil && refcount > 0) {
+			continue
+		}
+		if err != nil {
+			return freed, fmt.Errorf("database error: %w", err)
+		}
+
+		if _, err := tx.Exec(`DELETE FROM chunks WHERE hash = ?`, hash); err != nil {
+			return freed, fmt.Errorf("cannot release chunk: %w", err)
+		}
+		tx.release(s.chunkPath(hash))
+		freed += storedSize
+	}
+	return freed, nil
+}
+
+// storedChunk is a chunk of a locally stored chunked blob
+type storedChunk struct {
+	ChunkRef
+	codec      string
+	storedSize int64
+}
+
+// loadChunks returns a chunked blob's chunks in order. ok is false if the
+// blob has no chunk list.
+func (s *Store) loadChunks(blobHash string) (chunks []storedChunk, ok bool, err error) {
+	rows, err := s.db.Query(`
+	SELECT c.hash, c.size, c.codec, c.stored_size FROM blob_chunks bc JOIN chunks c ON c.hash = bc.chunk_hash
+	WHERE bc.blob_hash = ? ORDER BY bc.seq
+	`, blobHash)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chunk storedChunk
+		if err := rows.Scan(&chunk.Hash, &chunk.Size, &chunk.codec, &chunk.storedSize); err != nil {
+			return nil, false, fmt.Errorf("cannot scan chunk: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("cannot query chunks: %w", err)
+	}
+	return chunks, len(chunks) > 0, nil
+}
+
+// openChunks returns a reader over a chunked blob stored locally. Unless
+// verify is VerifySkip, each chunk is checked against its hash as it is
+// read and quarantined if it does not match.
+func (s *Store) openChunks(chunks []storedChunk, verify string) io.ReadCloser {
+	refs := make([]ChunkRef, len(chunks))
+	for i, chunk := range chunks {
+		refs[i] = chunk.ChunkRef
+	}
+
+	return &chunkReader{chunks: refs, open: func(i int) (io.ReadCloser, error) {
+		chunk := chunks[i]
+		file, err := os.Open(s.chunkPath(chunk.Hash))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrChunkMissing, chunk.Hash)
+		}
+		r, err := newDecoder(file, chunk.codec)
+		if err != nil || verify == VerifySkip {
+			return r, err
+		}
+		return newVerifyReader(r, chunk.Hash, chunk.Size, func() error {
+			_, err := s.quarantineChunk(chunk.Hash)
+			return err
+		}), nil
+	}}
+}
+
+// chunkReader streams a chunked blob by opening its chunks in turn
+type chunkReader struct {
+	chunks []ChunkRef
+	open   func(i int) (io.ReadCloser, error)
+	next   int
+	cur    io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next == len(r.chunks) {
+				return 0, io.EOF
+			}
+			cur, err := r.open(r.next)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = cur
+			r.next++
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
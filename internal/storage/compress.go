@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Blob codecs, recorded per blob and entry
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// Compression selects how new blobs are encoded on disk
+type Compression struct {
+	Codec string // CodecNone, CodecGzip or CodecZstd
+	Level int    // codec-specific level; 0 means the codec's default
+}
+
+// CompressionByName validates a policy's codec and level; an empty codec
+// means zstd
+func CompressionByName(codec string, level int) (Compression, error) {
+	switch codec {
+	case "":
+		codec = CodecZstd
+	case CodecNone, CodecGzip, CodecZstd:
+	default:
+		return Compression{}, fmt.Errorf("unknown compression %q (want zstd, gzip or none)", codec)
+	}
+
+	switch {
+	case codec == CodecGzip && (level < 0 || level > gzip.BestCompression):
+		return Compression{}, fmt.Errorf("gzip level must be between 1 and %d, or 0 for the default", gzip.BestCompression)
+	case codec == CodecZstd && (level < 0 || level > 22):
+		return Compression{}, fmt.Errorf("zstd level must be between 1 and 22, or 0 for the default")
+	}
+
+	return Compression{Codec: codec, Level: level}, nil
+}
+
+// SetCompression selects the compression used by NewBlobWriter
+func (s *Store) SetCompression(c Compression) {
+	s.compression = c
+}
+
+// sniffSize is how much of a blob is inspected before choosing a codec
+const sniffSize = 512
+
+// minCompressSize is the size below which blobs are stored raw; codec
+// framing would outweigh any saving
+const minCompressSize = 128
+
+// compressedMagic lists signatures of formats that are already compressed
+// and gain nothing from another pass
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                             // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},                 // zstd
+	{'P', 'K', 0x03, 0x04},                   // zip, jar, docx, ...
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},         // xz
+	{'B', 'Z', 'h'},                          // bzip2
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},       // 7z
+	{0x04, 0x22, 0x4d, 0x18},                 // lz4
+	{0x89, 'P', 'N', 'G'},                    // png
+	{0xff, 0xd8, 0xff},                       // jpeg
+	{'G', 'I', 'F', '8'},                     // gif
+	{'P', 'A', 'R', '1'},                     // parquet
+	{'O', 'b', 'j', 0x01},                    // avro
+	{0x00, 0x00, 0x00, 0x18, 'f', 't'},       // mp4
+	{0x00, 0x00, 0x00, 0x20, 'f', 't'},       // mp4
+	{0x1a, 0x45, 0xdf, 0xa3},                 // webm, mkv
+	{'%', 'P', 'D', 'F'},                     // pdf (streams are deflated)
+	{0x78, 0x9c}, {0x78, 0x01}, {0x78, 0xda}, // zlib
+}
+
+// chooseCodec picks the codec for a blob from its first bytes, falling
+// back to raw storage for small or already compressed content
+func chooseCodec(preferred string, head []byte, complete bool) string {
+	if complete && len(head) < minCompressSize {
+		return CodecNone
+	}
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(head, magic) {
+			return CodecNone
+		}
+	}
+	return preferred
+}
+
+// newEncoder wraps w in the codec's compressor
+func newEncoder(w io.Writer, c Compression, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CodecZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newDecoder returns a reader decompressing blob, which closes blob when
+// closed
+func newDecoder(blob io.ReadCloser, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecGzip:
+		r, err := gzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, fmt.Errorf("cannot open gzip blob: %w", err)
+		}
+		return &decodeCloser{Reader: r, close: r.Close, blob: blob}, nil
+	case CodecZstd:
+		r, err := zstd.NewReader(blob, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			blob.Close()
+			return nil, fmt.Errorf("cannot open zstd blob: %w", err)
+		}
+		return &decodeCloser{Reader: r, close: func() error { r.Close(); return nil }, blob: blob}, nil
+	case CodecNone, "":
+		return blob, nil
+	default:
+		blob.Close()
+		return nil, fmt.Errorf("unknown blob codec %q", codec)
+	}
+}
+
+// decodeCloser closes both the decompressor and the underlying blob
+type decodeCloser struct {
+	io.Reader
+	close func() error
+	blob  io.Closer
+}
+
+func (d *decodeCloser) Close() error {
+	err := d.close()
+	if blobErr := d.blob.Close(); err == nil {
+		err = blobErr
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter counts bytes passed through to the blob file
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Crash tests re-run the test binary as a child that saves an entry and
+// exits abruptly at one step of the save, leaving the files and database
+// as a killed process would.
+const (
+	crashStepEnv = "TASKVAULT_CRASH_STEP"
+	crashDirEnv  = "TASKVAULT_CRASH_DIR"
+	crashSizeEnv = "TASKVAULT_CRASH_SIZE"
+	crashExit    = 3
+)
+
+func TestCrashDuringSet(t *testing.T) {
+	if step := os.Getenv(crashStepEnv); step != "" {
+		runCrashChild(step)
+		return
+	}
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"file", 64 << 10},
+		{"chunked", 10 << 20},
+	}
+	steps := []string{"blob_written", "blob_renamed", "entry_inserted", "committed"}
+
+	for _, sz := range sizes {
+		for _, step := range steps {
+			t.Run(sz.name+"/"+step, func(t *testing.T) {
+				dir := t.TempDir()
+				oldData, newData := randomBlob(1, sz.size), randomBlob(2, sz.size)
+
+				store, err := NewStore(dir, 1)
+				if err != nil {
+					t.Fatalf("cannot create store: %v", err)
+				}
+				if err := store.SetStream(&Entry{Hash: "k", CreatedAt: time.Now()}, bytes.NewReader(oldData)); err != nil {
+					t.Fatalf("set error: %v", err)
+				}
+				store.Close()
+
+				cmd := exec.Command(os.Args[0], "-test.run=^TestCrashDuringSet$")
+				cmd.Env = append(os.Environ(),
+					crashStepEnv+"="+step,
+					crashDirEnv+"="+dir,
+					crashSizeEnv+"="+strconv.Itoa(sz.size),
+				)
+				var exitErr *exec.ExitError
+				if err := cmd.Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != crashExit {
+					t.Fatalf("expected child to crash at %s, got %v", step, err)
+				}
+
+				store, err = NewStore(dir, 1)
+				if err != nil {
+					t.Fatalf("cannot reopen store: %v", err)
+				}
+				defer store.Close()
+
+				// The save is applied entirely or not at all
+				want := oldData
+				if step == "committed" {
+					want = newData
+				}
+				_, blob, err := store.Open("k")
+				if err != nil || blob == nil {
+					t.Fatalf("expected entry to survive, got %v", err)
+				}
+				got, err := io.ReadAll(blob)
+				blob.Close()
+				if err != nil {
+					t.Fatalf("read error: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("entry holds neither the old nor the new contents intact")
+				}
+
+				// Whatever the crash left behind is garbage GC reclaims
+				if _, err := store.GC(GCOptions{}); err != nil {
+					t.Fatalf("gc error: %v", err)
+				}
+				report, err := store.Verify(false)
+				if err != nil {
+					t.Fatalf("verify error: %v", err)
+				}
+				if len(report.Problems) != 0 {
+					t.Errorf("expected a consistent store, got %+v", report.Problems)
+				}
+			})
+		}
+	}
+}
+
+// runCrashChild saves new contents over the entry and exits at step
+func runCrashChild(step string) {
+	size, _ := strconv.Atoi(os.Getenv(crashSizeEnv))
+	store, err := NewStore(os.Getenv(crashDirEnv), 1)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	crashHook = func(s string) {
+		if s == step {
+			os.Exit(crashExit)
+		}
+	}
+	store.SetStream(&Entry{Hash: "k", CreatedAt: time.Now()}, bytes.NewReader(randomBlob(2, size)))
+	os.Exit(0)
+}
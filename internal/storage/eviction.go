@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/taskvault/taskvault/internal/tracing"
+)
+
+// EntryInfo is the per-entry bookkeeping eviction strategies rank on
+type EntryInfo struct {
+	Hash        string
+	Task        string
+	Size        int64
+	CreatedAt   time.Time
+	AccessedAt  time.Time
+	HitCount    int64
+	ComputeTime time.Duration // how long the task took to produce the entry
+}
+
+// EvictionStrategy decides which entries go first when space is needed
+type EvictionStrategy interface {
+	// Name returns the strategy's policy name, e.g. "lru"
+	Name() string
+	// Less reports whether a should be evicted before b
+	Less(a, b EntryInfo) bool
+}
+
+// LRU evicts the least recently accessed entries first
+type LRU struct{}
+
+func (LRU) Name() string { return "lru" }
+
+func (LRU) Less(a, b EntryInfo) bool {
+	return a.AccessedAt.Before(b.AccessedAt)
+}
+
+// LFU evicts the least frequently hit entries first, LRU among equals
+type LFU struct{}
+
+func (LFU) Name() string { return "lfu" }
+
+func (LFU) Less(a, b EntryInfo) bool {
+	if a.HitCount != b.HitCount {
+		return a.HitCount < b.HitCount
+	}
+	return LRU{}.Less(a, b)
+}
+
+// FIFO evicts the oldest entries first, regardless of use
+type FIFO struct{}
+
+func (FIFO) Name() string { return "fifo" }
+
+func (FIFO) Less(a, b EntryInfo) bool {
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// CostAware evicts entries that are cheapest to recompute relative to the
+// space they take (compute time per byte), LRU among equals. Entries with no
+// recorded compute time count as free to recompute.
+type CostAware struct{}
+
+func (CostAware) Name() string { return "cost" }
+
+func (CostAware) Less(a, b EntryInfo) bool {
+	costA, costB := computeCostPerByte(a), computeCostPerByte(b)
+	if costA != costB {
+		return costA < costB
+	}
+	return LRU{}.Less(a, b)
+}
+
+// computeCostPerByte returns milliseconds of compute saved per stored byte
+func computeCostPerByte(e EntryInfo) float64 {
+	size := e.Size
+	if size < 1 {
+		size = 1
+	}
+	return float64(e.ComputeTime.Milliseconds()) / float64(size)
+}
+
+// StrategyByName resolves a policy strategy name; empty means LRU
+func StrategyByName(name string) (EvictionStrategy, error) {
+	switch name {
+	case "", "lru":
+		return LRU{}, nil
+	case "lfu":
+		return LFU{}, nil
+	case "fifo":
+		return FIFO{}, nil
+	case "cost":
+		return CostAware{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction strategy %q (want lru, lfu, fifo or cost)", name)
+	}
+}
+
+// selectVictims orders entries by strategy and returns the shortest prefix
+// whose sizes add up to at least excess bytes. The entry named keep (usually
+// the one just written) is never selected.
+func selectVictims(entries []EntryInfo, strategy EvictionStrategy, excess int64, keep string) []EntryInfo {
+	sortEntries(entries, strategy)
+
+	var victims []EntryInfo
+	var freed int64
+	for _, entry := range entries {
+		if freed >= excess {
+			break
+		}
+		if entry.Hash == keep {
+			continue
+		}
+		victims = append(victims, entry)
+		freed += entry.Size
+	}
+
+	return victims
+}
+
+// sortEntries orders entries so the first should be evicted first
+func sortEntries(entries []EntryInfo, strategy EvictionStrategy) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strategy.Less(entries[i], entries[j])
+	})
+}
+
+// evictionLowWater is the fraction of the cache limit eviction frees down
+// to, leaving headroom so the next few writes don't trigger it again
+const evictionLowWater = 0.8
+
+// SetEvictionStrategy selects the strategy used when the whole cache
+// exceeds its size limit
+func (s *Store) SetEvictionStrategy(strategy EvictionStrategy) {
+	s.strategy = strategy
+}
+
+// evictIfNeeded removes entries chosen by the store's strategy if blobs and
+// chunks on disk exceed the cache limit; keep is never evicted. Removing an entry
+// whose blob is shared frees nothing, so entries are removed one at a time
+// until enough space has actually been freed. Runs within the save's tx.
+func (s *Store) evictIfNeeded(tx *storeTx, keep string) (err error) {
+	totalSize, err := s.diskUsage(tx)
+	if err != nil {
+		return fmt.Errorf("cannot calculate cache size: %w", err)
+	}
+
+	if totalSize <= s.cacheSize {
+		return nil
+	}
+
+	_, span := tracing.Start(tx.ctx, "storage.evict", tracing.Size.Int64(totalSize))
+	evicted, freedTotal := 0, int64(0)
+	defer func() {
+		span.SetAttributes(tracing.Count.Int(evicted), tracing.Freed.Int64(freedTotal))
+		tracing.End(span, err)
+	}()
+
+	entries, err := s.entryInfo(tx, ``)
+	if err != nil {
+		return err
+	}
+	sortEntries(entries, s.strategy)
+
+	targetSize := int64(float64(s.cacheSize) * evictionLowWater)
+	for _, victim := range entries {
+		if totalSize <= targetSize {
+			break
+		}
+		if victim.Hash == keep {
+			continue
+		}
+
+		freed, err := s.removeTx(tx, victim.Hash)
+		if err != nil {
+			return err
+		}
+		if err := countEviction(tx, victim.Task); err != nil {
+			return err
+		}
+		totalSize -= freed
+		evicted++
+		freedTotal += freed
+	}
+
+	return nil
+}
+
+// EvictTask removes a task's entries, in strategy order, until the task's
+// total size is within maxBytes; keep is never evicted. Returns the number
+// of entries removed.
+func (s *Store) EvictTask(task string, maxBytes int64, strategy EvictionStrategy, keep string) (int, error) {
+	entries, err := s.entryInfo(s.db, `WHERE task = ?`, task)
+	if err != nil {
+		return 0, err
+	}
+
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.Size
+	}
+	if totalSize <= maxBytes {
+		return 0, nil
+	}
+
+	victims := selectVictims(entries, strategy, totalSize-maxBytes, keep)
+	for i, victim := range victims {
+		if err := s.Delete(victim.Hash); err != nil {
+			return i, err
+		}
+		if err := countEviction(s.db, task); err != nil {
+			return i + 1, err
+		}
+	}
+
+	return len(victims), nil
+}
+
+// entryInfo loads eviction bookkeeping for entries matching where
+func (s *Store) entryInfo(q querier, where string, args ...interface{}) ([]EntryInfo, error) {
+	stmt := `SELECT hash, task, size, created_at, accessed_at, hit_count, compute_ms FROM cache_entries ` + where
+
+	rows, err := q.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []EntryInfo
+	for rows.Next() {
+		var e EntryInfo
+		var computeMS int64
+		if err := rows.Scan(&e.Hash, &e.Task, &e.Size, &e.CreatedAt, &e.AccessedAt, &e.HitCount, &computeMS); err != nil {
+			return nil, fmt.Errorf("cannot scan entry: %w", err)
+		}
+		e.ComputeTime = time.Duration(computeMS) * time.Millisecond
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultGCGracePeriod protects files younger than this from GC. Blob and
+// chunk files are written before the row referencing them is committed,
+// and chunks uploaded with PutChunk wait unreferenced for SetChunks.
+const DefaultGCGracePeriod = time.Hour
+
+// GCOptions tunes a garbage collection pass
+type GCOptions struct {
+	GracePeriod time.Duration // files younger than this are kept
+}
+
+// GCReport summarizes what a garbage collection pass removed
+type GCReport struct {
+	ExpiredEntries  int   `json:"expired_entries"`
+	DanglingEntries int   `json:"dangling_entries"` // entries whose blob was gone
+	UnusedBlobs     int   `json:"unused_blobs"`
+	UnusedChunks    int   `json:"unused_chunks"`
+	OrphanedFiles   int   `json:"orphaned_files"`
+	ReclaimedBytes  int64 `json:"reclaimed_bytes"`
+}
+
+// GC reconciles the index with the blob and chunk directories: it removes
+// expired entries and leases, entries whose blob files are gone, blobs and
+// chunks nothing uses, and files no row refers to that are older than the
+// grace period. It is safe to run while the store is in use.
+func (s *Store) GC(opts GCOptions) (*GCReport, error) {
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	report := &GCReport{}
+
+	if err := s.gcExpired(report); err != nil {
+		return nil, err
+	}
+
+	// Scan the directories without the lock, which would stall every
+	// writer for as long as the disk takes; what is found is checked again
+	// under the lock before anything is removed
+	missingChunks, missingBlobs, err := s.missingFiles()
+	if err != nil {
+		return nil, err
+	}
+	stray, err := s.strayFiles(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Leases of holders that died without releasing them
+	if _, err := tx.Exec(`DELETE FROM leases WHERE expires_at < ?`, time.Now().UnixMilli()); err != nil {
+		return nil, fmt.Errorf("cannot delete leases: %w", err)
+	}
+
+	if err := s.gcMissing(tx, report, missingChunks, missingBlobs); err != nil {
+		return nil, err
+	}
+	if err := s.gcUnused(tx, report, cutoff); err != nil {
+		return nil, err
+	}
+	if err := s.gcFiles(tx, report, stray, cutoff); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("cannot commit gc: %w", err)
+	}
+	return report, nil
+}
+
+// StartGC runs GC every interval in the background until the returned
+// function is called. done, if not nil, receives the result of each pass.
+func (s *Store) StartGC(interval time.Duration, opts GCOptions, done func(*GCReport, error)) (stop func()) {
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				report, err := s.GC(opts)
+				if done != nil {
+					done(report, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		wg.Wait()
+	}
+}
+
+// gcExpired removes entries past their expiry time
+func (s *Store) gcExpired(report *GCReport) error {
+	rows, err := s.db.Query(`
+	SELECT hash FROM cache_entries
+	WHERE expires_at IS NOT NULL AND expires_at <= datetime('now')
+	`)
+	if err != nil {
+		return fmt.Errorf("cannot query entries: %w", err)
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan entry: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	for _, hash := range hashes {
+		freed, err := s.remove(context.Background(), hash)
+		if err != nil {
+			return err
+		}
+		report.ExpiredEntries++
+		report.ReclaimedBytes += freed
+	}
+	return nil
+}
+
+// missingFiles lists the chunks and unchunked blobs whose file is gone. It
+// reads without the write lock, so gcMissing checks each again.
+func (s *Store) missingFiles() (chunks, blobs []string, err error) {
+	hashes, err := queryHashes(s.db, `SELECT hash FROM chunks`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, hash := range hashes {
+		if _, err := os.Stat(s.chunkPath(hash)); err != nil {
+			chunks = append(chunks, hash)
+		}
+	}
+
+	hashes, err = queryHashes(s.db, `SELECT hash FROM blobs WHERE codec != ?`, CodecChunked)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, hash := range hashes {
+		if _, err := os.Stat(s.blobPath(hash)); err != nil {
+			blobs = append(blobs, hash)
+		}
+	}
+	return chunks, blobs, nil
+}
+
+// gcMissing removes entries whose blob row, blob file or one of whose
+// chunk files is gone, as left behind by an interrupted delete. chunks and
+// blobs are as found by missingFiles; those written again since are kept.
+func (s *Store) gcMissing(tx *storeTx, report *GCReport, chunks, blobs []string) error {
+	res, err := tx.Exec(`DELETE FROM cache_entries WHERE blob_hash NOT IN (SELECT hash FROM blobs)`)
+	if err != nil {
+		return fmt.Errorf("cannot delete entries: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	report.DanglingEntries += int(n)
+
+	// Forget chunks whose file is gone first, so releasing the blobs
+	// using them does not count them as reclaimed
+	var released []string
+	for _, hash := range chunks {
+		if _, err := os.Stat(s.chunkPath(hash)); err == nil {
+			continue
+		}
+		users, err := queryHashes(tx, `SELECT DISTINCT blob_hash FROM blob_chunks WHERE chunk_hash = ?`, hash)
+		if err != nil {
+			return err
+		}
+		released = append(released, users...)
+		if _, err := tx.Exec(`DELETE FROM chunks WHERE hash = ?`, hash); err != nil {
+			return fmt.Errorf("cannot release chunk: %w", err)
+		}
+	}
+
+	for _, hash := range blobs {
+		if _, err := os.Stat(s.blobPath(hash)); err != nil {
+			released = append(released, hash)
+		}
+	}
+
+	for _, blobHash := range released {
+		res, err := tx.Exec(`DELETE FROM cache_entries WHERE blob_hash = ?`, blobHash)
+		if err != nil {
+			return fmt.Errorf("cannot delete entries: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		report.DanglingEntries += int(n)
+
+		// A missing file frees nothing, but the chunks of a chunked blob
+		// that are still there do
+		var codec string
+		err = tx.QueryRow(`SELECT codec FROM blobs WHERE hash = ?`, blobHash).Scan(&codec)
+		if err == sql.ErrNoRows {
+			continue // listed twice, or deleted since the scan
+		}
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if _, err := tx.Exec(`UPDATE blobs SET refcount = 1 WHERE hash = ?`, blobHash); err != nil {
+			return fmt.Errorf("cannot release blob: %w", err)
+		}
+		freed, err := s.releaseBlob(tx, blobHash)
+		if err != nil {
+			return err
+		}
+		if codec == CodecChunked {
+			report.ReclaimedBytes += freed
+		}
+	}
+	return nil
+}
+
+// gcUnused removes blobs no entry uses and chunks no blob uses. Unused
+// chunks are kept for the grace period, as uploads reference them only
+// once the whole chunk list has arrived.
+func (s *Store) gcUnused(tx *storeTx, report *GCReport, cutoff time.Time) error {
+	blobs, err := queryHashes(tx, `
+	SELECT hash FROM blobs b
+	WHERE NOT EXISTS (SELECT 1 FROM cache_entries e WHERE e.blob_hash = b.hash)
+	`)
+	if err != nil {
+		return err
+	}
+	for _, blobHash := range blobs {
+		if _, err := tx.Exec(`UPDATE blobs SET refcount = 1 WHERE hash = ?`, blobHash); err != nil {
+			return fmt.Errorf("cannot release blob: %w", err)
+		}
+		freed, err := s.releaseBlob(tx, blobHash)
+		if err != nil {
+			return err
+		}
+		report.UnusedBlobs++
+		report.ReclaimedBytes += freed
+	}
+
+	chunks, err := queryHashes(tx, `
+	SELECT hash FROM chunks c
+	WHERE NOT EXISTS (SELECT 1 FROM blob_chunks bc WHERE bc.chunk_hash = c.hash)
+	`)
+	if err != nil {
+		return err
+	}
+	for _, hash := range chunks {
+		path := s.chunkPath(hash)
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().After(cutoff) {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM chunks WHERE hash = ?`, hash); err != nil {
+			return fmt.Errorf("cannot release chunk: %w", err)
+		}
+		tx.release(path)
+		report.UnusedChunks++
+		if info != nil {
+			report.ReclaimedBytes += info.Size()
+		}
+	}
+	return nil
+}
+
+// gcFiles removes the stray files strayFiles found that are older than
+// cutoff, once sure under tx that they still have no row and were not
+// written again since
+func (s *Store) gcFiles(tx *storeTx, report *GCReport, stray []strayFile, cutoff time.Time) error {
+	for _, file := range stray {
+		if file.info.ModTime().After(cutoff) {
+			continue
+		}
+
+		var known bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+file.table+` WHERE hash = ?)`, file.info.Name()).Scan(&known)
+		if err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+		if known {
+			continue
+		}
+		info, err := os.Lstat(file.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot stat %s: %w", file.path, err)
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove orphaned file: %w", err)
+		}
+		report.OrphanedFiles++
+		report.ReclaimedBytes += info.Size()
+	}
+	return nil
+}
+
+// strayFile is a file in the blob or chunk directory no row refers to
+type strayFile struct {
+	path  string
+	table string // where its row would be
+	info  fs.FileInfo
+}
+
+// strayFiles lists the blob and chunk files no row refers to. Files being
+// committed are listed too unless q holds the write lock.
+func (s *Store) strayFiles(q querier) ([]strayFile, error) {
+	var stray []strayFile
+	for _, dir := range []struct{ path, table string }{
+		{s.blobDir, "blobs"},
+		{s.chunkDir, "chunks"},
+	} {
+		hashes, err := queryHashes(q, `SELECT hash FROM `+dir.table)
+		if err != nil {
+			return nil, err
+		}
+		known := make(map[string]bool, len(hashes))
+		for _, hash := range hashes {
+			known[hash] = true
+		}
+
+		files, err := os.ReadDir(dir.path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list %s: %w", dir.path, err)
+		}
+		for _, file := range files {
+			if known[file.Name()] || file.IsDir() {
+				continue
+			}
+			info, err := file.Info()
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cannot stat %s: %w", file.Name(), err)
+			}
+			stray = append(stray, strayFile{path: filepath.Join(dir.path, file.Name()), table: dir.table, info: info})
+		}
+	}
+	return stray, nil
+}
+
+// queryHashes returns the single text column of a query's rows
+func queryHashes(q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGCReclaimsOrphans(t *testing.T) {
+	store := newTestStore(t)
+	store.SetCompression(Compression{Codec: CodecNone})
+
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	entries := []*Entry{
+		{Hash: "live", Data: []byte("live output"), CreatedAt: now, AccessedAt: now},
+		{Hash: "expired", Data: []byte("expired output"), CreatedAt: now, AccessedAt: now, ExpiresAt: &expired},
+		{Hash: "dangling", Data: []byte("dangling output"), CreatedAt: now, AccessedAt: now},
+	}
+	for _, entry := range entries {
+		if err := store.Set(entry); err != nil {
+			t.Fatalf("set error: %v", err)
+		}
+	}
+
+	// A delete interrupted after removing the blob file
+	if err := os.Remove(store.blobPath(entries[2].BlobHash)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files left by saves that died before their row was written
+	old := filepath.Join(store.blobDir, "0123abcd")
+	young := filepath.Join(store.blobDir, ".tmp-young")
+	for _, path := range []string{old, young} {
+		if err := os.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(old, now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.GC(GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("gc error: %v", err)
+	}
+
+	if report.ExpiredEntries != 1 || report.DanglingEntries != 1 || report.OrphanedFiles != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if want := int64(1000 + len("expired output")); report.ReclaimedBytes != want {
+		t.Errorf("expected %d bytes reclaimed, got %d", want, report.ReclaimedBytes)
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expected old orphan removed, stat says %v", err)
+	}
+	if _, err := os.Stat(young); err != nil {
+		t.Errorf("expected young file kept: %v", err)
+	}
+	for _, hash := range []string{"expired", "dangling"} {
+		if got, _ := store.Get(hash); got != nil {
+			t.Errorf("expected %s removed", hash)
+		}
+	}
+	if got, _ := store.Get("live"); got == nil {
+		t.Error("expected live entry kept")
+	}
+
+	verify, err := store.Verify(false)
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	if len(verify.Problems) != 0 {
+		t.Errorf("expected a consistent store after gc, got %+v", verify.Problems)
+	}
+}
+
+func TestGCRechecksWhatItScannedUnlocked(t *testing.T) {
+	store := newTestStore(t)
+	store.SetCompression(Compression{Codec: CodecNone})
+
+	now := time.Now()
+	entry := &Entry{Hash: "restored", Data: []byte("restored output"), CreatedAt: now, AccessedAt: now}
+	if err := store.Set(entry); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+
+	// Scan while the blob file is gone and two old files have no row
+	blobPath := store.blobPath(entry.BlobHash)
+	data, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(blobPath); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := filepath.Join(store.blobDir, "0123abcd")
+	vanished := filepath.Join(store.blobDir, ".tmp-vanished")
+	for _, path := range []string{rewritten, vanished} {
+		if err := os.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, missingBlobs, err := store.missingFiles()
+	if err != nil {
+		t.Fatalf("scan error: %v", err)
+	}
+	stray, err := store.strayFiles(store.db)
+	if err != nil {
+		t.Fatalf("scan error: %v", err)
+	}
+	if len(missingBlobs) != 1 || len(stray) != 2 {
+		t.Fatalf("expected 1 missing blob and 2 stray files, got %v and %d", missingBlobs, len(stray))
+	}
+
+	// Before the lock is taken, the blob comes back, one file is written
+	// again and the other removed
+	if err := os.WriteFile(blobPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rewritten, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(vanished); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := store.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	report := &GCReport{}
+	if err := store.gcMissing(tx, report, nil, missingBlobs); err != nil {
+		t.Fatalf("gc error: %v", err)
+	}
+	if err := store.gcFiles(tx, report, stray, now.Add(-time.Hour)); err != nil {
+		t.Fatalf("gc error: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.DanglingEntries != 0 || report.OrphanedFiles != 0 {
+		t.Errorf("expected nothing removed, got %+v", report)
+	}
+	if _, err := os.Stat(rewritten); err != nil {
+		t.Errorf("expected the rewritten file kept: %v", err)
+	}
+	if got, _ := store.Get("restored"); got == nil {
+		t.Error("expected the entry whose blob came back kept")
+	}
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Leases let one process at a time produce the entry for a key while
+// others wait for it. A lease lapses unless its holder renews it, so a
+// holder that crashed blocks the others for at most one TTL.
+
+// AcquireLease takes the lease on key for owner, or renews it if owner
+// holds it already. Reports false while another owner's lease is live.
+func (s *Store) AcquireLease(key, owner string, ttl time.Duration) (bool, error) {
+	return s.AcquireLeaseContext(context.Background(), key, owner, ttl)
+}
+
+// AcquireLeaseContext is AcquireLease under ctx, which also bounds the wait
+// for the write lock
+func (s *Store) AcquireLeaseContext(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	tx, err := s.beginContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var holder string
+	var expiresAt int64
+	err = tx.QueryRow(`SELECT owner, expires_at FROM leases WHERE key = ?`, key).Scan(&holder, &expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	if err == nil && holder != owner && expiresAt > now.UnixMilli() {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO leases (key, owner, expires_at) VALUES (?, ?, ?)
+	ON CONFLICT(key) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+	`, key, owner, now.Add(ttl).UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("cannot take lease: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("cannot take lease: %w", err)
+	}
+	return true, nil
+}
+
+// ReleaseLease gives up owner's lease on key; it is a no-op if the lease
+// lapsed and another owner took it since
+func (s *Store) ReleaseLease(key, owner string) error {
+	return s.ReleaseLeaseContext(context.Background(), key, owner)
+}
+
+// ReleaseLeaseContext is ReleaseLease under ctx
+func (s *Store) ReleaseLeaseContext(ctx context.Context, key, owner string) error {
+	if _, err := s.withContext(ctx).Exec(`DELETE FROM leases WHERE key = ? AND owner = ?`, key, owner); err != nil {
+		return fmt.Errorf("cannot release lease: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockPoll is how often a writer waiting under a context retries the lock
+// file held by another process
+const lockPoll = 10 * time.Millisecond
+
+// writeLock serializes writers to a cache directory, across goroutines
+// through a one-slot channel and across processes through an advisory lock
+// on a file, which the OS releases if its holder dies
+type writeLock struct {
+	held chan struct{}
+	file *os.File
+}
+
+// openWriteLock opens (creating if needed) the lock file at path
+func openWriteLock(path string) (*writeLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file: %w", err)
+	}
+	return &writeLock{held: make(chan struct{}, 1), file: file}, nil
+}
+
+// Lock blocks until no other goroutine or process holds the lock
+func (l *writeLock) Lock() error {
+	return l.LockContext(context.Background())
+}
+
+// LockContext is Lock, giving up once ctx is done. Another process's lock
+// is polled for then, as waiting on the file cannot be interrupted.
+func (l *writeLock) LockContext(ctx context.Context) error {
+	if err := l.hold(ctx); err != nil {
+		return fmt.Errorf("cannot lock cache: %w", err)
+	}
+
+	var err error
+	if ctx.Done() == nil {
+		err = lockFile(l.file)
+	} else {
+		err = pollFile(ctx, l.file)
+	}
+	if err != nil {
+		l.release()
+		return fmt.Errorf("cannot lock cache: %w", err)
+	}
+	return nil
+}
+
+// hold takes the lock from the other goroutines of this process only,
+// giving up once ctx is done
+func (l *writeLock) hold(ctx context.Context) error {
+	select {
+	case l.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives back what hold took
+func (l *writeLock) release() {
+	<-l.held
+}
+
+// pollFile takes the lock on f, retrying until ctx is done
+func pollFile(ctx context.Context, f *os.File) error {
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil || ok {
+			return err
+		}
+
+		timer := time.NewTimer(lockPoll)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock releases the lock
+func (l *writeLock) Unlock() {
+	unlockFile(l.file)
+	l.release()
+}
+
+// Close closes the lock file
+func (l *writeLock) Close() error {
+	return l.file.Close()
+}
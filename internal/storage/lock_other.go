@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package storage
+
+import "os"
+
+// Platforms without file locking only serialize writers within a process
+
+func lockFile(f *os.File) error { return nil }
+
+func tryLockFile(f *os.File) (bool, error) { return true, nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"github.com/taskvault/taskvault/internal/metrics"
+)
+
+// RegisterMetrics exports the store's size and the per-task counters it
+// keeps, read from the database at scrape time. The counters include every
+// process sharing the cache directory.
+func (s *Store) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewCollector("taskvault_cache_size_bytes", "Bytes blobs and chunks occupy on disk.", metrics.Gauge, nil,
+		func(emit metrics.Emit) error {
+			size, err := s.diskUsage(s.db)
+			if err != nil {
+				return err
+			}
+			emit(float64(size))
+			return nil
+		})
+
+	reg.NewCollector("taskvault_cache_limit_bytes", "Cache size above which entries are evicted.", metrics.Gauge, nil,
+		func(emit metrics.Emit) error {
+			emit(float64(s.cacheSize))
+			return nil
+		})
+
+	s.taskCollector(reg, "taskvault_cache_entries", "Cached entries by task.", metrics.Gauge, nil,
+		func(t TaskStats, emit metrics.Emit) { emit(float64(t.Entries), t.Task) })
+	s.taskCollector(reg, "taskvault_task_lookups_total", "Lookups by task and result, across all processes.", metrics.Counter, []string{"result"},
+		func(t TaskStats, emit metrics.Emit) {
+			emit(float64(t.Hits), t.Task, "hit")
+			emit(float64(t.Misses), t.Task, "miss")
+		})
+	s.taskCollector(reg, "taskvault_task_time_saved_seconds_total", "Recorded compute time of the entries hit, by task.", metrics.Counter, nil,
+		func(t TaskStats, emit metrics.Emit) { emit(float64(t.TimeSavedMS)/1000, t.Task) })
+	s.taskCollector(reg, "taskvault_task_evictions_total", "Entries evicted to stay within size limits, by task.", metrics.Counter, nil,
+		func(t TaskStats, emit metrics.Emit) { emit(float64(t.Evictions), t.Task) })
+}
+
+// taskCollector registers a metric labelled by task, then labels, whose
+// samples sample reports from each task's stats
+func (s *Store) taskCollector(reg *metrics.Registry, name, help, typ string, labels []string, sample func(TaskStats, metrics.Emit)) {
+	reg.NewCollector(name, help, typ, append([]string{"task"}, labels...), func(emit metrics.Emit) error {
+		tasks, err := s.TaskStats()
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			sample(t, emit)
+		}
+		return nil
+	})
+}
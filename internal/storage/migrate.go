@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the database was written by a newer
+// TaskVault whose schema this binary does not understand
+var ErrSchemaTooNew = errors.New("cache database schema is newer than this binary")
+
+// migration is one ordered, forward-only schema change
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Never edit or reorder a
+// released migration; append a new one instead. Column additions go
+// through addColumn so databases that gained columns before versioning
+// existed migrate cleanly.
+var migrations = []migration{
+	{1, "create cache_entries", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS cache_entries (
+			hash TEXT PRIMARY KEY,
+			metadata TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			accessed_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP,
+			size INTEGER NOT NULL,
+			blob_path TEXT NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_accessed ON cache_entries(accessed_at);
+		CREATE INDEX IF NOT EXISTS idx_expires ON cache_entries(expires_at);
+		CREATE INDEX IF NOT EXISTS idx_size ON cache_entries(size);
+		`)
+		return err
+	}},
+
+	// Existing rows were keyed by bare input hash (legacy schema 1)
+	{2, "add key_schema", func(tx *sql.Tx) error {
+		return addColumn(tx, "cache_entries", "key_schema", "INTEGER NOT NULL DEFAULT 1")
+	}},
+
+	{3, "add hit_count and compute_ms", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "cache_entries", "hit_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "cache_entries", "compute_ms", "INTEGER NOT NULL DEFAULT 0")
+	}},
+
+	// The task used to live only inside the JSON metadata
+	{4, "add task and tags", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "cache_entries", "tags", "TEXT NOT NULL DEFAULT '[]'"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "cache_entries", "task", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+		UPDATE cache_entries SET task = COALESCE(json_extract(metadata, '$.task'), '')
+		WHERE task = '' AND json_valid(metadata);
+
+		CREATE INDEX IF NOT EXISTS idx_task ON cache_entries(task);
+		`)
+		return err
+	}},
+
+	// Blobs used to be named after their entry; those keep their file name
+	// as blob hash and simply never dedup with newer, content-named blobs
+	{5, "add content-addressed blobs", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "cache_entries", "blob_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS blobs (
+			hash TEXT PRIMARY KEY,
+			size INTEGER NOT NULL,
+			refcount INTEGER NOT NULL
+		);
+
+		UPDATE cache_entries SET blob_hash = hash WHERE blob_hash = '';
+
+		INSERT OR IGNORE INTO blobs (hash, size, refcount)
+		SELECT blob_hash, MAX(size), COUNT(*) FROM cache_entries GROUP BY blob_hash;
+
+		CREATE INDEX IF NOT EXISTS idx_blob_hash ON cache_entries(blob_hash);
+		`)
+		return err
+	}},
+
+	// Existing blobs are raw, so their stored size is their size
+	{6, "add blob compression", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "blobs", "codec", "TEXT NOT NULL DEFAULT 'none'"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "cache_entries", "codec", "TEXT NOT NULL DEFAULT 'none'"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "cache_entries", "stored_size", "INTEGER NOT NULL DEFAULT -1"); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`UPDATE cache_entries SET stored_size = size WHERE stored_size = -1`)
+		return err
+	}},
+
+	// Chunk refcount counts blob_chunks rows, so a chunk repeated within
+	// one blob is referenced once per occurrence
+	{7, "add chunked blobs", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS chunks (
+			hash TEXT PRIMARY KEY,
+			size INTEGER NOT NULL,
+			stored_size INTEGER NOT NULL,
+			codec TEXT NOT NULL,
+			refcount INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS blob_chunks (
+			blob_hash TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			chunk_hash TEXT NOT NULL,
+			PRIMARY KEY (blob_hash, seq)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_chunk_hash ON blob_chunks(chunk_hash);
+		`)
+		return err
+	}},
+
+	// Blob hashes are content hashes except for legacy blobs named after
+	// their entry, whose contents were never hashed
+	{8, "add content_hash", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "cache_entries", "content_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`UPDATE cache_entries SET content_hash = blob_hash WHERE content_hash = '' AND blob_hash != hash`)
+		return err
+	}},
+
+	// expires_at is in Unix milliseconds, compared against the caller's clock
+	{9, "add leases", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS leases (
+			key TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`)
+		return err
+	}},
+
+	// Hits and misses per task outlive the entries they were counted on.
+	// Hits before this version only survive on entries still cached.
+	{10, "add task_stats", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS task_stats (
+			task TEXT PRIMARY KEY,
+			hits INTEGER NOT NULL,
+			misses INTEGER NOT NULL,
+			saved_ms INTEGER NOT NULL
+		);
+
+		INSERT OR IGNORE INTO task_stats (task, hits, misses, saved_ms)
+		SELECT task, SUM(hit_count), 0, SUM(hit_count * compute_ms) FROM cache_entries GROUP BY task;
+		`)
+		return err
+	}},
+
+	{11, "add task_stats evictions", func(tx *sql.Tx) error {
+		return addColumn(tx, "task_stats", "evictions", "INTEGER NOT NULL DEFAULT 0")
+	}},
+}
+
+// LatestSchemaVersion is the schema version this binary writes
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate brings the database up to LatestSchemaVersion. All pending
+// migrations run in a single transaction, so a failure leaves the database
+// exactly as it was.
+func (s *Store) migrate() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("cannot create migrations table: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("cannot read schema version: %w", err)
+	}
+
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("%w (database v%d, binary v%d)", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if err := m.up(tx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+
+		_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.version, m.name, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("cannot record migration %d: %w", m.version, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SchemaVersion returns the database's current schema version
+func (s *Store) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// addColumn adds a column to a table unless it already exists
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("cannot inspect table %s: %w", table, err)
+	}
+
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot inspect table %s: %w", table, err)
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot inspect table %s: %w", table, err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	if _, err := tx.Exec(alter); err != nil {
+		return fmt.Errorf("cannot add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
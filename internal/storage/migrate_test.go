@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadFixture creates cache.db in a fresh cache directory from a SQL
+// fixture, writing a blob for every row so entries are readable
+func loadFixture(t *testing.T, fixture string, blobs map[string]string) string {
+	t.Helper()
+
+	cacheDir := t.TempDir()
+	blobDir := filepath.Join(cacheDir, "blobs")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(cacheDir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(strings.ReplaceAll(string(script), "{{BLOBDIR}}", blobDir)); err != nil {
+		t.Fatalf("cannot load fixture %s: %v", fixture, err)
+	}
+
+	for hash, data := range blobs {
+		if err := os.WriteFile(filepath.Join(blobDir, hash), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cacheDir
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	hash := "a3f2b1c8d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2"
+	cacheDir := loadFixture(t, "v0_baseline.sql", map[string]string{hash: "hello"})
+
+	store, err := NewStore(cacheDir, 1)
+	if err != nil {
+		t.Fatalf("cannot open baseline database: %v", err)
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("expected schema v%d, got v%d", LatestSchemaVersion(), version)
+	}
+
+	entry, err := store.Get(hash)
+	if err != nil || entry == nil {
+		t.Fatalf("expected migrated entry, got %v", err)
+	}
+	if string(entry.Data) != "hello" {
+		t.Errorf("unexpected data %q", entry.Data)
+	}
+	if entry.Task != "lint" {
+		t.Errorf("expected task backfilled from metadata, got %q", entry.Task)
+	}
+	if entry.KeySchema != 1 {
+		t.Errorf("expected legacy key schema, got %d", entry.KeySchema)
+	}
+
+	// The legacy blob keeps its file and is reference counted
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["blobs"] != int64(1) || stats["total_size"] != int64(5) {
+		t.Errorf("expected legacy blob to be tracked, got %v", stats)
+	}
+	if err := store.Delete(hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "blobs", hash)); !os.IsNotExist(err) {
+		t.Errorf("expected legacy blob removed with its entry")
+	}
+}
+
+func TestMigrateUnversionedDevDatabase(t *testing.T) {
+	hash := "b0529528e3c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2a3f2b1c8d5e6f7a8b9c0"
+	cacheDir := loadFixture(t, "v2_dev.sql", map[string]string{hash: "abc"})
+
+	store, err := NewStore(cacheDir, 1)
+	if err != nil {
+		t.Fatalf("cannot open dev database: %v", err)
+	}
+	defer store.Close()
+
+	entry, err := store.Get(hash)
+	if err != nil || entry == nil {
+		t.Fatalf("expected migrated entry, got %v", err)
+	}
+	if entry.Task != "build" || entry.KeySchema != 2 || entry.HitCount != 5 {
+		t.Errorf("columns not preserved: task=%q key_schema=%d hits=%d", entry.Task, entry.KeySchema, entry.HitCount)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	for i := 0; i < 2; i++ {
+		store, err := NewStore(cacheDir, 1)
+		if err != nil {
+			t.Fatalf("open %d failed: %v", i, err)
+		}
+		store.Close()
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	store, err := NewStore(cacheDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', datetime('now'))`,
+		LatestSchemaVersion()+1)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewStore(cacheDir, 1)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
@@ -0,0 +1,690 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config locates a bucket on an S3-compatible object store
+type S3Config struct {
+	Endpoint  string // e.g. "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000"
+	Region    string // signing region; defaults to "us-east-1"
+	Bucket    string
+	Prefix    string // key prefix inside the bucket, e.g. "taskvault/"
+	AccessKey string
+	SecretKey string
+	Token     string // session token for temporary credentials, optional
+}
+
+// S3Backend stores entries in an S3-compatible bucket. Blobs are content
+// addressed (<prefix>blobs/<sha256>), so identical outputs are uploaded
+// once; each entry is a small JSON object (<prefix>entries/<hash>.json)
+// pointing at its blob, or listing its chunks (<prefix>chunks/<sha256>,
+// stored raw) for large blobs pushed chunk by chunk. Requests are
+// path-style and signed with AWS Signature Version 4, which MinIO and other
+// S3 clones accept.
+type S3Backend struct {
+	cfg  S3Config
+	http *http.Client
+	now  func() time.Time // signing clock, replaced in tests
+	ctx  context.Context  // requests are made under it; nil for none
+}
+
+var (
+	_ ChunkStore     = (*S3Backend)(nil)
+	_ ContextBackend = (*S3Backend)(nil)
+)
+
+// s3Entry is the JSON object stored per entry
+type s3Entry struct {
+	Entry
+	Blob string `json:"blob,omitempty"` // object key of the content-addressed blob, unless chunked
+}
+
+// NewS3Backend creates a backend for the bucket described by cfg. Missing
+// credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+func NewS3Backend(cfg S3Config) (*S3Backend, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.AccessKey == "" {
+		cfg.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.Token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("s3 credentials are required (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY)")
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return &S3Backend{
+		cfg:  cfg,
+		http: &http.Client{Transport: transport},
+		now:  time.Now,
+	}, nil
+}
+
+// SetStream uploads the blob under its content hash, then the entry. The
+// blob is spooled to a temporary file first, since its key and length must
+// be known before the upload starts.
+func (b *S3Backend) SetStream(entry *Entry, r io.Reader) error {
+	spool, err := os.CreateTemp("", "taskvault-s3-*")
+	if err != nil {
+		return fmt.Errorf("cannot spool blob: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hasher), r)
+	if err != nil {
+		return fmt.Errorf("cannot spool blob: %w", err)
+	}
+	entry.Size = size
+
+	blobKey := b.cfg.Prefix + "blobs/" + hex.EncodeToString(hasher.Sum(nil))
+
+	exists, err := b.exists(blobKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("cannot spool blob: %w", err)
+		}
+		if err := b.put(blobKey, spool, size); err != nil {
+			return err
+		}
+	}
+
+	stored := s3Entry{Entry: *entry, Blob: blobKey}
+	stored.Data = nil
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return fmt.Errorf("cannot marshal entry: %w", err)
+	}
+
+	return b.put(b.entryKey(entry.Hash), strings.NewReader(string(data)), int64(len(data)))
+}
+
+// Open fetches an entry and streams its blob. Expired entries are misses.
+func (b *S3Backend) Open(hash string) (*Entry, io.ReadCloser, error) {
+	stored, err := b.getEntry(hash)
+	if err != nil || stored == nil {
+		return nil, nil, err
+	}
+
+	if stored.ExpiresAt != nil && !stored.ExpiresAt.After(b.now()) {
+		return nil, nil, nil
+	}
+
+	if len(stored.Chunks) > 0 {
+		chunks := stored.Chunks
+		return &stored.Entry, &chunkReader{chunks: chunks, open: func(i int) (io.ReadCloser, error) {
+			return b.OpenChunk(chunks[i].Hash)
+		}}, nil
+	}
+
+	resp, err := b.do(http.MethodGet, stored.Blob, nil, nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// Entry without its blob - treat as missing
+		resp.Body.Close()
+		return nil, nil, nil
+	}
+	if err := s3Status(resp, http.StatusOK); err != nil {
+		return nil, nil, err
+	}
+
+	return &stored.Entry, resp.Body, nil
+}
+
+// Lookup fetches an entry without its blob. Expired entries are misses.
+func (b *S3Backend) Lookup(hash string) (*Entry, error) {
+	stored, err := b.getEntry(hash)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	if stored.ExpiresAt != nil && !stored.ExpiresAt.After(b.now()) {
+		return nil, nil
+	}
+	return &stored.Entry, nil
+}
+
+// HasChunk reports whether a chunk object exists
+func (b *S3Backend) HasChunk(hash string) (bool, error) {
+	return b.exists(b.chunkKey(hash))
+}
+
+// OpenChunk streams a chunk object
+func (b *S3Backend) OpenChunk(hash string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, b.chunkKey(hash), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrChunkMissing, hash)
+	}
+	if err := s3Status(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutChunk uploads a chunk after checking it against hash
+func (b *S3Backend) PutChunk(hash string, r io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, cdcMaxSize+1))
+	if err != nil {
+		return fmt.Errorf("cannot read chunk: %w", err)
+	}
+	if len(data) > cdcMaxSize {
+		return fmt.Errorf("chunk %s exceeds %d bytes", hash, cdcMaxSize)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("chunk contents do not match hash %s", hash)
+	}
+
+	return b.put(b.chunkKey(hash), bytes.NewReader(data), int64(len(data)))
+}
+
+// SetChunks uploads an entry listing chunks already uploaded with
+// PutChunk, once they are all there and read back as entry.BlobHash.
+// entry.Size is recomputed.
+func (b *S3Backend) SetChunks(entry *Entry) error {
+	if len(entry.Chunks) == 0 {
+		return fmt.Errorf("entry %s has no chunks", entry.Hash)
+	}
+
+	var size int64
+	var missing []string
+	seen := make(map[string]bool)
+	for _, chunk := range entry.Chunks {
+		size += chunk.Size
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+
+		has, err := b.HasChunk(chunk.Hash)
+		if err != nil {
+			return err
+		}
+		if !has {
+			missing = append(missing, chunk.Hash)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingChunksError{Hashes: missing}
+	}
+
+	// The bucket cannot check an entry against its chunks, so every reader
+	// would trust a wrong chunk list
+	if err := b.verifyChunks(entry.Chunks, entry.BlobHash, size); err != nil {
+		return fmt.Errorf("cannot store entry %s: %w", entry.Hash, err)
+	}
+	entry.Size = size
+
+	stored := s3Entry{Entry: *entry}
+	stored.Data = nil
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return fmt.Errorf("cannot marshal entry: %w", err)
+	}
+
+	return b.put(b.entryKey(entry.Hash), bytes.NewReader(data), int64(len(data)))
+}
+
+// verifyChunks reads a chunk list back and checks that it makes up the
+// blob with the given hash and size
+func (b *S3Backend) verifyChunks(chunks []ChunkRef, blobHash string, size int64) error {
+	blob := &chunkReader{chunks: chunks, open: func(i int) (io.ReadCloser, error) {
+		return b.OpenChunk(chunks[i].Hash)
+	}}
+	defer blob.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, blob)
+	if err != nil {
+		return fmt.Errorf("cannot read chunks: %w", err)
+	}
+	if n != size || hex.EncodeToString(hasher.Sum(nil)) != blobHash {
+		return fmt.Errorf("chunks do not make up blob %s", blobHash)
+	}
+	return nil
+}
+
+// Delete removes the entry object. Blobs and chunks may be shared by other
+// entries, so they are left in place for GC.
+func (b *S3Backend) Delete(hash string) error {
+	return b.remove(b.entryKey(hash))
+}
+
+// GC removes expired entries, then the blob and chunk objects no entry
+// refers to, as Delete leaves them, once older than the grace period:
+// uploads put them before the entry that refers to them. An entry saved
+// while GC runs may still lose an older object it reuses, and then fails
+// to read like an entry whose blob was lost.
+func (b *S3Backend) GC(opts GCOptions) (*GCReport, error) {
+	cutoff := b.now().Add(-opts.GracePeriod)
+	report := &GCReport{}
+
+	// Candidates are listed before the entries, so objects of entries
+	// stored in between are too young to be among them
+	var blobs, chunks []s3Object
+	err := b.list(b.cfg.Prefix+"blobs/", func(obj s3Object) {
+		if !obj.LastModified.After(cutoff) {
+			blobs = append(blobs, obj)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = b.list(b.cfg.Prefix+"chunks/", func(obj s3Object) {
+		if !obj.LastModified.After(cutoff) {
+			chunks = append(chunks, obj)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	err = b.list(b.cfg.Prefix+"entries/", func(obj s3Object) {
+		entries = append(entries, obj.Key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool)
+	for _, key := range entries {
+		hash := strings.TrimSuffix(strings.TrimPrefix(key, b.cfg.Prefix+"entries/"), ".json")
+		stored, err := b.getEntry(hash)
+		if err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			continue // deleted meanwhile
+		}
+		if stored.ExpiresAt != nil && !stored.ExpiresAt.After(b.now()) {
+			if err := b.remove(key); err != nil {
+				return nil, err
+			}
+			report.ExpiredEntries++
+			continue
+		}
+
+		if stored.Blob != "" {
+			used[stored.Blob] = true
+		}
+		for _, chunk := range stored.Chunks {
+			used[b.chunkKey(chunk.Hash)] = true
+		}
+	}
+
+	for _, obj := range blobs {
+		if used[obj.Key] {
+			continue
+		}
+		if err := b.remove(obj.Key); err != nil {
+			return nil, err
+		}
+		report.UnusedBlobs++
+		report.ReclaimedBytes += obj.Size
+	}
+	for _, obj := range chunks {
+		if used[obj.Key] {
+			continue
+		}
+		if err := b.remove(obj.Key); err != nil {
+			return nil, err
+		}
+		report.UnusedChunks++
+		report.ReclaimedBytes += obj.Size
+	}
+	return report, nil
+}
+
+// Stats counts entries and the bytes held in blobs and chunks
+func (b *S3Backend) Stats() (map[string]interface{}, error) {
+	var entries, blobs, chunks, totalSize int64
+
+	err := b.list(b.cfg.Prefix+"entries/", func(obj s3Object) {
+		entries++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.list(b.cfg.Prefix+"blobs/", func(obj s3Object) {
+		blobs++
+		totalSize += obj.Size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.list(b.cfg.Prefix+"chunks/", func(obj s3Object) {
+		chunks++
+		totalSize += obj.Size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"entries":    entries,
+		"blobs":      blobs,
+		"chunks":     chunks,
+		"total_size": totalSize,
+		"bucket":     b.cfg.Bucket,
+	}, nil
+}
+
+// Close releases idle connections
+func (b *S3Backend) Close() error {
+	b.http.CloseIdleConnections()
+	return nil
+}
+
+func (b *S3Backend) entryKey(hash string) string {
+	return b.cfg.Prefix + "entries/" + hash + ".json"
+}
+
+func (b *S3Backend) chunkKey(hash string) string {
+	return b.cfg.Prefix + "chunks/" + hash
+}
+
+func (b *S3Backend) getEntry(hash string) (*s3Entry, error) {
+	resp, err := b.do(http.MethodGet, b.entryKey(hash), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := s3Status(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var stored s3Entry
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal entry: %w", err)
+	}
+	return &stored, nil
+}
+
+func (b *S3Backend) exists(key string) (bool, error) {
+	resp, err := b.do(http.MethodHead, key, nil, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := s3Status(resp, http.StatusOK); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// remove deletes an object; S3 answers 204 whether or not it existed
+func (b *S3Backend) remove(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return s3Status(resp, http.StatusNoContent)
+}
+
+func (b *S3Backend) put(key string, body io.Reader, size int64) error {
+	resp, err := b.do(http.MethodPut, key, nil, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return s3Status(resp, http.StatusOK)
+}
+
+// s3Object is an object in a bucket listing
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// listResult is the subset of a ListObjectsV2 response we read
+type listResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// list calls fn for every object under prefix, following pagination
+func (b *S3Backend) list(prefix string, fn func(obj s3Object)) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := b.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return err
+		}
+		if err := s3Status(resp, http.StatusOK); err != nil {
+			return err
+		}
+
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot parse bucket listing: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			fn(obj)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// WithContext returns a backend sharing b's connections whose requests are
+// made under ctx
+func (b *S3Backend) WithContext(ctx context.Context) Backend {
+	bound := *b
+	bound.ctx = ctx
+	return &bound
+}
+
+// do sends a signed request for an object key (or the bucket itself when
+// key is empty)
+func (b *S3Backend) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	target := b.cfg.Endpoint + "/" + b.cfg.Bucket
+	if key != "" {
+		target += "/" + key
+	}
+
+	ctx := b.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s failed: %w", method, err)
+	}
+	req.URL.RawQuery = query.Encode()
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	b.sign(req, b.now())
+
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s failed: %w", method, err)
+	}
+	return resp, nil
+}
+
+// unsignedPayload skips body hashing; the transport (TLS) protects it
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds an AWS Signature Version 4 Authorization header covering the
+// host and every header already set on req
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+	if b.cfg.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", b.cfg.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := day + "/" + b.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.cfg.SecretKey), day)
+	key = hmacSHA256(key, b.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by name, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters (and "/"
+// unless encodeSlash is set)
+func s3Escape(s string, encodeSlash bool) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			out.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+// s3Status turns an unexpected response into an error carrying the S3
+// error message, closing the body in that case
+func s3Status(resp *http.Response, want int) error {
+	if resp.StatusCode == want {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3 returned %s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("s3 returned %s", resp.Status)
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TaskStats are the lookup counters of one task, kept across evictions,
+// and the entries it has cached now
+type TaskStats struct {
+	Task        string  `json:"task"`
+	Entries     int64   `json:"entries"`
+	Size        int64   `json:"size"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	TimeSavedMS int64   `json:"time_saved_ms"` // compute time of the entries hit
+	Evictions   int64   `json:"evictions"`
+}
+
+// execer is satisfied by *sql.DB, *storeTx and contextDB
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordHit updates an entry's access time and hit count, and adds the hit
+// and the compute time it saved to its task's counters
+func (s *Store) recordHit(ctx context.Context, hash string, at time.Time) error {
+	tx, err := s.beginContext(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot record hit: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE cache_entries SET accessed_at = ?, hit_count = hit_count + 1 WHERE hash = ?`, at, hash); err != nil {
+		return fmt.Errorf("cannot update access time: %w", err)
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO task_stats (task, hits, misses, saved_ms)
+	SELECT task, 1, 0, compute_ms FROM cache_entries WHERE hash = ?
+	ON CONFLICT(task) DO UPDATE SET hits = hits + 1, saved_ms = saved_ms + excluded.saved_ms
+	`, hash)
+	if err != nil {
+		return fmt.Errorf("cannot record hit: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot record hit: %w", err)
+	}
+	return nil
+}
+
+// RecordMiss counts a lookup for the task that found nothing
+func (s *Store) RecordMiss(task string) error {
+	return s.RecordMissContext(context.Background(), task)
+}
+
+// RecordMissContext is RecordMiss under ctx
+func (s *Store) RecordMissContext(ctx context.Context, task string) error {
+	_, err := s.withContext(ctx).Exec(`
+	INSERT INTO task_stats (task, hits, misses, saved_ms) VALUES (?, 0, 1, 0)
+	ON CONFLICT(task) DO UPDATE SET misses = misses + 1
+	`, task)
+	if err != nil {
+		return fmt.Errorf("cannot record miss: %w", err)
+	}
+	return nil
+}
+
+// countEviction adds an evicted entry to its task's counters
+func countEviction(e execer, task string) error {
+	_, err := e.Exec(`
+	INSERT INTO task_stats (task, hits, misses, saved_ms, evictions) VALUES (?, 0, 0, 0, 1)
+	ON CONFLICT(task) DO UPDATE SET evictions = evictions + 1
+	`, task)
+	if err != nil {
+		return fmt.Errorf("cannot record eviction: %w", err)
+	}
+	return nil
+}
+
+// TaskStats returns the counters of every task that was looked up or has
+// cached entries, by task name
+func (s *Store) TaskStats() ([]TaskStats, error) {
+	return s.TaskStatsContext(context.Background())
+}
+
+// TaskStatsContext is TaskStats under ctx
+func (s *Store) TaskStatsContext(ctx context.Context) ([]TaskStats, error) {
+	rows, err := s.withContext(ctx).Query(`
+	SELECT t.task, COALESCE(e.entries, 0), COALESCE(e.size, 0), t.hits, t.misses, t.saved_ms, t.evictions
+	FROM task_stats t
+	LEFT JOIN (SELECT task, COUNT(*) AS entries, SUM(size) AS size FROM cache_entries GROUP BY task) e ON e.task = t.task
+	UNION ALL
+	SELECT task, COUNT(*), SUM(size), 0, 0, 0, 0
+	FROM cache_entries WHERE task NOT IN (SELECT task FROM task_stats) GROUP BY task
+	ORDER BY 1
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get task stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []TaskStats{}
+	for rows.Next() {
+		var t TaskStats
+		if err := rows.Scan(&t.Task, &t.Entries, &t.Size, &t.Hits, &t.Misses, &t.TimeSavedMS, &t.Evictions); err != nil {
+			return nil, fmt.Errorf("cannot get task stats: %w", err)
+		}
+		t.HitRate = hitRate(t.Hits, t.Misses)
+		stats = append(stats, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot get task stats: %w", err)
+	}
+	return stats, nil
+}
+
+// hitRate returns hits / (hits + misses), or 0 before any lookup
+func hitRate(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
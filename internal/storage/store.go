@@ -1,14 +1,20 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/taskvault/taskvault/internal/tracing"
 )
 
 // Entry represents a cached task output
@@ -20,15 +26,37 @@ type Entry struct {
 	AccessedAt time.Time              `json:"accessed_at"`
 	ExpiresAt  *time.Time             `json:"expires_at,omitempty"`
 	Size       int64                  `json:"size"`
+	KeySchema  int                    `json:"key_schema"` // how Hash was derived
+	Task       string                 `json:"task"`
+	Tags       []string               `json:"tags,omitempty"`
+	BlobHash   string                 `json:"blob_hash,omitempty"` // content hash of the stored blob
+	Codec      string                 `json:"codec,omitempty"`     // how the blob is compressed on disk
+	StoredSize int64                  `json:"stored_size,omitempty"`
+	Chunks     []ChunkRef             `json:"chunks,omitempty"` // set for blobs stored as chunks
+
+	HitCount    int64         `json:"hit_count"`
+	ComputeTime time.Duration `json:"compute_time"` // time the task took to produce Data
 }
 
 // Store manages persistent cache storage
 type Store struct {
 	db        *sql.DB
 	blobDir   string
+	chunkDir  string
 	cacheSize int64 // max cache size in bytes
+	strategy  EvictionStrategy
+
+	compression   Compression // for blobs written by NewBlobWriter
+	verify        string      // VerifyFull, VerifyFast or VerifySkip
+	quarantineDir string      // where corrupted blobs are moved
+
+	lock *writeLock // held by write transactions, see begin
 }
 
+// busyTimeout bounds how long a statement outside a write transaction,
+// such as recording a hit, waits for another process's write to finish
+const busyTimeout = 30 * time.Second
+
 // NewStore creates/opens SQLite cache database and blob store
 func NewStore(cacheDir string, maxSizeGB int64) (*Store, error) {
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
@@ -37,12 +65,25 @@ func NewStore(cacheDir string, maxSizeGB int64) (*Store, error) {
 
 	dbPath := filepath.Join(cacheDir, "cache.db")
 	blobDir := filepath.Join(cacheDir, "blobs")
+	chunkDir := filepath.Join(cacheDir, "chunks")
 
 	if err := os.MkdirAll(blobDir, 0755); err != nil {
 		return nil, fmt.Errorf("cannot create blob directory: %w", err)
 	}
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create chunk directory: %w", err)
+	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// Transactions take the write lock up front, so concurrent writers
+	// wait on the busy timeout instead of failing to upgrade a read lock.
+	// Saves and deletes read a blob's refcount before changing it; with
+	// deferred transactions two of them could both read the old count, and
+	// the loser's upgrade fails with SQLITE_BUSY without waiting at all.
+	// WAL lets readers proceed while a save commits, and a crash rolls
+	// back an uncommitted save on the next open.
+	dsn := fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate&_journal_mode=WAL&_synchronous=NORMAL",
+		dbPath, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open database: %w", err)
 	}
@@ -51,125 +92,455 @@ func NewStore(cacheDir string, maxSizeGB int64) (*Store, error) {
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(5)
 
+	lock, err := openWriteLock(filepath.Join(cacheDir, "lock"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	store := &Store{
 		db:        db,
 		blobDir:   blobDir,
+		chunkDir:  chunkDir,
 		cacheSize: maxSizeGB * 1024 * 1024 * 1024,
+		strategy:  LRU{},
+
+		compression:   Compression{Codec: CodecZstd},
+		verify:        VerifyFast,
+		quarantineDir: filepath.Join(cacheDir, "quarantine"),
+
+		lock: lock,
 	}
 
-	if err := store.initSchema(); err != nil {
-		db.Close()
+	// Processes opening a fresh cache at once would otherwise race to
+	// switch it to WAL and create the schema
+	if err := store.lock.Lock(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	err = store.migrate()
+	store.lock.Unlock()
+	if err != nil {
+		store.Close()
 		return nil, fmt.Errorf("cannot initialize schema: %w", err)
 	}
 
 	return store, nil
 }
 
-// initSchema creates cache metadata tables
-func (s *Store) initSchema() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS cache_entries (
-		hash TEXT PRIMARY KEY,
-		metadata TEXT NOT NULL,
-		created_at TIMESTAMP NOT NULL,
-		accessed_at TIMESTAMP NOT NULL,
-		expires_at TIMESTAMP,
-		size INTEGER NOT NULL,
-		blob_path TEXT NOT NULL
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_accessed ON cache_entries(accessed_at);
-	CREATE INDEX IF NOT EXISTS idx_expires ON cache_entries(expires_at);
-	CREATE INDEX IF NOT EXISTS idx_size ON cache_entries(size);
-	`
+// Set stores a cache entry
+func (s *Store) Set(entry *Entry) error {
+	return s.SetStream(entry, bytes.NewReader(entry.Data))
+}
 
-	_, err := s.db.Exec(schema)
-	return err
+// SetStream stores a cache entry whose blob contents are read from r.
+// entry.Data is ignored; entry.Size is set to the number of bytes stored.
+func (s *Store) SetStream(entry *Entry, r io.Reader) error {
+	return s.SetStreamContext(context.Background(), entry, r)
 }
 
-// Set stores a cache entry
-func (s *Store) Set(entry *Entry) error {
-	// Write blob to disk
-	blobPath := filepath.Join(s.blobDir, entry.Hash)
-	if err := os.WriteFile(blobPath, entry.Data, 0644); err != nil {
+// SetStreamContext is SetStream under ctx: reading r fails with ctx's
+// error once ctx is done, and the commit is recorded as in CommitContext
+func (s *Store) SetStreamContext(ctx context.Context, entry *Entry, r io.Reader) error {
+	w, err := s.NewBlobWriter()
+	if err != nil {
+		return err
+	}
+
+	// A seekable source can be read again for chunks that go missing
+	// before the commit
+	seeker, _ := r.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	if _, err := io.Copy(w, ContextReader(ctx, r)); err != nil {
+		w.Abort()
 		return fmt.Errorf("cannot write blob: %w", err)
 	}
 
-	metadataJSON, err := json.Marshal(entry.Metadata)
+	for attempt := 1; ; attempt++ {
+		err := s.CommitContext(ctx, entry, w)
+		var missing *MissingChunksError
+		if !errors.As(err, &missing) {
+			return err
+		}
+		if seeker == nil || attempt == commitAttempts {
+			w.Abort()
+			return err
+		}
+
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			w.Abort()
+			return fmt.Errorf("cannot rewind blob: %w", err)
+		}
+		if err := w.Resupply(ContextReader(ctx, r)); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+}
+
+// commitAttempts bounds how often SetStream resupplies chunks evicted
+// while it commits
+const commitAttempts = 3
+
+// Commit moves a fully written blob into place under its content hash and
+// records the entry pointing at it. Entries with identical contents share
+// one blob, reference counted in the blobs table; the first writer's
+// encoding is kept. The blob writer is consumed whether or not Commit
+// succeeds, except on a *MissingChunksError: chunks the writer skipped
+// because the store had them are gone, and the writer is kept to be given
+// them with Resupply and committed again, or Aborted.
+func (s *Store) Commit(entry *Entry, w *BlobWriter) error {
+	return s.CommitContext(context.Background(), entry, w)
+}
+
+// CommitContext is Commit, recorded as a span in ctx's trace
+func (s *Store) CommitContext(ctx context.Context, entry *Entry, w *BlobWriter) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.commit", tracing.Key.String(entry.Hash), tracing.Size.Int64(w.Size()))
+	defer func() {
+		span.SetAttributes(tracing.Codec.String(entry.Codec), tracing.Stored.Int64(entry.StoredSize))
+		tracing.End(span, err)
+	}()
+
+	entry.Size = w.Size()
+	entry.BlobHash = w.Hash()
+
+	metadataJSON, tagsJSON, err := marshalEntry(entry)
 	if err != nil {
-		os.Remove(blobPath)
-		return fmt.Errorf("cannot marshal metadata: %w", err)
+		w.Abort()
+		return err
+	}
+
+	if err := w.close(); err != nil {
+		return err
 	}
+	defer os.Remove(w.file.Name()) // no-op once renamed
+	retry := false
+	defer func() {
+		if !retry {
+			w.removePending()
+		}
+	}()
 
+	crashPoint("blob_written")
+
+	tx, err := s.beginContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dir := s.blobDir
+	if w.chunker != nil {
+		entry.Chunks = w.chunks
+		dir = s.chunkDir
+		err = s.refChunkedBlob(tx, entry, w.pending)
+	} else {
+		entry.Chunks = nil
+		err = s.refFileBlob(tx, entry, w)
+	}
+	var missing *MissingChunksError
+	if errors.As(err, &missing) {
+		retry = true
+		w.missing = make(map[string]bool)
+		for _, hash := range missing.Hashes {
+			w.missing[hash] = true
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Make the renames durable before the row pointing at them is
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	crashPoint("blob_renamed")
+
+	return s.saveEntry(tx, entry, metadataJSON, tagsJSON)
+}
+
+// saveEntry records entry, whose blob tx already holds a reference on, in
+// place of any entry with the same hash, evicts entries if the cache is
+// over its limit and commits, so a save is applied entirely or not at all
+func (s *Store) saveEntry(tx *storeTx, entry *Entry, metadataJSON, tagsJSON []byte) error {
+	// Replacing an entry drops its reference to the old blob
+	var oldBlob string
+	err := tx.QueryRow(`SELECT blob_hash FROM cache_entries WHERE hash = ?`, entry.Hash).Scan(&oldBlob)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if err := s.insertEntry(tx, entry, metadataJSON, tagsJSON); err != nil {
+		return err
+	}
+
+	if oldBlob != "" {
+		if _, err := s.releaseBlob(tx, oldBlob); err != nil {
+			return err
+		}
+	}
+
+	// Evict entries if cache exceeds limit, never the one just written
+	if err := s.evictIfNeeded(tx, entry.Hash); err != nil {
+		return err
+	}
+	crashPoint("entry_inserted")
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot insert cache entry: %w", err)
+	}
+	crashPoint("committed")
+	return nil
+}
+
+// refFileBlob takes a reference on entry's single-file blob, moving w's
+// file into place unless an existing blob is reused. Sets entry.Codec and
+// entry.StoredSize.
+func (s *Store) refFileBlob(tx *storeTx, entry *Entry, w *BlobWriter) error {
+	blobPath := s.blobPath(entry.BlobHash)
+	entry.Codec = w.codec
+	entry.StoredSize = w.stored.n
+
+	// An existing blob is reused as stored, unless its file went missing
+	var existingCodec string
+	var existingSize int64
+	err := tx.QueryRow(`SELECT codec, size FROM blobs WHERE hash = ?`, entry.BlobHash).Scan(&existingCodec, &existingSize)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("database error: %w", err)
+	}
+	reuse := false
+	if err == nil {
+		if _, statErr := os.Stat(blobPath); statErr == nil {
+			reuse = true
+			entry.Codec = existingCodec
+			entry.StoredSize = existingSize
+		}
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO blobs (hash, size, codec, refcount) VALUES (?, ?, ?, 1)
+	ON CONFLICT(hash) DO UPDATE SET refcount = refcount + 1, size = excluded.size, codec = excluded.codec
+	`, entry.BlobHash, entry.StoredSize, entry.Codec)
+	if err != nil {
+		return fmt.Errorf("cannot reference blob: %w", err)
+	}
+
+	// Entries sharing a blob whose file this one replaces read it with
+	// the new encoding too
+	if !reuse && existingCodec != "" {
+		_, err := tx.Exec(`UPDATE cache_entries SET codec = ?, stored_size = ? WHERE blob_hash = ?`,
+			entry.Codec, entry.StoredSize, entry.BlobHash)
+		if err != nil {
+			return fmt.Errorf("cannot reference blob: %w", err)
+		}
+	}
+
+	// File changes happen while the transaction holds the write lock, so
+	// a concurrent release of the same blob cannot interleave
+	if !reuse {
+		if err := os.Rename(w.file.Name(), blobPath); err != nil {
+			return fmt.Errorf("cannot write blob: %w", err)
+		}
+	}
+	return nil
+}
+
+// marshalEntry encodes an entry's metadata and tags for storage
+func marshalEntry(entry *Entry) (metadataJSON, tagsJSON []byte, err error) {
+	metadataJSON, err = json.Marshal(entry.Metadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot marshal metadata: %w", err)
+	}
+
+	tags := entry.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, err = json.Marshal(tags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot marshal tags: %w", err)
+	}
+	return metadataJSON, tagsJSON, nil
+}
+
+// insertEntry records entry, replacing any entry with the same hash
+func (s *Store) insertEntry(tx *storeTx, entry *Entry, metadataJSON, tagsJSON []byte) error {
 	stmt := `
 	INSERT OR REPLACE INTO cache_entries 
-	(hash, metadata, created_at, accessed_at, expires_at, size, blob_path)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	(hash, metadata, created_at, accessed_at, expires_at, size, blob_path, blob_hash, content_hash, codec, stored_size, key_schema, compute_ms, task, tags)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err = s.db.Exec(stmt,
+	keySchema := entry.KeySchema
+	if keySchema == 0 {
+		keySchema = 1
+	}
+
+	// Chunked blobs have no file of their own
+	blobPath := ""
+	if entry.Codec != CodecChunked {
+		blobPath = s.blobPath(entry.BlobHash)
+	}
+
+	// Timestamps are stored in UTC so they compare correctly as text
+	var expiresAt *time.Time
+	if entry.ExpiresAt != nil {
+		utc := entry.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+
+	_, err := tx.Exec(stmt,
 		entry.Hash,
 		string(metadataJSON),
-		entry.CreatedAt,
-		entry.AccessedAt,
-		entry.ExpiresAt,
+		entry.CreatedAt.UTC(),
+		entry.AccessedAt.UTC(),
+		expiresAt,
 		entry.Size,
 		blobPath,
+		entry.BlobHash,
+		entry.BlobHash, // blobs are keyed by their content hash
+		entry.Codec,
+		entry.StoredSize,
+		keySchema,
+		entry.ComputeTime.Milliseconds(),
+		entry.Task,
+		string(tagsJSON),
 	)
-
 	if err != nil {
-		os.Remove(blobPath)
 		return fmt.Errorf("cannot insert cache entry: %w", err)
 	}
-
-	// Evict old entries if cache exceeds limit
-	return s.evictIfNeeded()
+	return nil
 }
 
-// Get retrieves a cache entry
+// Get retrieves a cache entry with its blob loaded into Data
 func (s *Store) Get(hash string) (*Entry, error) {
+	return s.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get under ctx, see OpenContext
+func (s *Store) GetContext(ctx context.Context, hash string) (*Entry, error) {
+	entry, blob, err := s.OpenContext(ctx, hash)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		blob.Close()
+		return nil, fmt.Errorf("cannot read blob: %w", err)
+	}
+	if err := blob.Close(); err != nil {
+		return nil, err
+	}
+
+	entry.Data = data
+	return entry, nil
+}
+
+// Open retrieves a cache entry and an open reader over its blob, which the
+// caller must close. The hit is recorded when a blob read to the end is
+// closed. entry.Data is not populated. Returns nil, nil, nil on a cache
+// miss.
+func (s *Store) Open(hash string) (*Entry, io.ReadCloser, error) {
+	return s.OpenContext(context.Background(), hash)
+}
+
+// OpenContext is Open under ctx, recorded as spans in ctx's trace: one for
+// the lookup, and one for reading the blob that ends when it is closed.
+// Reads from the blob fail with ctx's error once ctx is done.
+func (s *Store) OpenContext(ctx context.Context, hash string) (*Entry, io.ReadCloser, error) {
+	return s.open(ctx, hash, true)
+}
+
+// Peek is like Open but leaves the access time and hit count untouched, for
+// reads that are not cache hits (e.g. pushing an entry to a remote)
+func (s *Store) Peek(hash string) (*Entry, io.ReadCloser, error) {
+	return s.open(context.Background(), hash, false)
+}
+
+func (s *Store) open(ctx context.Context, hash string, touch bool) (entry *Entry, blob io.ReadCloser, err error) {
+	openCtx, span := tracing.Start(ctx, "storage.open", tracing.Key.String(hash))
+	defer func() {
+		span.SetAttributes(tracing.Hit.Bool(entry != nil))
+		if entry != nil {
+			span.SetAttributes(tracing.Size.Int64(entry.Size), tracing.Stored.Int64(entry.StoredSize), tracing.Codec.String(entry.Codec))
+			blob = traceRead(ctx, readContext(ctx, blob), entry)
+		}
+		tracing.End(span, err)
+	}()
+
 	stmt := `
-	SELECT metadata, created_at, accessed_at, expires_at, size, blob_path
+	SELECT metadata, created_at, accessed_at, expires_at, size, blob_path, blob_hash, content_hash, codec, stored_size, key_schema, hit_count, compute_ms, task, tags
 	FROM cache_entries
 	WHERE hash = ? AND (expires_at IS NULL OR expires_at > datetime('now'))
 	`
 
 	var metadataJSON string
-	var blobPath string
+	var blobPath, blobHash, contentHash, codec string
+	var storedSize int64
 	var createdAt, accessedAt time.Time
 	var expiresAt sql.NullTime
 	var size int64
+	var keySchema int
+	var hitCount, computeMS int64
+	var task, tagsJSON string
 
-	err := s.db.QueryRow(stmt, hash).Scan(
-		&metadataJSON, &createdAt, &accessedAt, &expiresAt, &size, &blobPath,
+	err = s.withContext(ctx).QueryRow(stmt, hash).Scan(
+		&metadataJSON, &createdAt, &accessedAt, &expiresAt, &size, &blobPath, &blobHash, &contentHash, &codec, &storedSize, &keySchema, &hitCount, &computeMS, &task, &tagsJSON,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, nil // Cache miss
+		return nil, nil, nil // Cache miss
 	}
 	if err != nil {
-		return nil, fmt.Errorf("database error: %w", err)
+		return nil, nil, fmt.Errorf("database error: %w", err)
 	}
 
-	// Read blob
-	data, err := os.ReadFile(blobPath)
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return nil, nil, fmt.Errorf("cannot unmarshal metadata: %w", err)
+	}
+
+	var tags []string
+	if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
+		return nil, nil, fmt.Errorf("cannot unmarshal tags: %w", err)
+	}
+
+	// Open blob; full verification reads it entirely here
+	_, blobSpan := tracing.Start(openCtx, "storage.blob_open", tracing.Codec.String(codec), tracing.Stored.Int64(storedSize))
+	blob, chunks, err := s.openBlob(ctx, blobRef{
+		hash:        blobHash,
+		path:        blobPath,
+		codec:       codec,
+		contentHash: contentHash,
+		size:        size,
+		storedSize:  storedSize,
+	}, s.verify)
+	tracing.End(blobSpan, err)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	if blob == nil {
 		// Blob missing but metadata exists - corrupted cache
 		if delErr := s.Delete(hash); delErr != nil {
-			return nil, fmt.Errorf("cannot delete corrupted entry: %w", delErr)
+			return nil, nil, fmt.Errorf("cannot delete corrupted entry: %w", delErr)
 		}
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	var metadata map[string]interface{}
-	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
-		return nil, fmt.Errorf("cannot unmarshal metadata: %w", err)
-	}
-
-	// Update access time
-	updateStmt := `UPDATE cache_entries SET accessed_at = datetime('now') WHERE hash = ?`
-	if _, err := s.db.Exec(updateStmt, hash); err != nil {
-		return nil, fmt.Errorf("cannot update access time: %w", err)
+	// Counted as a hit once the blob is read through and verified; the
+	// entry returned already reflects it
+	if touch {
+		accessedAt = time.Now().UTC()
+		hitCount++
+		blob = &hitReader{ReadCloser: blob, ctx: context.WithoutCancel(ctx), store: s, hash: hash, at: accessedAt}
 	}
 
 	expiresAtPtr := (*time.Time)(nil)
@@ -179,105 +550,275 @@ func (s *Store) Get(hash string) (*Entry, error) {
 
 	return &Entry{
 		Hash:       hash,
-		Data:       data,
 		Metadata:   metadata,
 		CreatedAt:  createdAt,
-		AccessedAt: time.Now(),
+		AccessedAt: accessedAt,
 		ExpiresAt:  expiresAtPtr,
 		Size:       size,
-	}, nil
+		KeySchema:  keySchema,
+		Task:       task,
+		Tags:       tags,
+		BlobHash:   blobHash,
+		Codec:      codec,
+		StoredSize: storedSize,
+		Chunks:     chunks,
+
+		HitCount:    hitCount,
+		ComputeTime: time.Duration(computeMS) * time.Millisecond,
+	}, blob, nil
+}
+
+// hitReader records a hit on an entry once its blob has been read to the
+// end, past any verification, and closed. A blob abandoned early or found
+// corrupt is not a hit.
+type hitReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	store *Store
+	hash  string
+	at    time.Time
+	eof   bool
+}
+
+func (r *hitReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *hitReader) Close() error {
+	err := r.ReadCloser.Close()
+	if !r.eof {
+		return err
+	}
+	r.eof = false // once, should Close be called again
+
+	if hitErr := r.store.recordHit(r.ctx, r.hash, r.at); hitErr != nil && err == nil {
+		err = hitErr
+	}
+	return err
+}
+
+// Touch records a hit on an entry read without Open, updating its access
+// time and hit count
+func (s *Store) Touch(hash string) error {
+	return s.recordHit(context.Background(), hash, time.Now().UTC())
 }
 
-// Delete removes a cache entry
+// Delete removes a cache entry, and its blob once no other entry uses it
 func (s *Store) Delete(hash string) error {
-	stmt := `SELECT blob_path FROM cache_entries WHERE hash = ?`
-	var blobPath string
+	return s.DeleteContext(context.Background(), hash)
+}
+
+// DeleteContext is Delete under ctx, which also bounds the wait for the
+// write lock
+func (s *Store) DeleteContext(ctx context.Context, hash string) error {
+	_, err := s.remove(ctx, hash)
+	return err
+}
+
+// remove deletes an entry and returns the number of bytes freed on disk,
+// which is zero when its blob is still shared
+func (s *Store) remove(ctx context.Context, hash string) (int64, error) {
+	tx, err := s.beginContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	err := s.db.QueryRow(stmt, hash).Scan(&blobPath)
+	freed, err := s.removeTx(tx, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("cannot delete entry: %w", err)
+	}
+	return freed, nil
+}
+
+// removeTx deletes an entry within tx, see remove
+func (s *Store) removeTx(tx *storeTx, hash string) (int64, error) {
+	var blobHash string
+	err := tx.QueryRow(`SELECT blob_hash FROM cache_entries WHERE hash = ?`, hash).Scan(&blobHash)
 	if err == sql.ErrNoRows {
-		return nil
+		return 0, nil
 	}
 	if err != nil {
-		return fmt.Errorf("database error: %w", err)
+		return 0, fmt.Errorf("database error: %w", err)
 	}
 
 	// Remove from database
-	deleteStmt := `DELETE FROM cache_entries WHERE hash = ?`
-	if _, err := s.db.Exec(deleteStmt, hash); err != nil {
-		return fmt.Errorf("cannot delete entry: %w", err)
+	if _, err := tx.Exec(`DELETE FROM cache_entries WHERE hash = ?`, hash); err != nil {
+		return 0, fmt.Errorf("cannot delete entry: %w", err)
 	}
 
-	// Remove blob file
-	if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("cannot remove blob: %w", err)
-	}
-	return nil
+	return s.releaseBlob(tx, blobHash)
 }
 
-// evictIfNeeded removes least-recently-used entries if cache exceeds limit
-func (s *Store) evictIfNeeded() error {
-	var totalSize int64
-	err := s.db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM cache_entries`).Scan(&totalSize)
+// releaseBlob drops one reference to a blob, removing the blob file once tx
+// commits when it was the last one. Returns the bytes freed.
+func (s *Store) releaseBlob(tx *storeTx, blobHash string) (int64, error) {
+	if _, err := tx.Exec(`UPDATE blobs SET refcount = refcount - 1 WHERE hash = ?`, blobHash); err != nil {
+		return 0, fmt.Errorf("cannot release blob: %w", err)
+	}
+
+	var refcount, size int64
+	var codec string
+	err := tx.QueryRow(`SELECT refcount, size, codec FROM blobs WHERE hash = ?`, blobHash).Scan(&refcount, &size, &codec)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 	if err != nil {
-		return fmt.Errorf("cannot calculate cache size: %w", err)
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if refcount > 0 {
+		return 0, nil
 	}
 
-	if totalSize <= s.cacheSize {
-		return nil
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE hash = ?`, blobHash); err != nil {
+		return 0, fmt.Errorf("cannot release blob: %w", err)
 	}
 
-	// Remove oldest accessed entries until under limit
-	targetSize := s.cacheSize / 2 // Keep 50% to avoid thrashing
+	if codec == CodecChunked {
+		return s.releaseChunks(tx, blobHash)
+	}
 
-	stmt := `
-	SELECT hash, size FROM cache_entries
-	ORDER BY accessed_at ASC
-	`
+	tx.release(s.blobPath(blobHash))
+	return size, nil
+}
 
-	rows, err := s.db.Query(stmt)
+// TaskFilter narrows which of a task's entries DeleteTask removes
+type TaskFilter struct {
+	CreatedBefore time.Time // zero means any age
+	Tag           string    // empty means any tags
+}
+
+// DeleteTask removes a task's entries (rows and blobs) matching filter,
+// returning the number removed
+func (s *Store) DeleteTask(task string, filter TaskFilter) (int, error) {
+	return s.DeleteTaskContext(context.Background(), task, filter)
+}
+
+// DeleteTaskContext is DeleteTask under ctx. Entries removed before ctx is
+// done stay removed, and are counted.
+func (s *Store) DeleteTaskContext(ctx context.Context, task string, filter TaskFilter) (int, error) {
+	stmt := `SELECT hash FROM cache_entries WHERE task = ?`
+	args := []interface{}{task}
+
+	if !filter.CreatedBefore.IsZero() {
+		stmt += ` AND created_at < ?`
+		args = append(args, filter.CreatedBefore.UTC())
+	}
+	if filter.Tag != "" {
+		stmt += ` AND EXISTS (SELECT 1 FROM json_each(cache_entries.tags) WHERE value = ?)`
+		args = append(args, filter.Tag)
+	}
+
+	rows, err := s.withContext(ctx).Query(stmt, args...)
 	if err != nil {
-		return fmt.Errorf("cannot query entries: %w", err)
+		return 0, fmt.Errorf("cannot query entries: %w", err)
 	}
-	defer rows.Close()
 
-	for rows.Next() && totalSize > targetSize {
+	var hashes []string
+	for rows.Next() {
 		var hash string
-		var size int64
-
-		if err := rows.Scan(&hash, &size); err != nil {
-			continue
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("cannot scan entry: %w", err)
 		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
 
-		if err := s.Delete(hash); err != nil {
-			continue
+	for i, hash := range hashes {
+		if _, err := s.remove(ctx, hash); err != nil {
+			return i, err
 		}
-
-		totalSize -= size
 	}
 
-	return nil
+	return len(hashes), nil
 }
 
-// Stats returns cache statistics
+// Stats returns cache statistics. total_size is what blobs and chunks
+// occupy on disk after compression; logical_size is the uncompressed size
+// counting shared blobs once per entry using them.
 func (s *Store) Stats() (map[string]interface{}, error) {
+	return s.StatsContext(context.Background())
+}
+
+// StatsContext is Stats under ctx
+func (s *Store) StatsContext(ctx context.Context) (map[string]interface{}, error) {
+	db := s.withContext(ctx)
+
 	var count int64
-	var totalSize int64
+	var logicalSize int64
 	var oldestAccess sql.NullString
 
-	err := s.db.QueryRow(`
+	err := db.QueryRow(`
 	SELECT COUNT(*), COALESCE(SUM(size), 0), MIN(accessed_at)
 	FROM cache_entries
-	`).Scan(&count, &totalSize, &oldestAccess)
+	`).Scan(&count, &logicalSize, &oldestAccess)
 
 	if err != nil {
 		return nil, fmt.Errorf("cannot get stats: %w", err)
 	}
 
+	var blobs, chunks int64
+	err = db.QueryRow(`SELECT (SELECT COUNT(*) FROM blobs), (SELECT COUNT(*) FROM chunks)`).Scan(&blobs, &chunks)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get stats: %w", err)
+	}
+
+	totalSize, err := s.diskUsage(db)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get stats: %w", err)
+	}
+
+	// Uncompressed size of each distinct blob, counting each distinct
+	// chunk once
+	var uniqueSize int64
+	err = db.QueryRow(`
+	SELECT COALESCE((SELECT SUM(size) FROM (
+		SELECT MAX(size) AS size FROM cache_entries WHERE codec != ? GROUP BY blob_hash
+	)), 0) + (SELECT COALESCE(SUM(size), 0) FROM chunks)
+	`, CodecChunked).Scan(&uniqueSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get stats: %w", err)
+	}
+
+	var hits, misses, savedMS int64
+	err = db.QueryRow(`
+	SELECT COALESCE(SUM(hits), 0), COALESCE(SUM(misses), 0), COALESCE(SUM(saved_ms), 0) FROM task_stats
+	`).Scan(&hits, &misses, &savedMS)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get stats: %w", err)
+	}
+
+	dedupRatio, compressionRatio := 1.0, 1.0
+	if uniqueSize > 0 {
+		dedupRatio = float64(logicalSize) / float64(uniqueSize)
+	}
+	if totalSize > 0 {
+		compressionRatio = float64(uniqueSize) / float64(totalSize)
+	}
+
 	stats := map[string]interface{}{
-		"entries":       count,
-		"total_size":    totalSize,
-		"cache_limit":   s.cacheSize,
-		"usage_percent": float64(totalSize) / float64(s.cacheSize) * 100,
+		"entries":           count,
+		"blobs":             blobs,
+		"chunks":            chunks,
+		"total_size":        totalSize,
+		"logical_size":      logicalSize,
+		"dedup_ratio":       dedupRatio,
+		"compression_ratio": compressionRatio,
+		"cache_limit":       s.cacheSize,
+		"usage_percent":     float64(totalSize) / float64(s.cacheSize) * 100,
+		"hits":              hits,
+		"misses":            misses,
+		"hit_rate":          hitRate(hits, misses),
+		"time_saved_ms":     savedMS,
 	}
 
 	if oldestAccess.Valid {
@@ -287,7 +828,66 @@ func (s *Store) Stats() (map[string]interface{}, error) {
 	return stats, nil
 }
 
-// Close cleanly closes the database connection
+// querier is satisfied by *sql.DB, *storeTx and contextDB
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// diskUsage returns the bytes blobs and chunks occupy on disk. Chunked
+// blobs take no space themselves; their chunks do.
+func (s *Store) diskUsage(q querier) (int64, error) {
+	var size int64
+	err := q.QueryRow(`
+	SELECT (SELECT COALESCE(SUM(size), 0) FROM blobs) + (SELECT COALESCE(SUM(stored_size), 0) FROM chunks)
+	`).Scan(&size)
+	return size, err
+}
+
+// Close cleanly closes the database connection, once a write in flight in
+// this process has finished
 func (s *Store) Close() error {
-	return s.db.Close()
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext is Close, waiting for a write in flight only until ctx is
+// done. It then returns ctx's error and leaves the store open.
+func (s *Store) CloseContext(ctx context.Context) error {
+	if err := s.lock.hold(ctx); err != nil {
+		return fmt.Errorf("cannot close store: %w", err)
+	}
+	defer s.lock.release()
+
+	err := s.db.Close()
+	s.lock.Close()
+	return err
+}
+
+// syncDir flushes a directory so renames into it survive a crash. Windows
+// cannot sync directories and orders renames itself.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot sync %s: %w", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// crashHook, when set by tests, is called at each step of a save so a
+// crash can be simulated there
+var crashHook func(step string)
+
+func crashPoint(step string) {
+	if crashHook != nil {
+		crashHook(step)
+	}
 }
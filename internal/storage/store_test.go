@@ -0,0 +1,567 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := NewStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// putEntry stores an entry with contents unique to hash and then overrides
+// its bookkeeping columns
+func putEntry(t *testing.T, s *Store, hash string, size int, created, accessed time.Time, hits int64, compute time.Duration) {
+	t.Helper()
+
+	entry := &Entry{
+		Hash:        hash,
+		Data:        []byte(strings.Repeat(hash, size)[:size]),
+		Task:        "t",
+		Metadata:    map[string]interface{}{"task": "t"},
+		CreatedAt:   created,
+		AccessedAt:  accessed,
+		ComputeTime: compute,
+	}
+	if err := s.Set(entry); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	if _, err := s.db.Exec(`UPDATE cache_entries SET hit_count = ? WHERE hash = ?`, hits, hash); err != nil {
+		t.Fatalf("update error: %v", err)
+	}
+}
+
+func TestEvictionStrategies(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	hour := time.Hour
+
+	tests := []struct {
+		strategy EvictionStrategy
+		victim   string
+	}{
+		// "old" was created first, "stale" accessed longest ago,
+		// "cold" hit least often, "cheap" is cheapest to recompute per byte
+		{LRU{}, "stale"},
+		{FIFO{}, "old"},
+		{LFU{}, "cold"},
+		{CostAware{}, "cheap"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy.Name(), func(t *testing.T) {
+			store := newTestStore(t)
+
+			putEntry(t, store, "old", 100, base, base.Add(5*hour), 5, 10*time.Second)
+			putEntry(t, store, "stale", 100, base.Add(hour), base.Add(hour), 5, 10*time.Second)
+			putEntry(t, store, "cold", 100, base.Add(2*hour), base.Add(6*hour), 1, 10*time.Second)
+			putEntry(t, store, "cheap", 100, base.Add(3*hour), base.Add(7*hour), 5, time.Millisecond)
+
+			evicted, err := store.EvictTask("t", 300, tt.strategy, "")
+			if err != nil {
+				t.Fatalf("evict error: %v", err)
+			}
+			if evicted != 1 {
+				t.Fatalf("expected 1 eviction, got %d", evicted)
+			}
+
+			entry, err := store.Get(tt.victim)
+			if err != nil {
+				t.Fatalf("get error: %v", err)
+			}
+			if entry != nil {
+				t.Errorf("expected %s to be evicted", tt.victim)
+			}
+		})
+	}
+}
+
+func TestEvictionKeepsNewestEntry(t *testing.T) {
+	store := newTestStore(t)
+	store.cacheSize = 250
+	store.SetEvictionStrategy(LFU{})
+
+	now := time.Now()
+	putEntry(t, store, "a", 100, now, now, 3, 0)
+	putEntry(t, store, "b", 100, now, now, 3, 0)
+
+	// The fresh entry has no hits yet but must not evict itself
+	putEntry(t, store, "c", 100, now, now, 0, 0)
+
+	if entry, _ := store.Get("c"); entry == nil {
+		t.Errorf("expected newly written entry to survive eviction")
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if stats["total_size"].(int64) > 200 {
+		t.Errorf("expected cache to be evicted below its limit, got %v", stats["total_size"])
+	}
+}
+
+func TestStrategyByName(t *testing.T) {
+	for _, name := range []string{"", "lru", "lfu", "fifo", "cost"} {
+		if _, err := StrategyByName(name); err != nil {
+			t.Errorf("unexpected error for %q: %v", name, err)
+		}
+	}
+	if _, err := StrategyByName("random"); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+func TestIdenticalOutputsShareBlob(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	for _, hash := range []string{"a", "b"} {
+		entry := &Entry{Hash: hash, Data: []byte("same output"), CreatedAt: now, AccessedAt: now}
+		if err := store.Set(entry); err != nil {
+			t.Fatalf("set error: %v", err)
+		}
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(store.blobDir, "[0-9a-f]*"))
+	if len(blobs) != 1 {
+		t.Fatalf("expected one shared blob file, got %d", len(blobs))
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if stats["logical_size"] != int64(22) || stats["total_size"] != int64(11) || stats["dedup_ratio"] != 2.0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	// The blob survives until its last entry is gone
+	if err := store.Delete("a"); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if entry, _ := store.Get("b"); entry == nil || string(entry.Data) != "same output" {
+		t.Fatalf("expected b to still read its shared blob")
+	}
+
+	// Overwriting b with new contents releases the old blob
+	if err := store.Set(&Entry{Hash: "b", Data: []byte("new"), CreatedAt: now, AccessedAt: now}); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	if _, err := os.Stat(blobs[0]); !os.IsNotExist(err) {
+		t.Errorf("expected unreferenced blob to be removed")
+	}
+
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if stats, _ := store.Stats(); stats["blobs"] != int64(0) || stats["total_size"] != int64(0) {
+		t.Errorf("expected no blobs left, got %v", stats)
+	}
+}
+
+func TestBlobCompression(t *testing.T) {
+	report := []byte(strings.Repeat(`{"file":"main.go","status":"ok"}`+"\n", 1000))
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(report)
+	zw.Close()
+
+	tests := []struct {
+		name   string
+		codec  string
+		data   []byte
+		stored string // codec expected on disk
+	}{
+		{"zstd", CodecZstd, report, CodecZstd},
+		{"gzip", CodecGzip, report, CodecGzip},
+		{"none", CodecNone, report, CodecNone},
+		{"already compressed", CodecZstd, gzipped.Bytes(), CodecNone},
+		{"tiny", CodecZstd, []byte("ok"), CodecNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+
+			w, err := store.NewCompressedBlobWriter(Compression{Codec: tt.codec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(tt.data)
+			now := time.Now()
+			entry := &Entry{Hash: "h", CreatedAt: now, AccessedAt: now}
+			if err := store.Commit(entry, w); err != nil {
+				t.Fatalf("commit error: %v", err)
+			}
+
+			got, err := store.Get("h")
+			if err != nil || got == nil {
+				t.Fatalf("expected entry, got %v", err)
+			}
+			if !bytes.Equal(got.Data, tt.data) {
+				t.Errorf("blob did not round trip")
+			}
+			if got.Codec != tt.stored || got.Size != int64(len(tt.data)) {
+				t.Errorf("expected codec %s and size %d, got %s and %d", tt.stored, len(tt.data), got.Codec, got.Size)
+			}
+
+			info, err := os.Stat(store.blobPath(got.BlobHash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != got.StoredSize {
+				t.Errorf("stored size %d does not match file size %d", got.StoredSize, info.Size())
+			}
+			if tt.stored != CodecNone && got.StoredSize*5 > got.Size {
+				t.Errorf("expected at least 5x compression, got %d -> %d", got.Size, got.StoredSize)
+			}
+		})
+	}
+}
+
+// randomBlob returns size bytes of incompressible data
+func randomBlob(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestLargeBlobsShareChunks(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	// v2 is v1 with a few bytes inserted in the middle
+	v1 := randomBlob(1, 24<<20)
+	v2 := append(append(append([]byte{}, v1[:12<<20]...), "edit"...), v1[12<<20:]...)
+
+	chunks := make(map[string][]ChunkRef)
+	for hash, data := range map[string][]byte{"v1": v1, "v2": v2} {
+		entry := &Entry{Hash: hash, CreatedAt: now, AccessedAt: now}
+		if err := store.SetStream(entry, bytes.NewReader(data)); err != nil {
+			t.Fatalf("set error: %v", err)
+		}
+
+		got, err := store.Get(hash)
+		if err != nil || got == nil {
+			t.Fatalf("expected entry, got %v", err)
+		}
+		if !bytes.Equal(got.Data, data) {
+			t.Fatalf("%s did not round trip", hash)
+		}
+		if got.Codec != CodecChunked || len(got.Chunks) < 2 {
+			t.Fatalf("expected %s to be chunked, got codec %s with %d chunks", hash, got.Codec, len(got.Chunks))
+		}
+		for i, chunk := range got.Chunks {
+			if chunk.Size > cdcMaxSize || (chunk.Size < cdcMinSize && i < len(got.Chunks)-1) {
+				t.Errorf("chunk %d of %s has size %d", i, hash, chunk.Size)
+			}
+		}
+		chunks[hash] = got.Chunks
+	}
+
+	// Only the chunks around the edit differ
+	shared := make(map[string]bool)
+	for _, chunk := range chunks["v1"] {
+		shared[chunk.Hash] = true
+	}
+	changed := 0
+	for _, chunk := range chunks["v2"] {
+		if !shared[chunk.Hash] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("expected 1-2 new chunks after a small edit, got %d of %d", changed, len(chunks["v2"]))
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if stats["chunks"] != int64(len(chunks["v1"])+changed) {
+		t.Errorf("expected %d chunks, got %v", len(chunks["v1"])+changed, stats["chunks"])
+	}
+	if total := stats["total_size"].(int64); total > int64(len(v1))+2*cdcMaxSize {
+		t.Errorf("expected shared chunks to be stored once, total size %d", total)
+	}
+
+	// Chunks are removed once no blob uses them
+	if err := store.Delete("v1"); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	if entry, _ := store.Get("v2"); entry == nil || !bytes.Equal(entry.Data, v2) {
+		t.Fatalf("expected v2 to still read its shared chunks")
+	}
+	if err := store.Delete("v2"); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(store.chunkDir, "*"))
+	if stats, _ := store.Stats(); stats["chunks"] != int64(0) || stats["total_size"] != int64(0) || len(files) != 0 {
+		t.Errorf("expected no chunks left, got %v and %d files", stats, len(files))
+	}
+}
+
+func TestCommitReplacesChunksRemovedMeanwhile(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+	data := randomBlob(2, 12<<20)
+
+	if err := store.SetStream(&Entry{Hash: "old", CreatedAt: now, AccessedAt: now}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+
+	// The chunks exist while the blob is written, so none is written again
+	w, err := store.NewBlobWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(store.chunkDir, ".tmp-*")); len(tmp) != 0 {
+		t.Fatalf("expected stored chunks to be skipped, got %d written", len(tmp))
+	}
+
+	// but they are gone at commit, which asks for them again
+	if err := store.Delete("old"); err != nil {
+		t.Fatalf("delete error: %v", err)
+	}
+	entry := &Entry{Hash: "new", CreatedAt: now, AccessedAt: now}
+	err = store.Commit(entry, w)
+	var missing *MissingChunksError
+	if !errors.As(err, &missing) || !errors.Is(err, ErrChunkMissing) {
+		t.Fatalf("expected missing chunks, got %v", err)
+	}
+	if len(missing.Hashes) == 0 {
+		t.Fatal("expected the missing chunks to be listed")
+	}
+	before, _ := filepath.Glob(filepath.Join(store.chunkDir, ".tmp-*"))
+	if err := w.Resupply(bytes.NewReader(data)); err != nil {
+		t.Fatalf("resupply error: %v", err)
+	}
+	if after, _ := filepath.Glob(filepath.Join(store.chunkDir, ".tmp-*")); len(after)-len(before) != len(missing.Hashes) {
+		t.Fatalf("expected only the %d missing chunks to be written, got %d", len(missing.Hashes), len(after)-len(before))
+	}
+	if err := store.Commit(entry, w); err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	if entry, err := store.Get("new"); err != nil || entry == nil || !bytes.Equal(entry.Data, data) {
+		t.Fatalf("expected new to read back, got %v", err)
+	}
+
+	// A stored blob whose chunk file is gone gets it back from the next save
+	entry, _ = store.Get("new")
+	os.Remove(store.chunkPath(entry.Chunks[0].Hash))
+	if err := store.SetStream(&Entry{Hash: "again", CreatedAt: now, AccessedAt: now}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	for _, hash := range []string{"new", "again"} {
+		if entry, err := store.Get(hash); err != nil || entry == nil || !bytes.Equal(entry.Data, data) {
+			t.Fatalf("expected %s to read back, got %v", hash, err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(store.chunkDir, "*"))
+	if stats, _ := store.Stats(); stats["chunks"] != int64(len(files)) {
+		t.Errorf("expected no pending chunk files left, got %d files for %v chunks", len(files), stats["chunks"])
+	}
+}
+
+func TestTaskStatsOutliveEntries(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+	putEntry(t, s, "a", 10, now, now, 0, 2*time.Second)
+
+	for i := 0; i < 3; i++ {
+		if entry, err := s.Get("a"); err != nil || entry == nil {
+			t.Fatalf("get error: %v", err)
+		}
+	}
+	if err := s.RecordMiss("t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := s.TaskStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("expected one task, got %+v", tasks)
+	}
+	if got := tasks[0]; got.Entries != 0 || got.Hits != 3 || got.Misses != 1 || got.HitRate != 0.75 || got.TimeSavedMS != 6000 {
+		t.Errorf("unexpected task stats: %+v", got)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["hits"] != int64(3) || stats["misses"] != int64(1) || stats["time_saved_ms"] != int64(6000) {
+		t.Errorf("unexpected totals: %v", stats)
+	}
+}
+
+func TestContextEndsOperations(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+	putEntry(t, s, "a", 10, now, now, 0, 0)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := s.OpenContext(cancelled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected open to fail with context.Canceled, got %v", err)
+	}
+	if _, err := s.StatsContext(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected stats to fail with context.Canceled, got %v", err)
+	}
+	if _, err := s.DeleteTaskContext(cancelled, "t", TaskFilter{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected delete to fail with context.Canceled, got %v", err)
+	}
+	if _, err := s.GetContext(cancelled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected get to fail with context.Canceled, got %v", err)
+	}
+	if err := s.SetStreamContext(cancelled, &Entry{Hash: "b", CreatedAt: now, AccessedAt: now}, strings.NewReader("b")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected set to fail with context.Canceled, got %v", err)
+	}
+	if err := s.DeleteContext(cancelled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected delete to fail with context.Canceled, got %v", err)
+	}
+	if err := s.RecordMissContext(cancelled, "t"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected recording a miss to fail with context.Canceled, got %v", err)
+	}
+	if err := s.ReleaseLeaseContext(cancelled, "k", "me"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected releasing a lease to fail with context.Canceled, got %v", err)
+	}
+
+	// A blob opened in time stops reading once its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	entry, blob, err := s.OpenContext(ctx, "a")
+	if err != nil || entry == nil {
+		t.Fatalf("expected the entry to survive, got %v, %v", entry, err)
+	}
+	defer blob.Close()
+	cancel()
+	if _, err := io.ReadAll(blob); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected reading to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestLockWaitEndsWithContext(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir, 1)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	defer s.Close()
+
+	// Another handle on the lock file stands in for another process
+	other, err := openWriteLock(filepath.Join(dir, "lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.AcquireLeaseContext(ctx, "k", "me", time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lease to fail with context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestCloseWaitEndsWithContext(t *testing.T) {
+	s := newTestStore(t)
+
+	tx, err := s.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected close to fail with context.DeadlineExceeded, got %v", err)
+	}
+	tx.Rollback()
+
+	// Left open
+	now := time.Now()
+	if err := s.Set(&Entry{Hash: "a", Data: []byte("a"), CreatedAt: now, AccessedAt: now}); err != nil {
+		t.Fatalf("expected the store to stay open, got %v", err)
+	}
+}
+
+func TestCompressionByNameLevels(t *testing.T) {
+	for _, tt := range []struct {
+		codec string
+		level int
+		ok    bool
+	}{
+		{CodecZstd, 0, true},
+		{CodecZstd, 22, true},
+		{CodecZstd, 23, false},
+		{CodecGzip, 9, true},
+		{CodecGzip, -1, false},
+		{"lz4", 0, false},
+	} {
+		if _, err := CompressionByName(tt.codec, tt.level); (err == nil) != tt.ok {
+			t.Errorf("%s level %d: expected ok=%v, got %v", tt.codec, tt.level, tt.ok, err)
+		}
+	}
+}
+
+func TestReplacedBlobFileServesSiblingEntries(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+	data := []byte(strings.Repeat("shared output\n", 1000))
+
+	s.SetCompression(Compression{Codec: CodecGzip})
+	for _, hash := range []string{"a", "b"} {
+		if err := s.SetStream(&Entry{Hash: hash, CreatedAt: now, AccessedAt: now}, bytes.NewReader(data)); err != nil {
+			t.Fatalf("set error: %v", err)
+		}
+	}
+
+	entry, _ := s.Lookup("a")
+	if err := os.Remove(s.blobPath(entry.BlobHash)); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCompression(Compression{Codec: CodecZstd})
+	if err := s.SetStream(&Entry{Hash: "a", CreatedAt: now, AccessedAt: now}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+
+	for _, hash := range []string{"a", "b"} {
+		got, err := s.Get(hash)
+		if err != nil || got == nil || !bytes.Equal(got.Data, data) {
+			t.Fatalf("expected %s to read back, got %v", hash, err)
+		}
+		if got.Codec != CodecZstd {
+			t.Errorf("expected %s to use the replaced file's codec, got %s", hash, got.Codec)
+		}
+	}
+}
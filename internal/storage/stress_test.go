@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The stress test re-runs the test binary as several worker processes
+// sharing one cache directory, as parallel CI jobs on one runner do
+const (
+	stressDirEnv    = "TASKVAULT_STRESS_DIR"
+	stressWorkerEnv = "TASKVAULT_STRESS_WORKER"
+
+	stressWorkers = 8
+	stressOps     = 60
+	stressKeys    = 20
+	stressSize    = 200 << 10
+)
+
+func TestConcurrentProcesses(t *testing.T) {
+	if dir := os.Getenv(stressDirEnv); dir != "" {
+		worker, _ := strconv.Atoi(os.Getenv(stressWorkerEnv))
+		if err := runStressWorker(dir, worker); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if testing.Short() {
+		t.Skip("spawns worker processes")
+	}
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestConcurrentProcesses$")
+			cmd.Env = append(os.Environ(), stressDirEnv+"="+dir, stressWorkerEnv+"="+strconv.Itoa(worker))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				errs <- fmt.Errorf("worker %d: %v\n%s", worker, err, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	store, err := NewStore(dir, 1)
+	if err != nil {
+		t.Fatalf("cannot reopen store: %v", err)
+	}
+	defer store.Close()
+
+	report, err := store.Verify(false)
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("expected a consistent store, got %+v", report.Problems)
+	}
+}
+
+// runStressWorker saves, reads and deletes entries whose contents are
+// determined by their key, so every worker writes the same blobs, with a
+// cache limit small enough to evict constantly
+func runStressWorker(dir string, worker int) error {
+	store, err := NewStore(dir, 1)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	store.cacheSize = stressKeys * stressSize / 4
+
+	rng := rand.New(rand.NewSource(int64(worker)))
+	for i := 0; i < stressOps; i++ {
+		key := rng.Intn(stressKeys)
+		hash := fmt.Sprintf("k%d", key)
+		data := randomBlob(int64(key), stressSize)
+
+		switch op := rng.Intn(10); {
+		case op < 5:
+			entry := &Entry{Hash: hash, CreatedAt: time.Now(), AccessedAt: time.Now()}
+			if err := store.SetStream(entry, bytes.NewReader(data)); err != nil {
+				return fmt.Errorf("set %s: %w", hash, err)
+			}
+		case op < 9:
+			_, blob, err := store.Open(hash)
+			if err != nil {
+				return fmt.Errorf("open %s: %w", hash, err)
+			}
+			if blob == nil {
+				continue
+			}
+			got, err := io.ReadAll(blob)
+			blob.Close()
+			if err != nil {
+				return fmt.Errorf("read %s: %w", hash, err)
+			}
+			if !bytes.Equal(got, data) {
+				return fmt.Errorf("read %s: contents clobbered", hash)
+			}
+		default:
+			if err := store.Delete(hash); err != nil {
+				return fmt.Errorf("delete %s: %w", hash, err)
+			}
+		}
+	}
+	return nil
+}
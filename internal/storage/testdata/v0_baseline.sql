@@ -0,0 +1,24 @@
+-- cache.db as created by TaskVault 0.1.0, before schema versioning
+CREATE TABLE cache_entries (
+	hash TEXT PRIMARY KEY,
+	metadata TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	accessed_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP,
+	size INTEGER NOT NULL,
+	blob_path TEXT NOT NULL
+);
+
+CREATE INDEX idx_accessed ON cache_entries(accessed_at);
+CREATE INDEX idx_expires ON cache_entries(expires_at);
+CREATE INDEX idx_size ON cache_entries(size);
+
+INSERT INTO cache_entries VALUES (
+	'a3f2b1c8d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2',
+	'{"input_hash":"a3f2b1c8d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2","output_size":5,"task":"lint","user_data":null}',
+	'2025-02-02 14:30:45.123456+00:00',
+	'2025-02-02 14:30:45.123456+00:00',
+	NULL,
+	5,
+	'{{BLOBDIR}}/a3f2b1c8d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2'
+);
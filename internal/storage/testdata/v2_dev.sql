@@ -0,0 +1,27 @@
+-- cache.db from a development build that added key_schema and the
+-- eviction counters ad hoc, without recording a schema version
+CREATE TABLE cache_entries (
+	hash TEXT PRIMARY KEY,
+	metadata TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	accessed_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP,
+	size INTEGER NOT NULL,
+	blob_path TEXT NOT NULL,
+	key_schema INTEGER NOT NULL DEFAULT 1,
+	hit_count INTEGER NOT NULL DEFAULT 0,
+	compute_ms INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO cache_entries VALUES (
+	'b0529528e3c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2a3f2b1c8d5e6f7a8b9c0',
+	'{"task":"build","task_version":"2","user_data":null}',
+	'2025-03-01 10:00:00+00:00',
+	'2025-03-01 10:00:00+00:00',
+	NULL,
+	3,
+	'{{BLOBDIR}}/b0529528e3c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2a3f2b1c8d5e6f7a8b9c0',
+	2,
+	4,
+	1500
+);
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/taskvault/taskvault/internal/tracing"
+)
+
+// storeTx is a write transaction holding the store's write lock. It
+// removes the files of the blobs and chunks it releases only once it has
+// committed, so neither a rollback nor a crash can leave a surviving row
+// without its file; a crash after the commit leaves orphaned files for GC.
+// Its statements run under the context it began with, which rolls it back
+// if done before the commit.
+type storeTx struct {
+	*sql.Tx
+	ctx      context.Context
+	store    *Store
+	released []string
+	done     bool
+}
+
+// begin starts a write transaction, taking the cross-process write lock
+// first so writers queue on it rather than on SQLite's busy timeout
+func (s *Store) begin() (*storeTx, error) {
+	return s.beginContext(context.Background())
+}
+
+// beginContext is begin under ctx, recording the wait for the write lock
+// in ctx's trace. The wait ends with ctx's error once ctx is done.
+func (s *Store) beginContext(ctx context.Context) (*storeTx, error) {
+	_, span := tracing.Start(ctx, "storage.lock_wait")
+	err := s.lock.LockContext(ctx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	return &storeTx{Tx: tx, ctx: ctx, store: s}, nil
+}
+
+// Exec runs a statement within tx under its context
+func (tx *storeTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(tx.ctx, query, args...)
+}
+
+// Query runs a query within tx under its context
+func (tx *storeTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(tx.ctx, query, args...)
+}
+
+// QueryRow runs a single-row query within tx under its context
+func (tx *storeTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(tx.ctx, query, args...)
+}
+
+// contextDB runs statements outside a transaction under a context, so
+// code written against querier or execer honours it as storeTx does
+type contextDB struct {
+	db  *sql.DB
+	ctx context.Context
+}
+
+// withContext returns the store's database bound to ctx
+func (s *Store) withContext(ctx context.Context) contextDB {
+	return contextDB{db: s.db, ctx: ctx}
+}
+
+func (c contextDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c contextDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c contextDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+// release schedules the file of a blob or chunk whose row tx deleted for
+// removal after the commit
+func (tx *storeTx) release(path string) {
+	tx.released = append(tx.released, path)
+}
+
+// Commit commits tx, then removes the files it released. No other writer
+// can store them again in between, as the write lock is still held.
+// Removal failures are left to GC, the rows being gone already.
+func (tx *storeTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	defer tx.unlock()
+
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	for _, path := range tx.released {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// Rollback aborts tx unless it has committed
+func (tx *storeTx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	defer tx.unlock()
+	return tx.Tx.Rollback()
+}
+
+func (tx *storeTx) unlock() {
+	tx.done = true
+	tx.store.lock.Unlock()
+}
@@ -0,0 +1,721 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verify modes, selecting how much of a blob is checked when it is read
+const (
+	VerifyFull = "full" // hash the whole blob before returning it
+	VerifyFast = "fast" // check sizes up front, hash while the blob streams
+	VerifySkip = "skip" // trust the disk
+)
+
+// ErrCorrupt is returned when a blob fails verification. The blob has been
+// quarantined and the entries using it removed by the time it is returned.
+var ErrCorrupt = errors.New("blob corrupted")
+
+// VerifyModeByName validates a verify mode; empty means VerifyFast
+func VerifyModeByName(name string) (string, error) {
+	switch name {
+	case "":
+		return VerifyFast, nil
+	case VerifyFull, VerifyFast, VerifySkip:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unknown verify mode %q (want full, fast or skip)", name)
+	}
+}
+
+// SetVerifyMode selects how Open checks blobs against their content hash.
+// With VerifyFast a mismatch surfaces as an ErrCorrupt error from the
+// blob reader once the blob has been read to the end.
+func (s *Store) SetVerifyMode(mode string) {
+	s.verify = mode
+}
+
+// blobRef locates an entry's blob
+type blobRef struct {
+	hash        string // blob hash
+	path        string
+	codec       string
+	contentHash string // empty for legacy blobs, whose contents were never hashed
+	size        int64  // uncompressed
+	storedSize  int64
+}
+
+// openBlob opens an entry's blob, checked as verify asks, and returns its
+// chunk list if it is chunked. Returns a nil reader if the blob is missing,
+// and an ErrCorrupt error if it fails the checks made before returning.
+func (s *Store) openBlob(ctx context.Context, ref blobRef, verify string) (io.ReadCloser, []ChunkRef, error) {
+	if verify == VerifyFull {
+		blob, _, err := s.openBlob(ctx, ref, VerifyFast)
+		if err != nil || blob == nil {
+			return nil, nil, err
+		}
+		_, err = io.Copy(io.Discard, readContext(ctx, blob))
+		blob.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.openBlob(ctx, ref, VerifySkip)
+	}
+
+	if ref.codec == CodecChunked {
+		chunks, ok, err := s.loadChunks(ref.hash)
+		if err != nil || !ok {
+			return nil, nil, err
+		}
+
+		refs := make([]ChunkRef, len(chunks))
+		for i, chunk := range chunks {
+			refs[i] = chunk.ChunkRef
+
+			info, err := os.Stat(s.chunkPath(chunk.Hash))
+			if err != nil {
+				return nil, nil, nil
+			}
+			if verify != VerifySkip && info.Size() != chunk.storedSize {
+				if _, err := s.quarantineChunk(chunk.Hash); err != nil {
+					return nil, nil, err
+				}
+				return nil, nil, fmt.Errorf("%w: chunk %s has %d bytes, want %d (quarantined)", ErrCorrupt, chunk.Hash, info.Size(), chunk.storedSize)
+			}
+		}
+		return s.openChunks(chunks, verify), refs, nil
+	}
+
+	file, err := os.Open(ref.path)
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	quarantine := func() error {
+		_, err := s.quarantineBlob(ref.hash)
+		return err
+	}
+
+	if verify != VerifySkip {
+		info, err := file.Stat()
+		if err == nil && info.Size() != ref.storedSize {
+			file.Close()
+			if err := quarantine(); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, fmt.Errorf("%w: blob %s has %d bytes, want %d (quarantined)", ErrCorrupt, ref.hash, info.Size(), ref.storedSize)
+		}
+	}
+
+	blob, err := newDecoder(file, ref.codec)
+	if err != nil {
+		if verify == VerifySkip {
+			return nil, nil, err
+		}
+		if qErr := quarantine(); qErr != nil {
+			return nil, nil, qErr
+		}
+		return nil, nil, fmt.Errorf("%w: blob %s: %v (quarantined)", ErrCorrupt, ref.hash, err)
+	}
+	if verify == VerifySkip {
+		return blob, nil, nil
+	}
+	return newVerifyReader(blob, ref.contentHash, ref.size, quarantine), nil, nil
+}
+
+// verifyReader checks a blob or chunk against its content hash and size
+// as it is read. On a mismatch it closes the underlying reader, calls
+// quarantine and fails the read with ErrCorrupt; read errors pass through.
+type verifyReader struct {
+	r          io.ReadCloser
+	hasher     hash.Hash
+	want       string // hex SHA-256; empty checks the size only
+	wantSize   int64
+	n          int64
+	quarantine func() error
+	err        error // set once the contents failed verification
+}
+
+func newVerifyReader(r io.ReadCloser, want string, wantSize int64, quarantine func() error) *verifyReader {
+	return &verifyReader{r: r, hasher: sha256.New(), want: want, wantSize: wantSize, quarantine: quarantine}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	v.n += int64(n)
+
+	switch {
+	case v.n > v.wantSize:
+		return 0, v.fail(fmt.Sprintf("more than %d bytes", v.wantSize))
+	case err == io.EOF && v.n != v.wantSize:
+		return 0, v.fail(fmt.Sprintf("%d bytes, want %d", v.n, v.wantSize))
+	case err == io.EOF && v.want != "" && hex.EncodeToString(v.hasher.Sum(nil)) != v.want:
+		return 0, v.fail("content hash mismatch")
+	}
+	// Other errors, e.g. from the disk, may not recur; the caller gets them
+	// and the contents stay, for Verify to judge
+	return n, err
+}
+
+// fail quarantines the contents and makes every further read fail
+func (v *verifyReader) fail(reason string) error {
+	v.r.Close()
+	v.r = nil
+
+	v.err = fmt.Errorf("%w: %s: %s (quarantined)", ErrCorrupt, v.name(), reason)
+	if err := v.quarantine(); err != nil {
+		v.err = fmt.Errorf("%w: %s: %s (cannot quarantine: %v)", ErrCorrupt, v.name(), reason, err)
+	}
+	return v.err
+}
+
+func (v *verifyReader) name() string {
+	if v.want == "" {
+		return "legacy blob"
+	}
+	return v.want
+}
+
+func (v *verifyReader) Close() error {
+	if v.r == nil {
+		return nil
+	}
+	return v.r.Close()
+}
+
+// quarantinePath returns where a quarantined blob or chunk is kept
+func (s *Store) quarantinePath(name string) string {
+	return filepath.Join(s.quarantineDir, name)
+}
+
+// moveToQuarantine moves a corrupted file out of the store for inspection;
+// a file that is already gone is not an error
+func (s *Store) moveToQuarantine(path, name string) error {
+	if err := os.MkdirAll(s.quarantineDir, 0755); err != nil {
+		return fmt.Errorf("cannot create quarantine directory: %w", err)
+	}
+	if err := os.Rename(path, s.quarantinePath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot quarantine %s: %w", name, err)
+	}
+	return nil
+}
+
+// quarantineBlob moves a corrupted blob to the quarantine directory and
+// removes every entry using it, so it is never served again. Returns the
+// removed entries.
+func (s *Store) quarantineBlob(blobHash string) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	entries, err := s.quarantineBlobTx(tx, blobHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("cannot quarantine blob: %w", err)
+	}
+	return entries, nil
+}
+
+// quarantineBlobTx quarantines a blob within tx, see quarantineBlob
+func (s *Store) quarantineBlobTx(tx *storeTx, blobHash string) ([]string, error) {
+	rows, err := tx.Query(`SELECT hash FROM cache_entries WHERE blob_hash = ?`, blobHash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query entries: %w", err)
+	}
+	var entries []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan entry: %w", err)
+		}
+		entries = append(entries, hash)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM cache_entries WHERE blob_hash = ?`, blobHash); err != nil {
+		return nil, fmt.Errorf("cannot delete entries: %w", err)
+	}
+
+	var codec string
+	if err := tx.QueryRow(`SELECT codec FROM blobs WHERE hash = ?`, blobHash).Scan(&codec); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE hash = ?`, blobHash); err != nil {
+		return nil, fmt.Errorf("cannot release blob: %w", err)
+	}
+
+	if codec == CodecChunked {
+		// The chunks themselves are fine as far as we know
+		if _, err := s.releaseChunks(tx, blobHash); err != nil {
+			return nil, err
+		}
+	} else if err := s.moveToQuarantine(s.blobPath(blobHash), blobHash); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// quarantineChunk moves a corrupted chunk to the quarantine directory and
+// quarantines every blob made from it, in one transaction so no writer
+// can take a new reference on the chunk meanwhile. Returns the removed
+// entries.
+func (s *Store) quarantineChunk(chunkHash string) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.moveToQuarantine(s.chunkPath(chunkHash), chunkHash); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT blob_hash FROM blob_chunks WHERE chunk_hash = ?`, chunkHash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query chunks: %w", err)
+	}
+	var blobs []string
+	for rows.Next() {
+		var blobHash string
+		if err := rows.Scan(&blobHash); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan chunk: %w", err)
+		}
+		blobs = append(blobs, blobHash)
+	}
+	rows.Close()
+
+	var entries []string
+	for _, blobHash := range blobs {
+		removed, err := s.quarantineBlobTx(tx, blobHash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, removed...)
+	}
+
+	// Drops the row of a chunk no blob referenced
+	if _, err := tx.Exec(`DELETE FROM chunks WHERE hash = ?`, chunkHash); err != nil {
+		return nil, fmt.Errorf("cannot release chunk: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("cannot quarantine chunk: %w", err)
+	}
+	return entries, nil
+}
+
+// Kinds of problems found by Verify
+const (
+	ProblemCorruptBlob  = "corrupt_blob"  // contents do not match their hash or size
+	ProblemCorruptChunk = "corrupt_chunk" // likewise for a chunk
+	ProblemMissingBlob  = "missing_blob"  // blob or chunk row whose file is gone
+	ProblemOrphanedFile = "orphaned_file" // blob or chunk file no row refers to
+	ProblemOrphanedRow  = "orphaned_row"  // entry whose blob is unknown, or blob no entry uses
+	ProblemBadRefcount  = "bad_refcount"  // reference count disagrees with its users
+)
+
+// VerifyProblem is one inconsistency found by Verify
+type VerifyProblem struct {
+	Kind    string   `json:"kind"`
+	Hash    string   `json:"hash"` // blob, chunk or entry hash, or file name
+	Detail  string   `json:"detail"`
+	Entries []string `json:"entries,omitempty"` // entries removed by the repair
+}
+
+// VerifyReport summarizes a Verify scan
+type VerifyReport struct {
+	Entries  int             `json:"entries"`
+	Blobs    int             `json:"blobs"`
+	Chunks   int             `json:"chunks"`
+	Problems []VerifyProblem `json:"problems"`
+	Repaired bool            `json:"repaired"`
+}
+
+// Verify re-hashes every blob and chunk and cross-checks the index against
+// the blob and chunk directories. With repair, corrupted and missing blobs
+// are quarantined together with the entries using them, orphaned files and
+// rows are removed and reference counts are corrected.
+func (s *Store) Verify(repair bool) (*VerifyReport, error) {
+	report := &VerifyReport{Repaired: repair}
+
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM cache_entries`).Scan(&report.Entries); err != nil {
+		return nil, fmt.Errorf("cannot count entries: %w", err)
+	}
+
+	if err := s.verifyBlobs(report, repair); err != nil {
+		return nil, err
+	}
+	if err := s.verifyChunks(report, repair); err != nil {
+		return nil, err
+	}
+	if err := s.verifyEntries(report, repair); err != nil {
+		return nil, err
+	}
+	if err := s.verifyFiles(report, repair); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyBlobs checks every blob row against its file and its entries
+func (s *Store) verifyBlobs(report *VerifyReport, repair bool) error {
+	type blobRow struct {
+		blobRef
+		refcount, users int64
+		minSize         int64
+	}
+
+	rows, err := s.db.Query(`
+	SELECT b.hash, b.size, b.codec, b.refcount, COUNT(e.hash),
+		COALESCE(MAX(e.content_hash), ''), COALESCE(MIN(e.size), 0), COALESCE(MAX(e.size), 0)
+	FROM blobs b LEFT JOIN cache_entries e ON e.blob_hash = b.hash
+	GROUP BY b.hash
+	`)
+	if err != nil {
+		return fmt.Errorf("cannot query blobs: %w", err)
+	}
+	var blobs []blobRow
+	for rows.Next() {
+		var b blobRow
+		if err := rows.Scan(&b.hash, &b.storedSize, &b.codec, &b.refcount, &b.users, &b.contentHash, &b.minSize, &b.size); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan blob: %w", err)
+		}
+		b.path = s.blobPath(b.hash)
+		blobs = append(blobs, b)
+	}
+	rows.Close()
+	report.Blobs = len(blobs)
+
+	for _, b := range blobs {
+		if b.users == 0 {
+			report.Problems = append(report.Problems, VerifyProblem{Kind: ProblemOrphanedRow, Hash: b.hash, Detail: "blob used by no entry"})
+			if repair {
+				if err := s.dropBlob(b.hash); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if b.refcount != b.users {
+			report.Problems = append(report.Problems, VerifyProblem{
+				Kind:   ProblemBadRefcount,
+				Hash:   b.hash,
+				Detail: fmt.Sprintf("blob refcount %d, used by %d entries", b.refcount, b.users),
+			})
+			if repair {
+				if err := s.fixRefcount("blobs", blobUsers, b.hash); err != nil {
+					return err
+				}
+			}
+		}
+
+		problem := VerifyProblem{Hash: b.hash}
+		if b.minSize != b.size {
+			problem.Kind = ProblemCorruptBlob
+			problem.Detail = "entries disagree on the blob size"
+		} else if b.codec != CodecChunked {
+			problem.Kind, problem.Detail = s.checkFile(b.path, b.codec, b.contentHash, b.size, b.storedSize)
+		} else if _, ok, err := s.loadChunks(b.hash); err != nil {
+			return err
+		} else if !ok {
+			problem.Kind = ProblemMissingBlob
+			problem.Detail = "chunk list missing"
+		}
+		// Chunked blobs are otherwise checked chunk by chunk
+
+		if problem.Kind == "" {
+			continue
+		}
+		if repair {
+			problem.Entries, err = s.quarantineBlob(b.hash)
+			if err != nil {
+				return err
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+	return nil
+}
+
+// Recounts of a blob's or chunk's users, made under the write lock by the
+// repairs so they see every committed save
+const (
+	blobUsers  = `SELECT COUNT(*) FROM cache_entries WHERE blob_hash = ?`
+	chunkUsers = `SELECT COUNT(*) FROM blob_chunks WHERE chunk_hash = ?`
+)
+
+// fixRefcount sets the reference count of a row of table, blobs or
+// chunks, to its users, counted afresh by the users query. Rows with no
+// users are left to dropBlob or GC.
+func (s *Store) fixRefcount(table, users, hash string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	if err := tx.QueryRow(users, hash).Scan(&count); err != nil {
+		return fmt.Errorf("cannot count users: %w", err)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(`UPDATE `+table+` SET refcount = ? WHERE hash = ?`, count, hash); err != nil {
+		return fmt.Errorf("cannot fix refcount: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot fix refcount: %w", err)
+	}
+	return nil
+}
+
+// dropBlob removes a blob no entry uses, together with its file or chunks.
+// A blob a save has taken up since the scan has its refcount fixed instead.
+func (s *Store) dropBlob(blobHash string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	if err := tx.QueryRow(blobUsers, blobHash).Scan(&count); err != nil {
+		return fmt.Errorf("cannot count users: %w", err)
+	}
+	if count > 0 {
+		tx.Rollback()
+		return s.fixRefcount("blobs", blobUsers, blobHash)
+	}
+
+	if _, err := tx.Exec(`UPDATE blobs SET refcount = 1 WHERE hash = ?`, blobHash); err != nil {
+		return fmt.Errorf("cannot release blob: %w", err)
+	}
+	if _, err := s.releaseBlob(tx, blobHash); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot release blob: %w", err)
+	}
+	return nil
+}
+
+// verifyChunks checks every chunk row against its file and its users
+func (s *Store) verifyChunks(report *VerifyReport, repair bool) error {
+	type chunkRow struct {
+		storedChunk
+		refcount, users int64
+	}
+
+	rows, err := s.db.Query(`
+	SELECT c.hash, c.size, c.codec, c.stored_size, c.refcount,
+		(SELECT COUNT(*) FROM blob_chunks bc WHERE bc.chunk_hash = c.hash)
+	FROM chunks c
+	`)
+	if err != nil {
+		return fmt.Errorf("cannot query chunks: %w", err)
+	}
+	var chunks []chunkRow
+	for rows.Next() {
+		var c chunkRow
+		if err := rows.Scan(&c.Hash, &c.Size, &c.codec, &c.storedSize, &c.refcount, &c.users); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan chunk: %w", err)
+		}
+		chunks = append(chunks, c)
+	}
+	rows.Close()
+	report.Chunks = len(chunks)
+
+	for _, c := range chunks {
+		// Unreferenced chunks may belong to a transfer in progress; they
+		// are left to garbage collection
+		if c.refcount != c.users && c.users > 0 {
+			report.Problems = append(report.Problems, VerifyProblem{
+				Kind:   ProblemBadRefcount,
+				Hash:   c.Hash,
+				Detail: fmt.Sprintf("chunk refcount %d, used %d times", c.refcount, c.users),
+			})
+			if repair {
+				if err := s.fixRefcount("chunks", chunkUsers, c.Hash); err != nil {
+					return err
+				}
+			}
+		}
+
+		kind, detail := s.checkFile(s.chunkPath(c.Hash), c.codec, c.Hash, c.Size, c.storedSize)
+		if kind == "" {
+			continue
+		}
+		if kind == ProblemCorruptBlob {
+			kind = ProblemCorruptChunk
+		}
+
+		problem := VerifyProblem{Kind: kind, Hash: c.Hash, Detail: "chunk " + detail}
+		if repair {
+			problem.Entries, err = s.quarantineChunk(c.Hash)
+			if err != nil {
+				return err
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+	return nil
+}
+
+// checkFile decodes a blob or chunk file and compares it with its expected
+// hash and sizes, returning the kind of problem found, if any
+func (s *Store) checkFile(path, codec, contentHash string, size, storedSize int64) (kind, detail string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ProblemMissingBlob, "file missing"
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() != storedSize {
+		file.Close()
+		return ProblemCorruptBlob, fmt.Sprintf("file has %d bytes, want %d", info.Size(), storedSize)
+	}
+
+	r, err := newDecoder(file, codec)
+	if err != nil {
+		return ProblemCorruptBlob, err.Error()
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, r)
+	switch {
+	case err != nil:
+		return ProblemCorruptBlob, err.Error()
+	case n != size:
+		return ProblemCorruptBlob, fmt.Sprintf("decodes to %d bytes, want %d", n, size)
+	case contentHash != "" && hex.EncodeToString(hasher.Sum(nil)) != contentHash:
+		return ProblemCorruptBlob, "content hash mismatch"
+	}
+	return "", ""
+}
+
+// verifyEntries finds entries whose blob row is gone
+func (s *Store) verifyEntries(report *VerifyReport, repair bool) error {
+	rows, err := s.db.Query(`
+	SELECT hash, blob_hash FROM cache_entries
+	WHERE blob_hash NOT IN (SELECT hash FROM blobs)
+	`)
+	if err != nil {
+		return fmt.Errorf("cannot query entries: %w", err)
+	}
+	var problems []VerifyProblem
+	for rows.Next() {
+		var hash, blobHash string
+		if err := rows.Scan(&hash, &blobHash); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot scan entry: %w", err)
+		}
+		problems = append(problems, VerifyProblem{
+			Kind:   ProblemOrphanedRow,
+			Hash:   hash,
+			Detail: fmt.Sprintf("entry refers to unknown blob %s", blobHash),
+		})
+	}
+	rows.Close()
+
+	for i := range problems {
+		if repair {
+			deleted, err := s.dropOrphanedEntry(problems[i].Hash)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				problems[i].Entries = []string{problems[i].Hash}
+			}
+		}
+	}
+	report.Problems = append(report.Problems, problems...)
+	return nil
+}
+
+// dropOrphanedEntry deletes an entry if its blob row is still unknown
+// once the write lock is held, reporting whether it did
+func (s *Store) dropOrphanedEntry(hash string) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM cache_entries WHERE hash = ? AND blob_hash NOT IN (SELECT hash FROM blobs)`, hash)
+	if err != nil {
+		return false, fmt.Errorf("cannot delete entry: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("cannot delete entry: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("cannot delete entry: %w", err)
+	}
+	return n > 0, nil
+}
+
+// verifyFiles finds blob and chunk files no row refers to. The scan holds
+// the write lock, so files being committed concurrently are not mistaken
+// for orphans.
+func (s *Store) verifyFiles(report *VerifyReport, repair bool) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	files, err := s.strayFiles(tx)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.info.Name()
+		// Temporary files belong to writes in progress, or are left to GC
+		if strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+
+		report.Problems = append(report.Problems, VerifyProblem{
+			Kind:   ProblemOrphanedFile,
+			Hash:   name,
+			Detail: fmt.Sprintf("%s/%s has no row", filepath.Base(filepath.Dir(file.path)), name),
+		})
+		if repair {
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("cannot remove orphaned file: %w", err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// corruptBlob flips one byte of a stored file in place
+func corruptBlob(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenDetectsCorruption(t *testing.T) {
+	data := bytes.Repeat([]byte("build output\n"), 100)
+
+	tests := []struct {
+		mode        string
+		openErr     bool // detected before Open returns
+		readErr     bool // detected at the end of the stream
+		quarantined bool
+	}{
+		{VerifyFull, true, false, true},
+		{VerifyFast, false, true, true},
+		{VerifySkip, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			store := newTestStore(t)
+			store.SetCompression(Compression{Codec: CodecNone})
+			store.SetVerifyMode(tt.mode)
+
+			now := time.Now()
+			entry := &Entry{Hash: "h", Data: data, CreatedAt: now, AccessedAt: now}
+			if err := store.Set(entry); err != nil {
+				t.Fatalf("set error: %v", err)
+			}
+			corruptBlob(t, store.blobPath(entry.BlobHash))
+
+			_, blob, err := store.Open("h")
+			if tt.openErr != errors.Is(err, ErrCorrupt) {
+				t.Fatalf("expected open error %v, got %v", tt.openErr, err)
+			}
+			if err == nil {
+				_, err = io.ReadAll(blob)
+				blob.Close()
+				if tt.readErr != errors.Is(err, ErrCorrupt) {
+					t.Fatalf("expected read error %v, got %v", tt.readErr, err)
+				}
+			}
+
+			_, statErr := os.Stat(store.quarantinePath(entry.BlobHash))
+			if tt.quarantined != (statErr == nil) {
+				t.Errorf("expected quarantined %v, stat says %v", tt.quarantined, statErr)
+			}
+			if got, _ := store.Get("h"); (got == nil) != tt.quarantined {
+				t.Errorf("expected entry removed %v, got %v", tt.quarantined, got)
+			}
+		})
+	}
+}
+
+func TestOpenDetectsTruncatedChunk(t *testing.T) {
+	store := newTestStore(t)
+	data := randomBlob(3, 10<<20)
+
+	if err := store.SetStream(&Entry{Hash: "big"}, bytes.NewReader(data)); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	entry, _ := store.Lookup("big")
+	if err := os.Truncate(store.chunkPath(entry.Chunks[0].Hash), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.Open("big"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected truncated chunk to be detected, got %v", err)
+	}
+	if got, _ := store.Lookup("big"); got != nil {
+		t.Errorf("expected entry using the chunk to be removed")
+	}
+}
+
+func TestVerifyRepair(t *testing.T) {
+	store := newTestStore(t)
+	store.SetCompression(Compression{Codec: CodecNone})
+	now := time.Now()
+
+	for _, hash := range []string{"good", "bad"} {
+		entry := &Entry{Hash: hash, Data: bytes.Repeat([]byte(hash), 100), CreatedAt: now, AccessedAt: now}
+		if err := store.Set(entry); err != nil {
+			t.Fatalf("set error: %v", err)
+		}
+		if hash == "bad" {
+			corruptBlob(t, store.blobPath(entry.BlobHash))
+		}
+	}
+	big := &Entry{Hash: "big", CreatedAt: now, AccessedAt: now}
+	if err := store.SetStream(big, bytes.NewReader(randomBlob(4, 10<<20))); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	corruptBlob(t, store.chunkPath(big.Chunks[1].Hash))
+
+	// A file without a row, a row without a blob and a wrong refcount
+	os.WriteFile(store.blobPath("0123456789abcdef"), []byte("stray"), 0644)
+	store.db.Exec(`INSERT INTO cache_entries (hash, metadata, created_at, accessed_at, size, blob_path, blob_hash) VALUES ('dangling', '{}', ?, ?, 1, '', 'gone')`, now, now)
+	store.db.Exec(`UPDATE blobs SET refcount = 5 WHERE hash = (SELECT blob_hash FROM cache_entries WHERE hash = 'good')`)
+
+	report, err := store.Verify(false)
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	kinds := make(map[string]int)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	want := map[string]int{
+		ProblemCorruptBlob:  1,
+		ProblemCorruptChunk: 1,
+		ProblemOrphanedFile: 1,
+		ProblemOrphanedRow:  1,
+		ProblemBadRefcount:  1,
+	}
+	for kind, n := range want {
+		if kinds[kind] != n {
+			t.Errorf("expected %d %s, got %d (%+v)", n, kind, kinds[kind], report.Problems)
+		}
+	}
+	if got, _ := store.Lookup("bad"); got == nil {
+		t.Fatalf("expected verify without repair to change nothing")
+	}
+
+	if _, err := store.Verify(true); err != nil {
+		t.Fatalf("repair error: %v", err)
+	}
+	report, err = store.Verify(false)
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatalf("expected no problems after repair, got %+v (%v)", report, err)
+	}
+
+	for hash, kept := range map[string]bool{"good": true, "bad": false, "big": false, "dangling": false} {
+		if got, _ := store.Get(hash); (got != nil) != kept {
+			t.Errorf("expected %s kept %v", hash, kept)
+		}
+	}
+	if _, err := os.Stat(store.quarantinePath(big.Chunks[1].Hash)); err != nil {
+		t.Errorf("expected corrupted chunk in quarantine: %v", err)
+	}
+}
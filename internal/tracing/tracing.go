@@ -0,0 +1,80 @@
+// Package tracing creates the OpenTelemetry spans TaskVault records around
+// hashing, lookups, blob I/O and eviction. Spans go to the global tracer
+// provider, a no-op unless the program installs one or calls ToFile.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer TaskVault's spans come from
+const instrumentation = "github.com/taskvault/taskvault"
+
+// Attribute keys shared by the spans of each package
+const (
+	Task   = attribute.Key("taskvault.task")
+	Key    = attribute.Key("taskvault.key")
+	Hit    = attribute.Key("taskvault.hit")
+	Size   = attribute.Key("taskvault.size")        // bytes of output
+	Stored = attribute.Key("taskvault.stored_size") // bytes on disk
+	Codec  = attribute.Key("taskvault.codec")
+	Files  = attribute.Key("taskvault.files")
+	Path   = attribute.Key("taskvault.path")
+	Count  = attribute.Key("taskvault.count")
+	Freed  = attribute.Key("taskvault.freed") // bytes released on disk
+)
+
+// Start starts a span named name as a child of any span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, recording err on it if set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ToFile installs a global tracer provider writing finished spans to path
+// as JSON, one span per line, for offline inspection. The returned
+// function flushes and closes the file.
+func ToFile(path string) (shutdown func(context.Context) error, err error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open trace file: %w", err)
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot create trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("taskvault"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
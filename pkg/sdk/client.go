@@ -1,14 +1,29 @@
 package sdk
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 
 	"github.com/taskvault/taskvault/internal/cache"
 	"github.com/taskvault/taskvault/internal/config"
-	"github.com/taskvault/taskvault/internal/hash"
+	"github.com/taskvault/taskvault/internal/tracing"
 )
 
-// Client is the programmatic interface to TaskVault
+// TaskKey identifies a task by name, version and environment inputs
+type TaskKey = cache.TaskKey
+
+// EnvInputs declares the environment a task depends on
+type EnvInputs = cache.EnvInputs
+
+// Client is the programmatic interface to TaskVault.
+//
+// Each operation has a variant taking a context.Context, which cancels it
+// and carries the caller's trace. A lookup whose deadline expires returns
+// a miss rather than an error, so a slow cache never fails the task;
+// cancelling a lookup, or a save running past its deadline, is an error.
 type Client struct {
 	manager *cache.Manager
 	config  *config.Config
@@ -25,7 +40,7 @@ func NewClient(configPath string) (*Client, error) {
 		return nil, fmt.Errorf("config validation: %w", err)
 	}
 
-	manager, err := cache.NewManager(cfg.CacheDir, cfg.MaxSizeGB, hash.HashAlgorithm(cfg.HashAlgo))
+	manager, err := cache.NewManagerFromConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("manager error: %w", err)
 	}
@@ -38,21 +53,199 @@ func NewClient(configPath string) (*Client, error) {
 
 // CacheResult wraps result saving with convenience
 func (c *Client) CacheResult(taskName string, input []byte, output []byte) (cacheKey string, err error) {
-	return c.manager.SaveResult(taskName, input, output, nil)
+	return c.CacheResultContext(context.Background(), taskName, input, output)
+}
+
+// CacheResultContext is CacheResult under ctx
+func (c *Client) CacheResultContext(ctx context.Context, taskName string, input []byte, output []byte) (cacheKey string, err error) {
+	return c.CacheTaskResultContext(ctx, TaskKey{Name: taskName}, input, output)
 }
 
 // GetCachedResult retrieves a result with hit/miss info
 func (c *Client) GetCachedResult(taskName string, input []byte) (output []byte, hit bool, err error) {
-	result, _, found, err := c.manager.GetResult(taskName, input)
+	return c.GetCachedResultContext(context.Background(), taskName, input)
+}
+
+// GetCachedResultContext is GetCachedResult under ctx
+func (c *Client) GetCachedResultContext(ctx context.Context, taskName string, input []byte) (output []byte, hit bool, err error) {
+	return c.GetCachedTaskResultContext(ctx, TaskKey{Name: taskName}, input)
+}
+
+// CacheTaskResult saves a result under a composite task key
+func (c *Client) CacheTaskResult(key TaskKey, input []byte, output []byte) (cacheKey string, err error) {
+	return c.CacheTaskResultContext(context.Background(), key, input, output)
+}
+
+// CacheTaskResultContext is CacheTaskResult under ctx
+func (c *Client) CacheTaskResultContext(ctx context.Context, key TaskKey, input []byte, output []byte) (cacheKey string, err error) {
+	return c.manager.SaveTaskResultContext(ctx, key, input, output, nil)
+}
+
+// GetCachedTaskResult retrieves a result by composite task key
+func (c *Client) GetCachedTaskResult(key TaskKey, input []byte) (output []byte, hit bool, err error) {
+	return c.GetCachedTaskResultContext(context.Background(), key, input)
+}
+
+// GetCachedTaskResultContext is GetCachedTaskResult under ctx
+func (c *Client) GetCachedTaskResultContext(ctx context.Context, key TaskKey, input []byte) (output []byte, hit bool, err error) {
+	result, _, found, err := c.manager.GetTaskResultContext(ctx, key, input)
 	return result, found, err
 }
 
+// CacheResultForFiles saves a result keyed by a set of input files.
+// Patterns may be files, directories or globs ("**" matches any depth).
+func (c *Client) CacheResultForFiles(key TaskKey, inputPatterns []string, output []byte) (cacheKey string, err error) {
+	return c.CacheResultForFilesContext(context.Background(), key, inputPatterns, output)
+}
+
+// CacheResultForFilesContext is CacheResultForFiles under ctx
+func (c *Client) CacheResultForFilesContext(ctx context.Context, key TaskKey, inputPatterns []string, output []byte) (cacheKey string, err error) {
+	inputHash, err := c.manager.HashInputsContext(ctx, inputPatterns)
+	if err != nil {
+		return "", err
+	}
+	return c.manager.SaveByInputHashContext(ctx, key, inputHash, output, nil)
+}
+
+// GetCachedResultForFiles retrieves a result keyed by a set of input files
+func (c *Client) GetCachedResultForFiles(key TaskKey, inputPatterns []string) (output []byte, hit bool, err error) {
+	return c.GetCachedResultForFilesContext(context.Background(), key, inputPatterns)
+}
+
+// GetCachedResultForFilesContext is GetCachedResultForFiles under ctx
+func (c *Client) GetCachedResultForFilesContext(ctx context.Context, key TaskKey, inputPatterns []string) (output []byte, hit bool, err error) {
+	inputHash, err := c.manager.HashInputsContext(ctx, inputPatterns)
+	if err != nil {
+		return nil, false, lookupError(err)
+	}
+	result, _, found, err := c.manager.GetByInputHashContext(ctx, key, inputHash)
+	return result, found, err
+}
+
+// CacheOutputs archives output files and directories keyed by a set of
+// input files, preserving relative paths, permissions, symlinks and mtimes
+func (c *Client) CacheOutputs(key TaskKey, inputPatterns []string, outputPaths []string) (cacheKey string, err error) {
+	return c.CacheOutputsContext(context.Background(), key, inputPatterns, outputPaths)
+}
+
+// CacheOutputsContext is CacheOutputs under ctx
+func (c *Client) CacheOutputsContext(ctx context.Context, key TaskKey, inputPatterns []string, outputPaths []string) (cacheKey string, err error) {
+	inputHash, err := c.manager.HashInputsContext(ctx, inputPatterns)
+	if err != nil {
+		return "", err
+	}
+	return c.manager.SaveOutputsContext(ctx, key, inputHash, outputPaths, nil)
+}
+
+// RestoreOutputs restores archived outputs below dest on a cache hit
+func (c *Client) RestoreOutputs(key TaskKey, inputPatterns []string, dest string) (hit bool, err error) {
+	return c.RestoreOutputsContext(context.Background(), key, inputPatterns, dest)
+}
+
+// RestoreOutputsContext is RestoreOutputs under ctx
+func (c *Client) RestoreOutputsContext(ctx context.Context, key TaskKey, inputPatterns []string, dest string) (hit bool, err error) {
+	inputHash, err := c.manager.HashInputsContext(ctx, inputPatterns)
+	if err != nil {
+		return false, lookupError(err)
+	}
+	_, hit, err = c.manager.RestoreOutputsContext(ctx, key, inputHash, dest)
+	return hit, err
+}
+
+// CacheStream saves a result read from output without buffering it in
+// memory, keyed by a set of input files
+func (c *Client) CacheStream(key TaskKey, inputPatterns []string, output io.Reader) (cacheKey string, err error) {
+	return c.CacheStreamContext(context.Background(), key, inputPatterns, output)
+}
+
+// CacheStreamContext is CacheStream under ctx
+func (c *Client) CacheStreamContext(ctx context.Context, key TaskKey, inputPatterns []string, output io.Reader) (cacheKey string, err error) {
+	inputHash, err := c.manager.HashInputsContext(ctx, inputPatterns)
+	if err != nil {
+		return "", err
+	}
+	return c.manager.SaveStreamContext(ctx, key, inputHash, output, nil)
+}
+
+// GetCachedStream copies a cached result into w on a hit
+func (c *Client) GetCachedStream(key TaskKey, inputPatterns []string, w io.Writer) (hit bool, err error) {
+	return c.GetCachedStreamContext(context.Background(), key, inputPatterns, w)
+}
+
+// GetCachedStreamContext is GetCachedStream under ctx. A deadline expiring
+// once copying into w has begun is an error, w holding part of the result.
+func (c *Client) GetCachedStreamContext(ctx context.Context, key TaskKey, inputPatterns []string, w io.Writer) (hit bool, err error) {
+	inputHash, err := c.manager.HashInputsContext(ctx, inputPatterns)
+	if err != nil {
+		return false, lookupError(err)
+	}
+
+	blob, _, found, err := c.manager.OpenResultContext(ctx, key, inputHash)
+	if err != nil || !found {
+		return false, err
+	}
+	defer blob.Close()
+
+	if _, err := io.Copy(w, blob); err != nil {
+		return false, fmt.Errorf("read error: %w", err)
+	}
+	return true, nil
+}
+
+// lookupError returns the error a lookup failed with, or nil for its
+// deadline expiring, which makes it a miss
+func lookupError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// InvalidateTask removes all of a task's cached results, returning the
+// number removed
+func (c *Client) InvalidateTask(taskName string) (int, error) {
+	return c.InvalidateTaskContext(context.Background(), taskName)
+}
+
+// InvalidateTaskContext is InvalidateTask under ctx. Results removed before
+// ctx is done stay removed, and are counted.
+func (c *Client) InvalidateTaskContext(ctx context.Context, taskName string) (int, error) {
+	return c.manager.InvalidateTaskContext(ctx, taskName)
+}
+
 // GetStats returns current cache statistics
 func (c *Client) GetStats() (map[string]interface{}, error) {
-	return c.manager.GetStats()
+	return c.GetStatsContext(context.Background())
 }
 
-// Close cleanly shuts down the client
+// GetStatsContext is GetStats under ctx
+func (c *Client) GetStatsContext(ctx context.Context) (map[string]interface{}, error) {
+	return c.manager.GetStatsContext(ctx)
+}
+
+// MetricsHandler enables metrics on the client's cache operations and
+// returns a handler serving them in the Prometheus text format, e.g. to
+// mount on /metrics
+func (c *Client) MetricsHandler() http.Handler {
+	return c.manager.EnableMetrics().Handler()
+}
+
+// TraceToFile records OpenTelemetry spans for the client's cache operations
+// (and any other instrumented code in the process) to path, one JSON span
+// per line. Programs with their own tracer provider need not call it: the
+// spans go to the global provider. Call the returned function before
+// exiting to flush them.
+func TraceToFile(path string) (shutdown func(context.Context) error, err error) {
+	return tracing.ToFile(path)
+}
+
+// Close cleanly shuts down the client, waiting for operations in flight
 func (c *Client) Close() error {
 	return c.manager.Close()
 }
+
+// CloseContext is Close, waiting for operations in flight only until ctx
+// is done. It then returns ctx's error and leaves the client open.
+func (c *Client) CloseContext(ctx context.Context) error {
+	return c.manager.CloseContext(ctx)
+}